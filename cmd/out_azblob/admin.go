@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+type FlushFunc func(timeSlice string) (int, error)
+
+type MetricsFunc func(w io.Writer)
+
+// Admin serves the HTTP endpoints which operators use on a running plugin.
+// POST /flush sends the open batches right away instead of after BatchWait;
+// with ?time_slice=... only the batches holding records of that time slice.
+// GET /metrics serves the metrics in the Prometheus text format.
+type Admin struct {
+	listener net.Listener
+	server   *http.Server
+	flush    FlushFunc
+	metrics  MetricsFunc
+	logger   *logrus.Entry
+	wg       sync.WaitGroup
+}
+
+func NewAdmin(addr string, l *logrus.Entry, flush FlushFunc,
+	metrics MetricsFunc) (*Admin, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Admin_Listen: %v", err)
+	}
+
+	a := &Admin{
+		listener: listener,
+		flush:    flush,
+		metrics:  metrics,
+		logger:   l,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flush", a.handleFlush)
+	mux.HandleFunc("/metrics", a.handleMetrics)
+	a.server = &http.Server{Handler: mux}
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		err := a.server.Serve(listener)
+		if err != http.ErrServerClosed {
+			l.Errorf("admin server error: %v", err)
+		}
+	}()
+	l.Infof("admin server listening on %s", listener.Addr())
+
+	return a, nil
+}
+
+func (a *Admin) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeSlice := r.URL.Query().Get("time_slice")
+	n, err := a.flush(timeSlice)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	a.logger.Infof("flush requested, time_slice=%s batches=%d", timeSlice, n)
+	fmt.Fprintf(w, "%d batches flushed\n", n)
+}
+
+func (a *Admin) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	a.metrics(w)
+}
+
+// Stop closes the listener and the open connections.
+func (a *Admin) Stop() {
+	a.server.Close()
+	a.wg.Wait()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// DefaultAppInsightsEndpoint is the ingestion endpoint of connection strings
+// which don't name one, and DefaultAppInsightsInterval the time between two
+// exports.
+const (
+	DefaultAppInsightsEndpoint = "https://dc.services.visualstudio.com/"
+	DefaultAppInsightsInterval = time.Minute
+)
+
+// AppInsightsTimeout bounds an export, so a slow endpoint doesn't hold up the
+// next one.
+const AppInsightsTimeout = 5 * time.Second
+
+// AppInsights is where the counters of the uploader are exported to, an
+// Application Insights resource of Azure Monitor.
+type AppInsights struct {
+	InstrumentationKey string
+	URL                url.URL
+	Pipeline           pipeline.Pipeline
+	Interval           time.Duration
+}
+
+// newAppInsights parses a connection string of Application Insights, e.g.
+// "InstrumentationKey=...;IngestionEndpoint=https://...". The telemetry is
+// sent to the track endpoint of its ingestion endpoint.
+func newAppInsights(connectionString string, interval time.Duration,
+	options azblob.PipelineOptions) (*AppInsights, error) {
+	fields := map[string]string{}
+	for _, pair := range strings.Split(connectionString, ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.IndexByte(pair, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid AppInsights_Connection_String, expected key=value: %s", pair)
+		}
+		fields[strings.ToLower(strings.TrimSpace(pair[:i]))] = strings.TrimSpace(pair[i+1:])
+	}
+
+	a := &AppInsights{
+		InstrumentationKey: fields["instrumentationkey"],
+		Interval:           interval,
+		// the instrumentation key authenticates the telemetry
+		Pipeline: azblob.NewPipeline(azblob.NewAnonymousCredential(), options),
+	}
+	if a.InstrumentationKey == "" {
+		return nil, fmt.Errorf("invalid AppInsights_Connection_String, no InstrumentationKey")
+	}
+
+	endpoint := fields["ingestionendpoint"]
+	if endpoint == "" {
+		endpoint = DefaultAppInsightsEndpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid AppInsights_Connection_String, bad IngestionEndpoint: %s", endpoint)
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/v2/track"
+	a.URL = *u
+
+	return a, nil
+}
+
+// counters are the totals of the uploader which are exported.
+type counters struct {
+	uploads   uint64
+	sentBytes uint64
+	failures  uint64
+}
+
+func (u *AzblobUploader) counters() counters {
+	return counters{
+		uploads:   atomic.LoadUint64(&u.uploads),
+		sentBytes: atomic.LoadUint64(&u.sentBytes),
+		failures:  atomic.LoadUint64(&u.failures),
+	}
+}
+
+// exportMetrics sends what the counters grew by since the last export to
+// AppInsights, as one metric per counter. It's best-effort: a failure is only
+// logged, and the growth is sent with the next export.
+func (u *AzblobUploader) exportMetrics() {
+	u.exportMu.Lock()
+	defer u.exportMu.Unlock()
+
+	a := u.config.AppInsights
+	current := u.counters()
+	now := u.now().UTC().Format(time.RFC3339Nano)
+
+	var envelopes []map[string]interface{}
+	for _, m := range []struct {
+		name  string
+		value uint64
+	}{
+		{"azblob_uploads_total", current.uploads - u.exported.uploads},
+		{"azblob_uploaded_bytes_total", current.sentBytes - u.exported.sentBytes},
+		{"azblob_upload_failures_total", current.failures - u.exported.failures},
+	} {
+		envelopes = append(envelopes, map[string]interface{}{
+			"name": "Microsoft.ApplicationInsights.Metric",
+			"time": now,
+			"iKey": a.InstrumentationKey,
+			"tags": map[string]string{
+				"ai.cloud.role":         "fluent-bit-go-azblob",
+				"ai.cloud.roleInstance": InstanceID,
+			},
+			"data": map[string]interface{}{
+				"baseType": "MetricData",
+				"baseData": map[string]interface{}{
+					"ver": 2,
+					"metrics": []map[string]interface{}{
+						{"name": m.name, "kind": 0, "value": m.value, "count": 1},
+					},
+					"properties": map[string]string{
+						"hostname": Hostname,
+						"version":  Version,
+					},
+				},
+			},
+		})
+	}
+
+	body, err := jsoniter.Marshal(envelopes)
+	if err != nil {
+		u.logger.Warnf("encode metrics error: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AppInsightsTimeout)
+	defer cancel()
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	_, _, err = doRequest(ctx, a.Pipeline, http.MethodPost, a.URL, header, body)
+	if err != nil {
+		u.logger.Warnf("export metrics error, endpoint=%s: %v", a.URL.Host, err)
+		return
+	}
+
+	u.exported = current
+	u.logger.Debug("metrics exported")
+}
@@ -0,0 +1,176 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// The tests in this file run against Azurite, the storage emulator:
+//
+//	azurite-blob --skipApiVersionCheck --loose &
+//	make test-integration
+//
+// AZURITE_BLOB_URL points them at another emulator; they use its well-known
+// development account.
+const (
+	AzuriteAccount = "devstoreaccount1"
+	AzuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// azuriteConfig returns the settings of a new container in Azurite, using an
+// account SAS as the emulator takes path-style URLs, which the account name
+// of shared key signing can't be derived from.
+func azuriteConfig(t *testing.T) mapConfig {
+	serviceURL := os.Getenv("AZURITE_BLOB_URL")
+	if serviceURL == "" {
+		serviceURL = "http://127.0.0.1:10000/" + AzuriteAccount
+	}
+
+	credential, err := azblob.NewSharedKeyCredential(AzuriteAccount, AzuriteKey)
+	if err != nil {
+		t.Fatalf("NewSharedKeyCredential fails: %v", err)
+	}
+	sas, err := azblob.AccountSASSignatureValues{
+		Protocol:      azblob.SASProtocolHTTPSandHTTP,
+		ExpiryTime:    time.Now().UTC().Add(time.Hour),
+		Permissions:   azblob.AccountSASPermissions{Read: true, Write: true, Add: true, Create: true, List: true}.String(),
+		Services:      azblob.AccountSASServices{Blob: true}.String(),
+		ResourceTypes: azblob.AccountSASResourceTypes{Container: true, Object: true}.String(),
+	}.NewSASQueryParameters(credential)
+	if err != nil {
+		t.Fatalf("NewSASQueryParameters fails: %v", err)
+	}
+
+	return mapConfig{
+		"Azure_Service_URL":     serviceURL,
+		"Azure_Storage_SAS":     sas.Encode(),
+		"Azure_Container":       "integration-" + uuid.NewV4().String()[:8],
+		"Auto_Create_Container": "true",
+	}
+}
+
+// download reads a whole blob, decompressing every gzip member of it.
+func download(t *testing.T, cfg *AzblobConfig, objectKey string) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	blobURL := cfg.ContainerURLs[0].NewBlobURL(objectKey)
+	resp, err := blobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		t.Fatalf("download fails: %v", err)
+	}
+	body := resp.Body(azblob.RetryReaderOptions{})
+	defer body.Close()
+
+	// gzip.Reader reads concatenated members as one stream by default.
+	r, err := gzip.NewReader(body)
+	if err != nil {
+		t.Fatalf("read gzip header fails: %v", err)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, AppendBlockSize)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("decompress fails after %d lines: %v", len(lines), err)
+	}
+
+	return lines
+}
+
+func TestIntegrationGzipAppends(t *testing.T) {
+	conf := azuriteConfig(t)
+	conf["Blob_Type"] = "append"
+	conf["StoreAs"] = "gzip"
+	conf["Batch_Limit_Size"] = "16KB"
+	conf["Preserve_Order"] = "true"
+	conf["Shutdown_Timeout"] = "60"
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		t.Fatalf("NewConfig fails: %v", err)
+	}
+
+	u, err := NewUploader(cfg, NewLogger("testing", logrus.InfoLevel))
+	if err != nil {
+		t.Fatalf("NewUploader fails: %v", err)
+	}
+
+	// Small records make many batches, so many appended members; a few large
+	// ones make members of their own.
+	k := BatchKey{ObjectKeyFormat: "integration/appends.log.gz"}
+	var expected []string
+	for i := 0; i < 20000; i++ {
+		record := fmt.Sprintf(`{"n":%d}`, i)
+		if i%5000 == 4999 {
+			record = fmt.Sprintf(`{"n":%d,"pad":"%s"}`, i, strings.Repeat("x", 1024*1024))
+		}
+		expected = append(expected, record)
+		u.Entries <- Entry{Key: k, Time: time.Now(), Raw: []byte(record)}
+	}
+	u.Stop()
+	assert.NoError(t, u.Err())
+
+	lines := download(t, cfg, "integration/appends.log.gz")
+	assert.Equal(t, len(expected), len(lines))
+	for i := range expected {
+		if i >= len(lines) || lines[i] != expected[i] {
+			t.Fatalf("record %d is missing or out of order", i)
+		}
+	}
+}
+
+func TestIntegrationGzipAppendsAcrossRestarts(t *testing.T) {
+	conf := azuriteConfig(t)
+	conf["Blob_Type"] = "append"
+	conf["StoreAs"] = "gzip"
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		t.Fatalf("NewConfig fails: %v", err)
+	}
+
+	// Every run appends to the blob the previous one left. The second one
+	// sends a batch over AppendBlockSize, which is split into several members.
+	k := BatchKey{ObjectKeyFormat: "integration/restarts.log.gz"}
+	var expected []string
+	for run := 0; run < 3; run++ {
+		u, err := NewUploader(cfg, NewLogger("testing", logrus.InfoLevel))
+		if err != nil {
+			t.Fatalf("NewUploader fails: %v", err)
+		}
+		for i := 0; i < 100; i++ {
+			record := fmt.Sprintf(`{"run":%d,"n":%d}`, run, i)
+			expected = append(expected, record)
+			u.sendBatch(k, appendRecord(nil, []byte(record)), Source{})
+		}
+		if run == 1 {
+			var b []byte
+			for i := 0; i < 6000; i++ {
+				record := fmt.Sprintf(`{"run":%d,"big":%d,"pad":"%s"}`, run, i, strings.Repeat("x", 1024))
+				expected = append(expected, record)
+				b = appendRecord(b, []byte(record))
+			}
+			u.sendBatch(k, b, Source{})
+		}
+		u.Stop()
+		assert.NoError(t, u.Err())
+	}
+
+	assert.Equal(t, expected, download(t, cfg, "integration/restarts.log.gz"))
+}
@@ -1,24 +1,141 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"code.cloudfoundry.org/bytefmt"
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/sirupsen/logrus"
 )
 
 // Default configuration
 const (
-	DefaultObjectKeyFormat = "%{path}%{time_slice}_%{uuid}.%{file_extension}"
-	DefaultTimeSliceFormat = "2006010215-04"
-	DefaultLogLevel        = "info"
-	DefaultBatchWait       = 5 * time.Second
-	DefaultBatchLimitSize  = 32 * 1024 // 32k
+	DefaultObjectKeyFormat  = "%{path}%{time_slice}_%{uuid}.%{file_extension}"
+	DefaultFlatKeyFormat    = "%{path}%{tag}/%{hostname}/%{time_slice}_%{uuid}.%{file_extension}"
+	DefaultTimeSliceFormat  = "2006010215-04"
+	DefaultUploadDateFormat = "20060102"
+	DefaultLogLevel         = "info"
+	DefaultBatchWait        = 5 * time.Second
+	DefaultBatchLimitSize   = 32 * 1024 // 32k
+	DefaultRawKey           = "_raw"
+	DefaultClusterKey       = "cluster"
+	DefaultRegionKey        = "region"
+	DefaultRoute            = "default"
+	DefaultLevelKey         = "level"
+	DefaultMessageKey       = "log"
+	DefaultLevel            = "unknown"
+	DefaultErrorLevel       = "error"
+	DefaultTimeFormat       = time.RFC3339Nano
+	DefaultSpoolRetry       = 30 * time.Second
+	DefaultAppendBufferAge  = time.Minute
+	DefaultOpenBlobsLimit   = 1024
+	DefaultMaxIdleConns     = 100
+	DefaultIdleConnTimeout  = 90 * time.Second
+	DefaultKeepAlive        = 30 * time.Second
+	DefaultDeadLetterPrefix = "deadletter/"
+	DefaultInvalidPrefix    = "invalid/"
+	DefaultHeartbeatKey     = "heartbeat/%{hostname}.json"
+	DefaultShutdownTimeout  = 4 * time.Second // below the 5s grace of fluent-bit
+	DefaultUploadTimeout    = Timeout * time.Second
+)
+
+// MaxIndexTags is the number of index tags a blob can have, and
+// MaxIndexTagKey and MaxIndexTagValue the length of their keys and values.
+const (
+	MaxIndexTags     = 10
+	MaxIndexTagKey   = 128
+	MaxIndexTagValue = 256
+)
+
+// KeyPlaceholders are the placeholders of the object key formats, besides
+// %{record.<key>}.
+var KeyPlaceholders = []string{
+	"path", "time_slice", "upload_date", "uuid", "hostname", "instance_id", "file_extension",
+	"route", "tag", "level", "hash", "part", "namespace", "pod", "container", "deployment",
+	"image",
+}
+
+var keyPlaceholder = regexp.MustCompile(`%\{([^{}]*)\}`)
+
+// Fields which may compose the batch key, each with a placeholder of the same
+// name in the object key formats.
+const (
+	BatchKeyTimeSlice = "time_slice"
+	BatchKeyRoute     = "route"
+	BatchKeyTag       = "tag"
+	BatchKeyLevel     = "level"
+	BatchKeyImage     = "image"
+)
+
+// RolloverFormats are the time formats of the Rollover granularities. A new
+// blob is started whenever the formatted time changes.
+var RolloverFormats = map[string]string{
+	"daily":    "20060102",
+	"hourly":   "2006010215",
+	"minutely": "200601021504",
+}
+
+var (
+	BatchKeyNames         = []string{BatchKeyTimeSlice, BatchKeyRoute, BatchKeyTag, BatchKeyLevel, BatchKeyImage}
+	DefaultBatchKeyFields = []string{BatchKeyTimeSlice, BatchKeyRoute}
+	FlatBatchKeyFields    = []string{BatchKeyTimeSlice, BatchKeyTag}
+)
+
+type Mode string
+
+const (
+	// KubernetesMode looks into the records for Kubernetes metadata.
+	KubernetesMode Mode = "kubernetes"
+	// FlatMode treats every record as an opaque line, for hosts without
+	// Kubernetes. Blobs are named only by the tag, the hostname and the time.
+	FlatMode Mode = "flat"
+)
+
+// RecordFormat is the shape of the records written to the blobs.
+type RecordFormat string
+
+const (
+	// JSONRecordFormat writes the records as they are, as JSON.
+	JSONRecordFormat RecordFormat = "json"
+	// LogAnalyticsFormat writes the records in the shape of the
+	// ContainerLogV2 table of Azure Monitor, for ingestion into Log
+	// Analytics.
+	LogAnalyticsFormat RecordFormat = "loganalytics"
+)
+
+// RestartPolicy is what happens to the blobs written before a restart.
+type RestartPolicy string
+
+const (
+	// AppendOnRestart keeps writing to the blobs of the same name.
+	AppendOnRestart RestartPolicy = "append"
+	// NewOnRestart names the blobs after the start of the plugin, so every
+	// run writes blobs of its own.
+	NewOnRestart RestartPolicy = "new"
+)
+
+// ContainerNamePolicy is what happens to an Azure_Container which isn't a
+// valid container name.
+type ContainerNamePolicy string
+
+const (
+	// SanitizeContainerName lowercases the name and replaces the invalid
+	// characters with hyphens.
+	SanitizeContainerName ContainerNamePolicy = "sanitize"
+	// StrictContainerName refuses to start.
+	StrictContainerName ContainerNamePolicy = "strict"
 )
 
 type FileFormat string
@@ -28,17 +145,148 @@ const (
 	GzipFormat      FileFormat = "gz"
 )
 
+type BlobType string
+
+const (
+	BlockBlob  BlobType = "block"
+	AppendBlob BlobType = "append"
+	// UniqueBlob writes every batch to a new block blob and never overwrites
+	// or appends to an existing one.
+	UniqueBlob BlobType = "unique"
+)
+
+// BatchRule overrides BatchWait and BatchLimitSize for the batches whose
+// object key matches Pattern. A zero Wait or LimitSize keeps the default.
+type BatchRule struct {
+	Pattern   string
+	Wait      time.Duration
+	LimitSize uint64
+}
+
+// TagKeyFormat is the object key format of the records whose tag matches
+// Pattern.
+type TagKeyFormat struct {
+	Pattern         string
+	ObjectKeyFormat string
+}
+
+// Route sends the records matching all its Conditions to Container, with
+// blobs named by ObjectKeyFormat. An empty Container or ObjectKeyFormat keeps
+// the default one.
+type Route struct {
+	Conditions      []RouteCondition
+	Container       string
+	ObjectKeyFormat string
+}
+
+// RouteCondition matches the field of a record at Path, or the tag when Path
+// is nil, against Pattern.
+type RouteCondition struct {
+	Path    []string
+	Pattern string
+}
+
 type AzblobConfig struct {
-	ContainerURL        azblob.ContainerURL
-	AutoCreateContainer bool
-	StoreAs             FileFormat
-	ObjectKeyFormat     string
-	TimeSliceFormat     string
-	BatchWait           time.Duration
-	BatchLimitSize      uint64
-	BatchRetryLimit     *uint64
-	Location            *time.Location
-	LogLevel            logrus.Level
+	ContainerURLs           []azblob.ContainerURL
+	Pipelines               []pipeline.Pipeline
+	NotifyQueue             *url.URL
+	NotifyPipeline          pipeline.Pipeline
+	WebhookURL              *url.URL
+	WebhookClient           *http.Client
+	WebhookTimeout          time.Duration
+	WebhookRetries          int
+	AppInsights             *AppInsights
+	Retry                   azblob.RetryOptions
+	UserAgent               string
+	Container               string
+	ContainerRenamedFrom    string
+	ContainerNamePolicy     ContainerNamePolicy
+	AutoCreateContainer     bool
+	PrecreateContainers     []string
+	Mode                    Mode
+	KubernetesPrefix        string
+	StoreAs                 FileFormat
+	CompressionMinBytes     uint64
+	GzipContentEncoding     bool
+	BlobType                BlobType
+	ObjectKeyFormat         string
+	FallbackObjectKeyFormat string
+	TagKeyFormats           []TagKeyFormat
+	Routes                  []Route
+	TimeSliceFormat         string
+	UploadDateFormat        string
+	ClockSkewLimit          time.Duration
+	BatchWait               time.Duration
+	BatchMaxAge             time.Duration
+	LateRecordGrace         time.Duration
+	BatchLimitSize          uint64
+	BatchRules              []BatchRule
+	SourceShare             float64
+	CoalesceTimeSlices      int
+	DedupWindow             int
+	BatchKeyFields          map[string]bool
+	BatchRetryLimit         *uint64
+	MaxBlobSize             uint64
+	MaxBlobBlocks           int
+	OnRestart               RestartPolicy
+	BlobTargetSize          uint64
+	OpenBlobsLimit          int
+	UploadParallelism       int
+	MaxIdleConnsPerHost     int
+	IdleConnTimeout         time.Duration
+	KeepAlive               time.Duration
+	FinalizeMarker          string
+	FinalizeMetadata        bool
+	RecordCountMetadata     bool
+	SequenceMetadata        bool
+	CreateFirst             bool
+	WriteBOM                bool
+	AppendBufferSize        uint64
+	AppendBufferMaxAge      time.Duration
+	ImmutabilityDays        int
+	LegalHold               bool
+	PreserveOrder           bool
+	FlushOnTagChange        bool
+	HeartbeatInterval       time.Duration
+	AdminListen             string
+	EntriesBuffer           int
+	MemFlushThreshold       uint64
+	LastSuccessPrefixes     []string
+	HeartbeatKeyFormat      string
+	ShutdownTimeout         time.Duration
+	UploadTimeout           time.Duration
+	SetupTimeout            time.Duration
+	SpoolDir                string
+	DeadLetterContainer     string
+	DeadLetterPrefix        string
+	SpoolRetryInterval      time.Duration
+	PreserveRaw             bool
+	Format                  RecordFormat
+	EncodeInvalidUTF8       bool
+	StripANSI               bool
+	FieldRename             map[string]string
+	Schema                  *Schema
+	InvalidRecordPrefix     string
+	MessageKey              string
+	SkipMissingMessage      bool
+	RawKey                  string
+	ClusterName             string
+	ClusterKey              string
+	Region                  string
+	RegionKey               string
+	RouteKey                string
+	RouteDefault            string
+	ContainerKey            []string
+	LevelKey                string
+	LevelDefault            string
+	ErrorContainer          string
+	IndexTagLabels          []string
+	IndexTags               map[string]string
+	ErrorLevel              string
+	TimeKey                 string
+	TimeFormat              string
+	Location                *time.Location
+	LogLevel                logrus.Level
 }
 
 func NewConfig(c PluginConfig) (*AzblobConfig, error) {
@@ -50,25 +298,174 @@ func NewConfig(c PluginConfig) (*AzblobConfig, error) {
 		return nil, fmt.Errorf("cannot specify empty string to Azure_Container")
 	}
 
-	urlString := fmt.Sprintf("https://%s.blob.core.windows.net/%s", c.Get("Azure_Storage_Account"), c.Get("Azure_Container"))
+	// Azure_Container often comes from the cluster name, which may have
+	// uppercase letters or underscores a container name can't have.
+	cfg.Container = c.Get("Azure_Container")
+	switch v := getEnvDefault(c, "Container_Name_Policy", "AZBLOB_CONTAINER_NAME_POLICY"); v {
+	case "", string(SanitizeContainerName):
+		cfg.ContainerNamePolicy = SanitizeContainerName
+		cfg.Container, err = sanitizeContainerName(cfg.Container)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Container != c.Get("Azure_Container") {
+			cfg.ContainerRenamedFrom = c.Get("Azure_Container")
+		}
+	case string(StrictContainerName):
+		cfg.ContainerNamePolicy = StrictContainerName
+		if !validContainerName(cfg.Container) && !systemContainers[cfg.Container] {
+			return nil, fmt.Errorf("invalid Azure_Container: %s is not a valid container name", cfg.Container)
+		}
+	default:
+		return nil, fmt.Errorf("invalid Container_Name_Policy: %s", v)
+	}
 
-	var credential azblob.Credential
-	if c.Get("Azure_Storage_SAS") != "" {
-		credential = azblob.NewAnonymousCredential()
-		urlString = fmt.Sprintf("%s?%s", urlString, c.Get("Azure_Storage_SAS"))
-	} else {
-		credential, err = azblob.NewSharedKeyCredential(
-			c.Get("Azure_Storage_Account"), c.Get("Azure_Storage_Access_Key"))
+	accounts := splitList(c.Get("Azure_Storage_Accounts"))
+	if c.Get("Azure_Storage_Account") != "" {
+		if len(accounts) > 0 {
+			return nil, fmt.Errorf("cannot specify both Azure_Storage_Account and Azure_Storage_Accounts")
+		}
+		accounts = []string{c.Get("Azure_Storage_Account")}
+	}
+
+	// Azure_Service_URL fully specifies the blob service endpoint (e.g. a
+	// private endpoint or custom domain) instead of deriving it from the
+	// account name.
+	serviceURLs := splitList(c.Get("Azure_Service_URL"))
+	// The environment only names the accounts or endpoints when the config
+	// names no endpoint at all.
+	if len(accounts) == 0 && len(serviceURLs) == 0 {
+		accounts = splitList(os.Getenv("AZBLOB_STORAGE_ACCOUNTS"))
+		serviceURLs = splitList(os.Getenv("AZBLOB_SERVICE_URL"))
+	}
+	switch {
+	case len(accounts) == 0 && len(serviceURLs) == 0:
+		return nil, fmt.Errorf("either Azure_Storage_Account or Azure_Service_URL must be specified")
+	case len(accounts) > 0 && len(serviceURLs) > 0:
+		return nil, fmt.Errorf("cannot specify both Azure_Storage_Account and Azure_Service_URL")
+	case len(serviceURLs) == 0:
+		for _, account := range accounts {
+			serviceURLs = append(serviceURLs,
+				fmt.Sprintf("https://%s.blob.core.windows.net", account))
+		}
+	}
+
+	// With several endpoints, SAS and access key may be given once for all
+	// endpoints or once per endpoint, in the same order as the endpoints.
+	sas, err := getSecret(c, "Azure_Storage_SAS")
+	if err != nil {
+		return nil, err
+	}
+	key, err := getSecret(c, "Azure_Storage_Access_Key")
+	if err != nil {
+		return nil, err
+	}
+
+	sasList := []string{sas}
+	keyList := []string{key}
+	if len(serviceURLs) > 1 {
+		sasList = splitList(sas)
+		keyList = splitList(key)
+	}
+	if len(sasList) > 1 && len(sasList) != len(serviceURLs) {
+		return nil, fmt.Errorf("Azure_Storage_SAS must have one value or one per account")
+	}
+	if len(keyList) > 1 && len(keyList) != len(serviceURLs) {
+		return nil, fmt.Errorf("Azure_Storage_Access_Key must have one value or one per account")
+	}
+
+	cfg.Retry, err = getRetryOptions(c)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.UserAgent = userAgent(
+		getEnvDefault(c, "User_Agent_Suffix", "AZBLOB_USER_AGENT_SUFFIX"))
+
+	cfg.MaxIdleConnsPerHost = DefaultMaxIdleConns
+	if v := c.Get("Max_Idle_Conns_Per_Host"); v != "" {
+		cfg.MaxIdleConnsPerHost, err = strconv.Atoi(v)
+		if err != nil || cfg.MaxIdleConnsPerHost < 1 {
+			return nil, fmt.Errorf("invalid Max_Idle_Conns_Per_Host: %s", v)
+		}
+	}
+
+	cfg.IdleConnTimeout, err = getSeconds(c, "Idle_Conn_Timeout", DefaultIdleConnTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cfg.KeepAlive, err = getSeconds(c, "Keep_Alive", DefaultKeepAlive)
+	if err != nil {
+		return nil, err
+	}
+
+	options := azblob.PipelineOptions{
+		Retry:      cfg.Retry,
+		Telemetry:  azblob.TelemetryOptions{Value: cfg.UserAgent},
+		HTTPSender: newHTTPSender(newHTTPClient(cfg)),
+	}
+	for i, serviceURL := range serviceURLs {
+		containerURL, p, err := newContainerURL(serviceURL, cfg.Container,
+			pick(sasList, i), pick(keyList, i), options)
 		if err != nil {
-			return nil, fmt.Errorf("invalid credential: " + err.Error())
+			return nil, err
 		}
+		cfg.ContainerURLs = append(cfg.ContainerURLs, containerURL)
+		cfg.Pipelines = append(cfg.Pipelines, p)
 	}
 
-	URL, _ := url.Parse(urlString)
-	// Create a ContainerURL object that wraps the container URL and a request
-	// pipeline to make requests.
-	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
-	cfg.ContainerURL = azblob.NewContainerURL(*URL, p)
+	// Without its own SAS, the queue is reached with the credentials of the
+	// first storage account.
+	if v := getEnvDefault(c, "Notify_Queue_URL", "AZBLOB_NOTIFY_QUEUE_URL"); v != "" {
+		cfg.NotifyQueue, cfg.NotifyPipeline, err = newQueueURL(
+			v, pick(sasList, 0), pick(keyList, 0), options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The webhook is a plain HTTP endpoint, not a storage service, so it gets
+	// a client of its own rather than a pipeline of the azblob SDK.
+	if v := getEnvDefault(c, "Webhook_URL", "AZBLOB_WEBHOOK_URL"); v != "" {
+		cfg.WebhookURL, err = url.Parse(v)
+		if err != nil || (cfg.WebhookURL.Scheme != "http" && cfg.WebhookURL.Scheme != "https") ||
+			cfg.WebhookURL.Host == "" {
+			return nil, fmt.Errorf("invalid Webhook_URL: %s", v)
+		}
+		cfg.WebhookTimeout = DefaultWebhookTimeout
+		if t := getEnvDefault(c, "Webhook_Timeout", "AZBLOB_WEBHOOK_TIMEOUT"); t != "" {
+			cfg.WebhookTimeout, err = parseSeconds("Webhook_Timeout", t)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if cfg.WebhookTimeout == 0 {
+			return nil, fmt.Errorf("Webhook_Timeout must be positive")
+		}
+		cfg.WebhookRetries = DefaultWebhookRetries
+		if r := getEnvDefault(c, "Webhook_Retries", "AZBLOB_WEBHOOK_RETRIES"); r != "" {
+			cfg.WebhookRetries, err = strconv.Atoi(r)
+			if err != nil || cfg.WebhookRetries < 0 {
+				return nil, fmt.Errorf("invalid Webhook_Retries: %s", r)
+			}
+		}
+		cfg.WebhookClient = newHTTPClient(cfg)
+	}
+
+	if v := getEnvDefault(c, "AppInsights_Connection_String",
+		"AZBLOB_APPINSIGHTS_CONNECTION_STRING"); v != "" {
+		interval, err := getSeconds(c, "AppInsights_Interval", DefaultAppInsightsInterval)
+		if err != nil {
+			return nil, err
+		}
+		if interval == 0 {
+			return nil, fmt.Errorf("AppInsights_Interval must be positive")
+		}
+		cfg.AppInsights, err = newAppInsights(v, interval, options)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	cfg.AutoCreateContainer, err = strconv.ParseBool(
 		c.Get("Auto_Create_Container"))
@@ -76,6 +473,14 @@ func NewConfig(c PluginConfig) (*AzblobConfig, error) {
 		cfg.AutoCreateContainer = false
 	}
 
+	cfg.PrecreateContainers = splitList(
+		getEnvDefault(c, "Precreate_Containers", "AZBLOB_PRECREATE_CONTAINERS"))
+	for _, name := range cfg.PrecreateContainers {
+		if !validContainerName(name) {
+			return nil, fmt.Errorf("invalid container name in Precreate_Containers: %s", name)
+		}
+	}
+
 	switch c.Get("StoreAs") {
 	case "text":
 		cfg.StoreAs = PlainTextFormat
@@ -83,46 +488,350 @@ func NewConfig(c PluginConfig) (*AzblobConfig, error) {
 		cfg.StoreAs = GzipFormat
 	}
 
+	// Batches smaller than CompressionMinBytes are stored as text. The
+	// extension tells them apart, so it's in the object key and blobs never
+	// mix both.
+	if v := getEnvDefault(c, "Compression_Min_Bytes", "AZBLOB_COMPRESSION_MIN_BYTES"); v != "" {
+		if cfg.StoreAs != GzipFormat {
+			return nil, fmt.Errorf("Compression_Min_Bytes requires StoreAs gzip")
+		}
+		cfg.CompressionMinBytes, err = parseSize("Compression_Min_Bytes", v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	storeAs := cfg.StoreAs
+	if cfg.CompressionMinBytes > 0 {
+		storeAs = ""
+	}
+
+	switch v := c.Get("Blob_Type"); v {
+	case "", string(BlockBlob):
+		cfg.BlobType = BlockBlob
+	case string(AppendBlob):
+		cfg.BlobType = AppendBlob
+	case string(UniqueBlob):
+		cfg.BlobType = UniqueBlob
+	default:
+		return nil, fmt.Errorf("invalid Blob_Type: %s", v)
+	}
+
+	// With GzipContentEncoding the blobs are named like text and carry
+	// "Content-Encoding: gzip", so HTTP clients decompress them transparently.
+	// Append blobs are a series of gzip members, which clients honoring the
+	// header don't expect, so it's for block blobs only.
+	cfg.GzipContentEncoding, err = strconv.ParseBool(c.Get("Gzip_Content_Encoding"))
+	if err != nil {
+		cfg.GzipContentEncoding = false
+	}
+	if cfg.GzipContentEncoding {
+		switch {
+		case cfg.StoreAs != GzipFormat:
+			return nil, fmt.Errorf("Gzip_Content_Encoding requires StoreAs gzip")
+		case cfg.BlobType == AppendBlob:
+			return nil, fmt.Errorf("Gzip_Content_Encoding is not allowed with Blob_Type append")
+		case cfg.CompressionMinBytes > 0:
+			return nil, fmt.Errorf("cannot specify both Gzip_Content_Encoding and Compression_Min_Bytes")
+		}
+		storeAs = PlainTextFormat
+	}
+
+	switch v := getEnvDefault(c, "Mode", "AZBLOB_MODE"); v {
+	case "", string(KubernetesMode):
+		cfg.Mode = KubernetesMode
+	case string(FlatMode):
+		cfg.Mode = FlatMode
+	default:
+		return nil, fmt.Errorf("invalid Mode: %s", v)
+	}
+
+	// Records whose Kubernetes metadata was lifted to the top level, e.g. by
+	// the nest filter, carry it in prefixed fields instead of under kubernetes.
+	cfg.KubernetesPrefix = getEnvDefault(c, "Kubernetes_Flat_Prefix", "AZBLOB_KUBERNETES_FLAT_PREFIX")
+
 	switch v := c.Get("Azure_Object_Key_Format"); {
+	case v == "" && cfg.Mode == FlatMode:
+		cfg.ObjectKeyFormat = DefaultFlatKeyFormat
 	case v == "":
 		cfg.ObjectKeyFormat = DefaultObjectKeyFormat
 	default:
-		cfg.ObjectKeyFormat = v
+		cfg.ObjectKeyFormat, err = normalizeKeyFormat(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg.ObjectKeyFormat = expandKeyFormat(
+		cfg.ObjectKeyFormat, c.Get("Path"), storeAs)
+
+	// Records without Kubernetes metadata (e.g. host logs) may use their own
+	// layout. When it's empty, every record uses ObjectKeyFormat.
+	if v := getEnvDefault(c, "Azure_Fallback_Object_Key_Format",
+		"AZBLOB_FALLBACK_KEY_FORMAT"); v != "" {
+		v, err = normalizeKeyFormat(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.FallbackObjectKeyFormat = expandKeyFormat(
+			v, c.Get("Path"), storeAs)
+	}
+
+	cfg.TagKeyFormats, err = parseTagKeyFormats(getEnvDefault(c,
+		"Object_Key_Format_By_Tag", "AZBLOB_OBJECT_KEY_FORMAT_BY_TAG"), c.Get("Path"), storeAs)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Routes, err = parseRoutes(getEnvDefault(c, "Routes", "AZBLOB_ROUTES"),
+		cfg.KubernetesPrefix, c.Get("Path"), storeAs)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CompressionMinBytes > 0 {
+		for _, f := range cfg.keyFormats() {
+			if !strings.Contains(f, "%{file_extension}") {
+				return nil, fmt.Errorf(
+					"Compression_Min_Bytes requires %%{file_extension} in object key format: %s", f)
+			}
+		}
+	}
+
+	if cfg.BlobType == UniqueBlob {
+		for _, f := range cfg.keyFormats() {
+			if !strings.Contains(f, "%{uuid}") {
+				return nil, fmt.Errorf(
+					"Blob_Type unique requires %%{uuid} in object key format: %s", f)
+			}
+		}
+	}
+
+	cfg.BatchKeyFields, err = getBatchKeyFields(c, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollover sets how often the time in the blob names changes, unless the
+	// formats are given themselves.
+	timeSliceFormat, uploadDateFormat := DefaultTimeSliceFormat, DefaultUploadDateFormat
+	if v := getEnvDefault(c, "Rollover", "AZBLOB_ROLLOVER"); v != "" {
+		f, ok := RolloverFormats[v]
+		if !ok {
+			return nil, fmt.Errorf("invalid Rollover: %s", v)
+		}
+		timeSliceFormat, uploadDateFormat = f, f
 	}
-	cfg.ObjectKeyFormat = strings.ReplaceAll(
-		cfg.ObjectKeyFormat, "%{path}", c.Get("Path"))
-	cfg.ObjectKeyFormat = strings.ReplaceAll(
-		cfg.ObjectKeyFormat, "%{file_extension}", string(cfg.StoreAs))
 
 	switch v := c.Get("Time_Slice_Format"); {
 	case v == "":
-		cfg.TimeSliceFormat = DefaultTimeSliceFormat
+		cfg.TimeSliceFormat = timeSliceFormat
 	default:
 		cfg.TimeSliceFormat = v
 	}
 
-	batchWait := c.Get("Batch_Wait")
-	if batchWait != "" {
-		batchWaitValue, err := strconv.Atoi(batchWait)
+	cfg.BatchWait, err = getSeconds(c, "Batch_Wait", DefaultBatchWait)
+	if err != nil {
+		return nil, err
+	}
+
+	if v := getEnvDefault(c, "Batch_Max_Age", "AZBLOB_MAX_BATCH_AGE"); v != "" {
+		cfg.BatchMaxAge, err = parseSeconds("Batch_Max_Age", v)
 		if err != nil {
-			return nil, fmt.Errorf("invalid Batch_Wait: %s", batchWait)
+			return nil, err
 		}
+	}
 
-		cfg.BatchWait = time.Duration(batchWaitValue) * time.Second
-	} else {
-		cfg.BatchWait = DefaultBatchWait
+	cfg.UploadDateFormat = getDefault(
+		c, "Upload_Date_Format", uploadDateFormat)
+
+	cfg.ClockSkewLimit, err = getSeconds(c, "Clock_Skew_Limit", 0)
+	if err != nil {
+		return nil, err
 	}
 
 	batchLimitSize := c.Get("Batch_Limit_Size")
 	if batchLimitSize != "" {
-		cfg.BatchLimitSize, err = bytefmt.ToBytes(batchLimitSize)
+		cfg.BatchLimitSize, err = parseSize("Batch_Limit_Size", batchLimitSize)
 		if err != nil {
-			return nil, fmt.Errorf("invalid Batch_Limit_Size: %v", err)
+			return nil, err
 		}
 	} else {
 		cfg.BatchLimitSize = DefaultBatchLimitSize
 	}
 
+	if v := getEnvDefault(c, "Batch_Source_Share", "AZBLOB_BATCH_SOURCE_SHARE"); v != "" {
+		cfg.SourceShare, err = strconv.ParseFloat(v, 64)
+		if err != nil || cfg.SourceShare <= 0 || cfg.SourceShare > 1 {
+			return nil, fmt.Errorf("invalid Batch_Source_Share: %s (expected a fraction like 0.25)", v)
+		}
+	}
+
+	cfg.BatchRules, err = parseBatchRules(getEnvDefault(c, "Batch_Rules", "AZBLOB_BATCH_RULES"))
+	if err != nil {
+		return nil, err
+	}
+
+	if v := c.Get("Coalesce_Time_Slices"); v != "" {
+		cfg.CoalesceTimeSlices, err = strconv.Atoi(v)
+		if err != nil || cfg.CoalesceTimeSlices < 0 {
+			return nil, fmt.Errorf("invalid Coalesce_Time_Slices: %s", v)
+		}
+	}
+
+	// Sources which send the same records again and again are caught by the
+	// hashes of the last few batches.
+	if v := getEnvDefault(c, "Dedup_Window", "AZBLOB_DEDUP_WINDOW"); v != "" {
+		cfg.DedupWindow, err = strconv.Atoi(v)
+		if err != nil || cfg.DedupWindow < 0 {
+			return nil, fmt.Errorf("invalid Dedup_Window: %s", v)
+		}
+	}
+
+	if v := getEnvDefault(c, "Max_Blob_Size", "AZBLOB_MAX_BLOB_BYTES"); v != "" {
+		if cfg.BlobType != AppendBlob {
+			return nil, fmt.Errorf("Max_Blob_Size requires Blob_Type append")
+		}
+		cfg.MaxBlobSize, err = parseSize("Max_Blob_Size", v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v := c.Get("Max_Blob_Blocks"); v != "" {
+		if cfg.BlobType != AppendBlob {
+			return nil, fmt.Errorf("Max_Blob_Blocks requires Blob_Type append")
+		}
+		cfg.MaxBlobBlocks, err = strconv.Atoi(v)
+		if err != nil || cfg.MaxBlobBlocks < 1 || cfg.MaxBlobBlocks > MaxAppendBlocks {
+			return nil, fmt.Errorf("invalid Max_Blob_Blocks: %s", v)
+		}
+	}
+
+	switch v := getEnvDefault(c, "On_Restart", "AZBLOB_ON_RESTART"); v {
+	case "", string(AppendOnRestart):
+		cfg.OnRestart = AppendOnRestart
+	case string(NewOnRestart):
+		cfg.OnRestart = NewOnRestart
+	default:
+		return nil, fmt.Errorf("invalid On_Restart: %s", v)
+	}
+
+	if v := c.Get("Blob_Target_Size"); v != "" {
+		if cfg.BlobType != AppendBlob {
+			return nil, fmt.Errorf("Blob_Target_Size requires Blob_Type append")
+		}
+		cfg.BlobTargetSize, err = parseSize("Blob_Target_Size", v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.OpenBlobsLimit = DefaultOpenBlobsLimit
+	if v := c.Get("Open_Blobs_Limit"); v != "" {
+		cfg.OpenBlobsLimit, err = strconv.Atoi(v)
+		if err != nil || cfg.OpenBlobsLimit < 0 {
+			return nil, fmt.Errorf("invalid Open_Blobs_Limit: %s", v)
+		}
+	}
+
+	cfg.UploadParallelism = Parallelism
+	if v := c.Get("Upload_Parallelism"); v != "" {
+		cfg.UploadParallelism, err = strconv.Atoi(v)
+		if err != nil || cfg.UploadParallelism < 1 {
+			return nil, fmt.Errorf("invalid Upload_Parallelism: %s", v)
+		}
+	}
+
+	cfg.RecordCountMetadata, err = strconv.ParseBool(c.Get("Record_Count_Metadata"))
+	if err != nil {
+		cfg.RecordCountMetadata = false
+	}
+
+	cfg.CreateFirst, err = strconv.ParseBool(getEnvDefault(c, "Create_First", "AZBLOB_CREATE_FIRST"))
+	if err != nil {
+		cfg.CreateFirst = false
+	}
+	if cfg.CreateFirst && cfg.BlobType != AppendBlob {
+		return nil, fmt.Errorf("Create_First requires Blob_Type append")
+	}
+
+	cfg.SequenceMetadata, err = strconv.ParseBool(c.Get("Sequence_Metadata"))
+	if err != nil {
+		cfg.SequenceMetadata = false
+	}
+	if cfg.SequenceMetadata && cfg.BlobType != AppendBlob {
+		return nil, fmt.Errorf("Sequence_Metadata requires Blob_Type append")
+	}
+
+	// The BOM would be an append the sequence doesn't count.
+	cfg.WriteBOM, err = strconv.ParseBool(getEnvDefault(c, "Write_BOM", "AZBLOB_WRITE_BOM"))
+	if err != nil {
+		cfg.WriteBOM = false
+	}
+	if cfg.WriteBOM && cfg.SequenceMetadata {
+		return nil, fmt.Errorf("Write_BOM doesn't work with Sequence_Metadata")
+	}
+
+	cfg.FinalizeMarker = c.Get("Finalize_Marker")
+	cfg.FinalizeMetadata, err = strconv.ParseBool(c.Get("Finalize_Metadata"))
+	if err != nil {
+		cfg.FinalizeMetadata = false
+	}
+	if (cfg.FinalizeMarker != "" || cfg.FinalizeMetadata) && cfg.BlobType != AppendBlob {
+		return nil, fmt.Errorf("Finalize_Marker and Finalize_Metadata require Blob_Type append")
+	}
+
+	if v := c.Get("Append_Buffer_Size"); v != "" {
+		if cfg.BlobType != AppendBlob {
+			return nil, fmt.Errorf("Append_Buffer_Size requires Blob_Type append")
+		}
+		cfg.AppendBufferSize, err = parseSize("Append_Buffer_Size", v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.AppendBufferMaxAge, err = getSeconds(
+		c, "Append_Buffer_Max_Age", DefaultAppendBufferAge)
+	if err != nil {
+		return nil, err
+	}
+
+	if v := getEnvDefault(
+		c, "Immutability_Days", "AZBLOB_IMMUTABILITY_DAYS"); v != "" {
+		if cfg.BlobType == AppendBlob {
+			return nil, fmt.Errorf("Immutability_Days requires block blobs")
+		}
+		cfg.ImmutabilityDays, err = strconv.Atoi(v)
+		if err != nil || cfg.ImmutabilityDays < 0 {
+			return nil, fmt.Errorf("invalid Immutability_Days: %s", v)
+		}
+	}
+
+	if v := getEnvDefault(c, "Legal_Hold", "AZBLOB_LEGAL_HOLD"); v != "" {
+		cfg.LegalHold, err = strconv.ParseBool(v)
+		if err != nil {
+			cfg.LegalHold = false
+		}
+		if cfg.LegalHold && cfg.BlobType == AppendBlob {
+			return nil, fmt.Errorf("Legal_Hold requires block blobs")
+		}
+	}
+
+	// Late records are added to the blob of their time slice, which unique
+	// and immutable blobs can't be.
+	cfg.LateRecordGrace, err = getSeconds(c, "Late_Record_Grace", 0)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cfg.LateRecordGrace > 0 && cfg.BlobType == UniqueBlob:
+		return nil, fmt.Errorf("Late_Record_Grace doesn't work with Blob_Type unique")
+	case cfg.LateRecordGrace > 0 && cfg.ImmutabilityDays > 0:
+		return nil, fmt.Errorf("Late_Record_Grace doesn't work with Immutability_Days")
+	case cfg.LateRecordGrace > 0 && cfg.LegalHold:
+		return nil, fmt.Errorf("Late_Record_Grace doesn't work with Legal_Hold")
+	}
+
 	batchRetryLimit, err := strconv.ParseUint(
 		c.Get("Batch_Retry_Limit"), 10, 64)
 	if err != nil {
@@ -131,19 +840,850 @@ func NewConfig(c PluginConfig) (*AzblobConfig, error) {
 		cfg.BatchRetryLimit = &batchRetryLimit
 	}
 
-	cfg.Location, err = time.LoadLocation(c.Get("TimeZone"))
-	if err != nil {
-		return nil, fmt.Errorf("invalid Time_Zone: %v", err)
+	// Max_Delivery_Attempts bounds the retries, which are unlimited by
+	// default, so a batch which keeps failing is spooled or dropped instead
+	// of wedging the plugin.
+	if v := getEnvDefault(c, "Max_Delivery_Attempts", "AZBLOB_MAX_DELIVERY_ATTEMPTS"); v != "" {
+		if c.Get("Batch_Retry_Limit") != "" {
+			return nil, fmt.Errorf("cannot specify both Batch_Retry_Limit and Max_Delivery_Attempts")
+		}
+		attempts, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || attempts == 0 {
+			return nil, fmt.Errorf("invalid Max_Delivery_Attempts: %s", v)
+		}
+		batchRetryLimit := attempts - 1
+		cfg.BatchRetryLimit = &batchRetryLimit
 	}
 
-	logLvl := c.Get("Logging")
-	if logLvl == "" {
-		logLvl = DefaultLogLevel
+	cfg.PreserveOrder, err = strconv.ParseBool(
+		getEnvDefault(c, "Preserve_Order", "AZBLOB_PRESERVE_ORDER"))
+	if err != nil {
+		cfg.PreserveOrder = false
 	}
-	cfg.LogLevel, err = logrus.ParseLevel(logLvl)
+
+	cfg.FlushOnTagChange, err = strconv.ParseBool(c.Get("Flush_On_Tag_Change"))
 	if err != nil {
-		return nil, fmt.Errorf("invalid Logging: %v", logLvl)
+		cfg.FlushOnTagChange = false
 	}
 
-	return cfg, nil
+	if v := getEnvDefault(
+		c, "Heartbeat_Interval", "AZBLOB_HEARTBEAT_INTERVAL"); v != "" {
+		cfg.HeartbeatInterval, err = parseSeconds("Heartbeat_Interval", v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg.HeartbeatKeyFormat = getDefault(
+		c, "Heartbeat_Key_Format", DefaultHeartbeatKey)
+
+	cfg.AdminListen = getEnvDefault(c, "Admin_Listen", "AZBLOB_ADMIN_LISTEN")
+	if cfg.AdminListen != "" {
+		if _, _, err := net.SplitHostPort(cfg.AdminListen); err != nil {
+			return nil, fmt.Errorf("invalid Admin_Listen: %s", cfg.AdminListen)
+		}
+	}
+
+	if v := getEnvDefault(c, "Entries_Buffer", "AZBLOB_ENTRIES_BUFFER"); v != "" {
+		cfg.EntriesBuffer, err = strconv.Atoi(v)
+		if err != nil || cfg.EntriesBuffer < 0 {
+			return nil, fmt.Errorf("invalid Entries_Buffer: %s", v)
+		}
+	}
+
+	if v := getEnvDefault(c, "Mem_Flush_Threshold", "AZBLOB_MEM_FLUSH_THRESHOLD"); v != "" {
+		cfg.MemFlushThreshold, err = parseSize("Mem_Flush_Threshold", v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.LastSuccessPrefixes = splitList(c.Get("Last_Success_Prefixes"))
+	if len(cfg.LastSuccessPrefixes) > 0 && cfg.AdminListen == "" {
+		return nil, fmt.Errorf("Last_Success_Prefixes requires Admin_Listen")
+	}
+
+	cfg.SpoolDir = getEnvDefault(c, "Spool_Dir", "AZBLOB_SPOOL_DIR")
+
+	// Either key enables the dead-letter blobs, which default to the prefix
+	// in the container of the records.
+	cfg.DeadLetterContainer = c.Get("Dead_Letter_Container")
+	cfg.DeadLetterPrefix = c.Get("Dead_Letter_Prefix")
+	if cfg.DeadLetterContainer != "" || cfg.DeadLetterPrefix != "" {
+		if cfg.DeadLetterContainer == "" {
+			cfg.DeadLetterContainer = cfg.Container
+		}
+		if !validContainerName(cfg.DeadLetterContainer) {
+			return nil, fmt.Errorf("invalid Dead_Letter_Container: %s", cfg.DeadLetterContainer)
+		}
+		if cfg.DeadLetterPrefix == "" {
+			cfg.DeadLetterPrefix = DefaultDeadLetterPrefix
+		}
+	}
+	cfg.SpoolRetryInterval, err = getSeconds(
+		c, "Spool_Retry_Interval", DefaultSpoolRetry)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.PreserveRaw, err = strconv.ParseBool(
+		getEnvDefault(c, "Preserve_Raw", "AZBLOB_PRESERVE_RAW"))
+	if err != nil {
+		cfg.PreserveRaw = false
+	}
+
+	cfg.RawKey = getDefault(c, "Raw_Key", DefaultRawKey)
+
+	switch v := getEnvDefault(c, "Format", "AZBLOB_FORMAT"); v {
+	case "", string(JSONRecordFormat):
+		cfg.Format = JSONRecordFormat
+	case string(LogAnalyticsFormat):
+		cfg.Format = LogAnalyticsFormat
+	default:
+		return nil, fmt.Errorf("invalid Format: %s", v)
+	}
+
+	cfg.EncodeInvalidUTF8, err = strconv.ParseBool(getEnvDefault(
+		c, "Encode_Invalid_UTF8", "AZBLOB_ENCODE_INVALID_UTF8"))
+	if err != nil {
+		cfg.EncodeInvalidUTF8 = false
+	}
+
+	cfg.StripANSI, err = strconv.ParseBool(getEnvDefault(
+		c, "Strip_ANSI", "AZBLOB_STRIP_ANSI"))
+	if err != nil {
+		cfg.StripANSI = false
+	}
+
+	if file := getEnvDefault(c, "JSON_Schema_File", "AZBLOB_JSON_SCHEMA_FILE"); file != "" {
+		cfg.Schema, err = LoadSchema(file)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON_Schema_File: %v", err)
+		}
+	}
+	cfg.InvalidRecordPrefix = getDefault(c, "Invalid_Record_Prefix", DefaultInvalidPrefix)
+
+	cfg.FieldRename, err = parseFieldRename(
+		getEnvDefault(c, "Field_Rename", "AZBLOB_FIELD_RENAME"))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ShutdownTimeout = DefaultShutdownTimeout
+	if v := getEnvDefault(c, "Shutdown_Timeout", "AZBLOB_SHUTDOWN_TIMEOUT"); v != "" {
+		cfg.ShutdownTimeout, err = parseSeconds("Shutdown_Timeout", v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Getting the container and the blob ready has a budget of its own, a
+	// third of the write's by default, so a slow setup doesn't leave the
+	// write short of time.
+	cfg.UploadTimeout, err = getSeconds(c, "Upload_Timeout", DefaultUploadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SetupTimeout, err = getSeconds(c, "Setup_Timeout", cfg.UploadTimeout/3)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.UploadTimeout <= 0 || cfg.SetupTimeout <= 0 {
+		return nil, fmt.Errorf("Upload_Timeout and Setup_Timeout must be positive")
+	}
+
+	cfg.MessageKey = getEnvDefault(c, "Message_Key", "AZBLOB_MESSAGE_KEY")
+	if cfg.MessageKey == "" {
+		cfg.MessageKey = DefaultMessageKey
+	}
+
+	// Records without the message, e.g. metric events, are written as they
+	// are unless they're skipped.
+	switch v := getEnvDefault(c, "Missing_Message", "AZBLOB_MISSING_MESSAGE"); v {
+	case "", "passthrough":
+	case "skip":
+		cfg.SkipMissingMessage = true
+	default:
+		return nil, fmt.Errorf("invalid Missing_Message: %s", v)
+	}
+
+	cfg.ClusterName = getEnvDefault(c, "Cluster_Name", "CLUSTER_NAME")
+	cfg.ClusterKey = getDefault(c, "Cluster_Key", DefaultClusterKey)
+	cfg.Region = getEnvDefault(c, "Region", "AZBLOB_REGION")
+	cfg.RegionKey = getDefault(c, "Region_Key", DefaultRegionKey)
+
+	cfg.RouteKey = getEnvDefault(c, "Route_Key", "AZBLOB_ROUTE_KEY")
+	cfg.RouteDefault = getDefault(c, "Route_Default", DefaultRoute)
+
+	if v := getEnvDefault(c, "Container_Key", "AZBLOB_CONTAINER_KEY"); v != "" {
+		cfg.ContainerKey = strings.Split(v, ".")
+	}
+
+	cfg.LevelKey = getDefault(c, "Level_Key", DefaultLevelKey)
+	cfg.LevelDefault = getDefault(c, "Level_Default", DefaultLevel)
+
+	// The labels are the keys of the index tags, so they're held to the
+	// limits of tags rather than adjusted.
+	cfg.IndexTagLabels = splitList(getEnvDefault(c, "Index_Tag_Labels", "AZBLOB_INDEX_TAG_LABELS"))
+	if len(cfg.IndexTagLabels) > MaxIndexTags {
+		return nil, fmt.Errorf("Index_Tag_Labels can have at most %d labels", MaxIndexTags)
+	}
+	for _, name := range cfg.IndexTagLabels {
+		if len(name) > MaxIndexTagKey || indexTagChars.MatchString(name) {
+			return nil, fmt.Errorf("invalid label in Index_Tag_Labels: %s", name)
+		}
+	}
+	cfg.IndexTags, err = parseIndexTags(getEnvDefault(c, "Index_Tags", "AZBLOB_INDEX_TAGS"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range cfg.IndexTagLabels {
+		if _, ok := cfg.IndexTags[name]; ok {
+			return nil, fmt.Errorf("invalid Index_Tags, %s is in Index_Tag_Labels too", name)
+		}
+	}
+	if len(cfg.IndexTagLabels)+len(cfg.IndexTags) > MaxIndexTags {
+		return nil, fmt.Errorf("Index_Tag_Labels and Index_Tags can have at most %d tags", MaxIndexTags)
+	}
+
+	cfg.ErrorContainer = getEnvDefault(c, "Error_Container", "AZBLOB_ERROR_CONTAINER")
+	if cfg.ErrorContainer != "" && !validContainerName(cfg.ErrorContainer) {
+		return nil, fmt.Errorf("invalid Error_Container: %s", cfg.ErrorContainer)
+	}
+	cfg.ErrorLevel = strings.ToLower(getDefault(c, "Error_Level", DefaultErrorLevel))
+	if _, ok := severities[cfg.ErrorLevel]; !ok {
+		return nil, fmt.Errorf("invalid Error_Level: %s", cfg.ErrorLevel)
+	}
+
+	cfg.TimeKey = getEnvDefault(c, "Time_Key", "AZBLOB_TIME_KEY")
+	cfg.TimeFormat = getDefault(c, "Time_Format", DefaultTimeFormat)
+
+	if cfg.Mode == FlatMode {
+		if err := checkFlatMode(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.Location, err = time.LoadLocation(c.Get("TimeZone"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Time_Zone: %v", err)
+	}
+
+	logLvl := c.Get("Logging")
+	if logLvl == "" {
+		logLvl = DefaultLogLevel
+	}
+	cfg.LogLevel, err = logrus.ParseLevel(logLvl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Logging: %v", logLvl)
+	}
+
+	return cfg, nil
+}
+
+func newContainerURL(serviceURL, container, sas, key string,
+	options azblob.PipelineOptions) (azblob.ContainerURL, pipeline.Pipeline, error) {
+	var err error
+
+	u, err := url.Parse(strings.TrimRight(serviceURL, "/"))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return azblob.ContainerURL{}, nil, fmt.Errorf("invalid service url: %s", serviceURL)
+	}
+	urlString := fmt.Sprintf("%s://%s%s/%s", u.Scheme, u.Host, u.Path, container)
+
+	var credential azblob.Credential
+	if sas != "" {
+		credential = azblob.NewAnonymousCredential()
+		urlString = fmt.Sprintf("%s?%s", urlString, sas)
+	} else {
+		// Shared key signing needs the account name, which is the first
+		// label of the blob service host name.
+		account := strings.SplitN(u.Hostname(), ".", 2)[0]
+		credential, err = azblob.NewSharedKeyCredential(account, key)
+		if err != nil {
+			return azblob.ContainerURL{}, nil, fmt.Errorf("invalid credential: " + err.Error())
+		}
+	}
+
+	URL, _ := url.Parse(urlString)
+	// Create a ContainerURL object that wraps the container URL and a request
+	// pipeline to make requests.
+	p := azblob.NewPipeline(credential, options)
+
+	return azblob.NewContainerURL(*URL, p), p, nil
+}
+
+// newHTTPClient returns the client which sends the storage requests. It's
+// shared by the pipelines of all the accounts, so the blob clients, however
+// many there are, draw from one connection pool.
+//
+// Idle connections are closed after IdleConnTimeout and probed every
+// KeepAlive, so a NAT or firewall which drops quiet connections doesn't fail
+// the first request after a quiet period. A KeepAlive of 0 disables the
+// probes.
+func newHTTPClient(cfg *AzblobConfig) *http.Client {
+	keepAlive := cfg.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = -1
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: keepAlive,
+			}).DialContext,
+			MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+			IdleConnTimeout:       cfg.IdleConnTimeout,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
+
+// newHTTPSender sends the requests of a pipeline with client.
+func newHTTPSender(client *http.Client) pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			r, err := client.Do(request.WithContext(ctx))
+			if err != nil {
+				err = pipeline.NewError(err, "HTTP request failed")
+			}
+			return pipeline.NewHTTPResponse(r), err
+		}
+	})
+}
+
+// userAgent returns what the plugin prepends to the User-Agent of the storage
+// requests, so they can be told apart in the storage analytics logs. A suffix,
+// e.g. the cluster or instance, is appended to it.
+func userAgent(suffix string) string {
+	version := Version
+	if version == "" {
+		version = "dev"
+	}
+
+	ua := "fluent-bit-go-azblob/" + version
+	if suffix != "" {
+		ua += " " + suffix
+	}
+
+	return ua
+}
+
+// getRetryOptions returns the retry policy of the SDK, which retries a single
+// request on timeouts, throttling and server errors. Zero values keep the
+// defaults of the SDK. Batch_Retry_Limit retries a whole upload on top of it.
+func getRetryOptions(c PluginConfig) (azblob.RetryOptions, error) {
+	var err error
+
+	o := azblob.RetryOptions{Policy: azblob.RetryPolicyExponential}
+
+	if v := c.Get("Retry_Max_Tries"); v != "" {
+		tries, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || tries < 0 {
+			return o, fmt.Errorf("invalid Retry_Max_Tries: %s", v)
+		}
+		o.MaxTries = int32(tries)
+	}
+
+	o.TryTimeout, err = getSeconds(c, "Retry_Try_Timeout", 0)
+	if err != nil {
+		return o, err
+	}
+	o.RetryDelay, err = getSeconds(c, "Retry_Delay", 0)
+	if err != nil {
+		return o, err
+	}
+	o.MaxRetryDelay, err = getSeconds(c, "Retry_Max_Delay", 0)
+	if err != nil {
+		return o, err
+	}
+
+	if o.RetryDelay > 0 && o.MaxRetryDelay > 0 && o.RetryDelay > o.MaxRetryDelay {
+		return o, fmt.Errorf("Retry_Delay must not be greater than Retry_Max_Delay")
+	}
+
+	return o, nil
+}
+
+// getBatchKeyFields returns the fields which compose the batch key. Records
+// which differ in one of them are never put into the same batch, so every
+// placeholder of those fields used in the object key formats must be one of
+// them.
+func getBatchKeyFields(c PluginConfig, cfg *AzblobConfig) (map[string]bool, error) {
+	names := splitList(getEnvDefault(c, "Batch_Key_Fields", "AZBLOB_BATCH_KEY_FIELDS"))
+	switch {
+	case len(names) > 0:
+	case cfg.Mode == FlatMode:
+		names = FlatBatchKeyFields
+	default:
+		names = DefaultBatchKeyFields
+	}
+
+	fields := map[string]bool{}
+	for _, name := range names {
+		known := false
+		for _, n := range BatchKeyNames {
+			known = known || n == name
+		}
+		if !known {
+			return nil, fmt.Errorf("invalid Batch_Key_Fields: unknown field %s", name)
+		}
+		fields[name] = true
+	}
+
+	for _, f := range cfg.keyFormats() {
+		for _, name := range BatchKeyNames {
+			if !fields[name] && strings.Contains(f, "%{"+name+"}") {
+				return nil, fmt.Errorf(
+					"object key format %s uses %%{%s}, which is not in Batch_Key_Fields", f, name)
+			}
+		}
+	}
+
+	return fields, nil
+}
+
+// checkFlatMode rejects the options which look into the records, as flat mode
+// never does.
+func checkFlatMode(cfg *AzblobConfig) error {
+	switch {
+	case cfg.FallbackObjectKeyFormat != "":
+		return fmt.Errorf("cannot specify Azure_Fallback_Object_Key_Format with Mode flat")
+	case cfg.RouteKey != "":
+		return fmt.Errorf("cannot specify Route_Key with Mode flat")
+	case len(cfg.ContainerKey) > 0:
+		return fmt.Errorf("cannot specify Container_Key with Mode flat")
+	case len(cfg.Routes) > 0:
+		return fmt.Errorf("cannot specify Routes with Mode flat")
+	case cfg.KubernetesPrefix != "":
+		return fmt.Errorf("cannot specify Kubernetes_Flat_Prefix with Mode flat")
+	case cfg.TimeKey != "":
+		return fmt.Errorf("cannot specify Time_Key with Mode flat")
+	case cfg.BatchKeyFields[BatchKeyLevel]:
+		return fmt.Errorf("Mode flat doesn't support the batch key field level")
+	case cfg.BatchKeyFields[BatchKeyImage]:
+		return fmt.Errorf("Mode flat doesn't support the batch key field image")
+	}
+
+	for _, f := range cfg.keyFormats() {
+		switch {
+		case strings.Contains(f, "%{record."):
+			return fmt.Errorf(
+				"Mode flat doesn't support %%{record.<key>} in object key format: %s", f)
+		case recordPlaceholder.MatchString(f):
+			return fmt.Errorf(
+				"Mode flat doesn't support Kubernetes placeholders in object key format: %s", f)
+		}
+	}
+
+	return nil
+}
+
+func getDefault(c PluginConfig, key, def string) string {
+	if v := c.Get(key); v != "" {
+		return v
+	}
+
+	return def
+}
+
+// getEnvDefault reads a key which defaults to an environment variable.
+func getEnvDefault(c PluginConfig, key, env string) string {
+	return getDefault(c, key, os.Getenv(env))
+}
+
+// getSecret reads a credential either from the key itself or from the file
+// named by the key with a "_File" suffix, e.g. a mounted secret.
+func getSecret(c PluginConfig, key string) (string, error) {
+	file := c.Get(key + "_File")
+	if file == "" {
+		return c.Get(key), nil
+	}
+
+	if c.Get(key) != "" {
+		return "", fmt.Errorf("cannot specify both %s and %s_File", key, key)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s_File: %v", key, err)
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// getSeconds reads a duration given in seconds.
+func getSeconds(c PluginConfig, key string, def time.Duration) (time.Duration, error) {
+	v := c.Get(key)
+	if v == "" {
+		return def, nil
+	}
+
+	return parseSeconds(key, v)
+}
+
+// parseSeconds parses a duration given either in seconds or as a Go duration,
+// e.g. "90" or "1m30s".
+func parseSeconds(key, v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+
+	d, err := time.ParseDuration(v)
+	if seconds, serr := strconv.Atoi(v); serr == nil {
+		d, err = time.Duration(seconds)*time.Second, nil
+	}
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf(
+			"invalid %s: %s (expected seconds or a duration like 1m30s)", key, v)
+	}
+
+	return d, nil
+}
+
+// parseSize parses a size given either in bytes or with a unit, e.g. "32768",
+// "256KB" or "10MB". Units are powers of 1024.
+func parseSize(key, v string) (uint64, error) {
+	v = strings.TrimSpace(v)
+
+	size, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		size, err = bytefmt.ToBytes(v)
+	}
+	if err != nil {
+		return 0, fmt.Errorf(
+			"invalid %s: %s (expected bytes or a size like 256KB or 10MB)", key, v)
+	}
+
+	return size, nil
+}
+
+// parseFieldRename parses comma-separated "from:to" pairs of field names.
+func parseFieldRename(v string) (map[string]string, error) {
+	var rename map[string]string
+	for _, pair := range splitList(v) {
+		i := strings.IndexByte(pair, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid Field_Rename, expected from:to: %s", pair)
+		}
+		from, to := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("invalid Field_Rename, expected from:to: %s", pair)
+		}
+		if _, ok := rename[from]; ok {
+			return nil, fmt.Errorf("invalid Field_Rename, %s renamed twice", from)
+		}
+		if rename == nil {
+			rename = map[string]string{}
+		}
+		rename[from] = to
+	}
+
+	return rename, nil
+}
+
+// parseBatchRules parses comma-separated "pattern:wait:size" rules. Wait and
+// size are split off from the right, so patterns may hold colons, and either
+// may be empty.
+func parseBatchRules(v string) ([]BatchRule, error) {
+	var rules []BatchRule
+	for _, item := range splitList(v) {
+		i := strings.LastIndexByte(item, ':')
+		j := -1
+		if i > 0 {
+			j = strings.LastIndexByte(item[:i], ':')
+		}
+		if j <= 0 {
+			return nil, fmt.Errorf("invalid Batch_Rules, expected pattern:wait:size: %s", item)
+		}
+
+		rule := BatchRule{Pattern: item[:j]}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid Batch_Rules, bad pattern: %s", rule.Pattern)
+		}
+		var err error
+		if wait := item[j+1 : i]; wait != "" {
+			rule.Wait, err = parseSeconds("Batch_Rules wait", wait)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if size := item[i+1:]; size != "" {
+			rule.LimitSize, err = parseSize("Batch_Rules size", size)
+			if err != nil {
+				return nil, err
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// parseTagKeyFormats parses comma-separated "pattern:format" pairs. The
+// pattern is split off at the first colon, as tags have none.
+func parseTagKeyFormats(v, keyPath string, storeAs FileFormat) ([]TagKeyFormat, error) {
+	var formats []TagKeyFormat
+	for _, pair := range splitList(v) {
+		i := strings.IndexByte(pair, ':')
+		if i <= 0 || strings.TrimSpace(pair[i+1:]) == "" {
+			return nil, fmt.Errorf("invalid Object_Key_Format_By_Tag, expected pattern:format: %s", pair)
+		}
+
+		pattern := strings.TrimSpace(pair[:i])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid Object_Key_Format_By_Tag, bad pattern: %s", pattern)
+		}
+		format, err := normalizeKeyFormat(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		formats = append(formats, TagKeyFormat{
+			Pattern:         pattern,
+			ObjectKeyFormat: expandKeyFormat(format, keyPath, storeAs),
+		})
+	}
+
+	return formats, nil
+}
+
+// parseRoutes parses comma-separated "conditions -> container:format" rules.
+// The conditions are space-separated field=pattern pairs, all of which must
+// match; the fields are namespace, tag, label.<name> and record.<key>, and a
+// rule without conditions matches every record. The container or the format
+// may be empty to keep the default one.
+func parseRoutes(v, kubernetesPrefix, keyPath string, storeAs FileFormat) ([]Route, error) {
+	var routes []Route
+	for _, item := range splitList(v) {
+		i := strings.Index(item, "->")
+		j := -1
+		if i >= 0 {
+			j = strings.IndexByte(item[i:], ':')
+		}
+		if j < 0 {
+			return nil, fmt.Errorf("invalid Routes, expected conditions -> container:format: %s", item)
+		}
+
+		var route Route
+		for _, cond := range strings.Fields(item[:i]) {
+			k := strings.IndexByte(cond, '=')
+			if k <= 0 {
+				return nil, fmt.Errorf("invalid Routes, expected field=pattern: %s", cond)
+			}
+			field, pattern := cond[:k], cond[k+1:]
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid Routes, bad pattern: %s", pattern)
+			}
+
+			rc := RouteCondition{Pattern: pattern}
+			switch {
+			case field == "tag":
+			case field == "namespace":
+				rc.Path = kubernetesPath(WorkloadPaths["namespace"], kubernetesPrefix)
+			case strings.HasPrefix(field, "label.") && len(field) > len("label."):
+				rc.Path = kubernetesPath(
+					[]string{"kubernetes", "labels", field[len("label."):]}, kubernetesPrefix)
+			case strings.HasPrefix(field, "record.") && len(field) > len("record."):
+				rc.Path = strings.Split(field[len("record."):], ".")
+			default:
+				return nil, fmt.Errorf("invalid Routes, unknown field: %s", field)
+			}
+			route.Conditions = append(route.Conditions, rc)
+		}
+
+		route.Container = strings.TrimSpace(item[i+len("->") : i+j])
+		if route.Container != "" && !validContainerName(route.Container) {
+			return nil, fmt.Errorf("invalid Routes, bad container name: %s", route.Container)
+		}
+		if format := strings.TrimSpace(item[i+j+1:]); format != "" {
+			format, err := normalizeKeyFormat(format)
+			if err != nil {
+				return nil, err
+			}
+			route.ObjectKeyFormat = expandKeyFormat(format, keyPath, storeAs)
+		}
+		if route.Container == "" && route.ObjectKeyFormat == "" {
+			return nil, fmt.Errorf("invalid Routes, expected a container or a format: %s", item)
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+// keyFormats returns all the object key formats in use.
+func (cfg *AzblobConfig) keyFormats() []string {
+	formats := []string{cfg.ObjectKeyFormat}
+	if cfg.FallbackObjectKeyFormat != "" {
+		formats = append(formats, cfg.FallbackObjectKeyFormat)
+	}
+	for _, f := range cfg.TagKeyFormats {
+		formats = append(formats, f.ObjectKeyFormat)
+	}
+	for _, route := range cfg.Routes {
+		if route.ObjectKeyFormat != "" {
+			formats = append(formats, route.ObjectKeyFormat)
+		}
+	}
+
+	return formats
+}
+
+// IndexTagPlaceholders are the placeholders of the values of Index_Tags.
+var IndexTagPlaceholders = map[string]bool{
+	"tag": true, "hostname": true, "namespace": true, "deployment": true,
+}
+
+// parseIndexTags parses comma-separated "name:value" pairs of index tags. The
+// value is split off at the first colon, as values may hold colons too.
+func parseIndexTags(v string) (map[string]string, error) {
+	var tags map[string]string
+	for _, pair := range splitList(v) {
+		i := strings.IndexByte(pair, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid Index_Tags, expected name:value: %s", pair)
+		}
+		name, value := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		if len(name) > MaxIndexTagKey || indexTagChars.MatchString(name) {
+			return nil, fmt.Errorf("invalid Index_Tags, bad tag name: %s", name)
+		}
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("invalid Index_Tags, %s set twice", name)
+		}
+		for _, m := range keyPlaceholder.FindAllStringSubmatch(value, -1) {
+			if !IndexTagPlaceholders[m[1]] {
+				return nil, fmt.Errorf("invalid Index_Tags, unknown placeholder %s in %s", m[0], name)
+			}
+		}
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		tags[name] = value
+	}
+
+	return tags, nil
+}
+
+// validContainerName tells whether name is a valid container name: 3 to 63
+// lowercase letters, digits and single hyphens, starting and ending with a
+// letter or a digit.
+func validContainerName(name string) bool {
+	if len(name) < 3 || len(name) > 63 ||
+		name[0] == '-' || name[len(name)-1] == '-' || strings.Contains(name, "--") {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// systemContainers are the containers Azure names itself, which are valid
+// despite the dollar sign.
+var systemContainers = map[string]bool{"$root": true, "$web": true, "$logs": true}
+
+// sanitizeContainerName turns name into a valid container name: uppercase
+// letters are lowercased, other invalid characters and runs of them become a
+// single hyphen, and the name is cut to 63 characters. Names which are still
+// too short are an error.
+func sanitizeContainerName(name string) (string, error) {
+	if systemContainers[name] || validContainerName(name) {
+		return name, nil
+	}
+
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+		} else if s := b.String(); s != "" && s[len(s)-1] != '-' {
+			b.WriteByte('-')
+		}
+	}
+	sanitized := b.String()
+	if len(sanitized) > 63 {
+		sanitized = sanitized[:63]
+	}
+	sanitized = strings.TrimRight(sanitized, "-")
+
+	if !validContainerName(sanitized) {
+		return "", fmt.Errorf(
+			"invalid Azure_Container: %s can't be made a valid container name, "+
+				"it needs at least 3 letters or digits", name)
+	}
+
+	return sanitized, nil
+}
+
+// splitList splits a comma-separated value and drops the empty items.
+func splitList(v string) []string {
+	var items []string
+
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func pick(values []string, i int) string {
+	switch len(values) {
+	case 0:
+		return ""
+	case 1:
+		return values[0]
+	default:
+		return values[i]
+	}
+}
+
+// normalizeKeyFormat checks that an object key format has only known
+// placeholders, so a typo doesn't end up literally in every blob name. The
+// names of the placeholders are trimmed and lowercased, except for the keys of
+// %{record.<key>}.
+func normalizeKeyFormat(format string) (string, error) {
+	var err error
+	format = keyPlaceholder.ReplaceAllStringFunc(format, func(m string) string {
+		name := strings.TrimSpace(m[2 : len(m)-1])
+		if strings.HasPrefix(strings.ToLower(name), "record.") && len(name) > len("record.") {
+			return "%{record." + name[len("record."):] + "}"
+		}
+
+		name = strings.ToLower(name)
+		for _, p := range KeyPlaceholders {
+			if name == p {
+				return "%{" + name + "}"
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("unknown placeholder %s in object key format: %s, valid are %%{%s} and %%{record.<key>}",
+				m, format, strings.Join(KeyPlaceholders, "}, %{"))
+		}
+		return m
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if strings.Contains(keyPlaceholder.ReplaceAllString(format, ""), "%{") {
+		return "", fmt.Errorf("unclosed placeholder in object key format: %s", format)
+	}
+
+	return format, nil
+}
+
+// expandKeyFormat substitutes the placeholders which are fixed for the whole
+// lifetime of the plugin. An empty storeAs leaves %{file_extension} to be
+// chosen per batch.
+func expandKeyFormat(format, path string, storeAs FileFormat) string {
+	format = strings.ReplaceAll(format, "%{path}", path)
+	if storeAs != "" {
+		format = strings.ReplaceAll(format, "%{file_extension}", string(storeAs))
+	}
+
+	return format
 }
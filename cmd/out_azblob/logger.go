@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"sort"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh/terminal"
@@ -85,6 +86,18 @@ func (f *FluentBitLogFormat) Format(entry *logrus.Entry) ([]byte, error) {
 		b.WriteString(entry.Message)
 	}
 
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		if k != "interface" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		b.WriteString(fmt.Sprintf(" %s=%v", k, entry.Data[k]))
+	}
+
 	b.WriteByte('\n')
 	return b.Bytes(), nil
 }
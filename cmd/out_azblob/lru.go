@@ -0,0 +1,64 @@
+package main
+
+import "container/list"
+
+// blobCache holds the state of the most recently written append blobs. Once
+// it's full, the least recently used blob is evicted and rebuilt from the
+// storage on its next write. It isn't safe for concurrent use.
+type blobCache struct {
+	limit int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type blobCacheItem struct {
+	id    string
+	state *blobState
+}
+
+// newBlobCache returns a cache of at most limit blobs, or without a limit when
+// it's zero.
+func newBlobCache(limit int) *blobCache {
+	return &blobCache{
+		limit: limit,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (c *blobCache) Get(id string) (*blobState, bool) {
+	e, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+
+	return e.Value.(*blobCacheItem).state, true
+}
+
+func (c *blobCache) Add(id string, state *blobState) {
+	if e, ok := c.items[id]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*blobCacheItem).state = state
+		return
+	}
+
+	c.items[id] = c.ll.PushFront(&blobCacheItem{id: id, state: state})
+
+	if c.limit > 0 && c.ll.Len() > c.limit {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*blobCacheItem).id)
+	}
+}
+
+func (c *blobCache) Remove(id string) {
+	if e, ok := c.items[id]; ok {
+		c.ll.Remove(e)
+		delete(c.items, id)
+	}
+}
+
+func (c *blobCache) Len() int {
+	return c.ll.Len()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/sirupsen/logrus"
+)
+
+// NotifyTimeout bounds the request which enqueues a notification, so a slow
+// queue holds up the batch it's about only briefly.
+const NotifyTimeout = 5 * time.Second
+
+// DefaultWebhookTimeout bounds every try to post to WebhookURL, and
+// DefaultWebhookRetries is how often a failed post is tried again, first
+// after WebhookRetryInterval, which doubles with every retry.
+const (
+	DefaultWebhookTimeout = 5 * time.Second
+	DefaultWebhookRetries = 3
+	WebhookRetryInterval  = 500 * time.Millisecond
+)
+
+// Notification is the message enqueued on NotifyQueue, and posted to
+// WebhookURL, for every blob write. Size and Records are those of the write,
+// which for an append blob is only what was appended; FirstRecord and
+// LastRecord are the times of its earliest and latest record, when known.
+type Notification struct {
+	URL         string `json:"url"`
+	Container   string `json:"container"`
+	Blob        string `json:"blob"`
+	Size        int    `json:"size"`
+	Records     int    `json:"records"`
+	FirstRecord string `json:"first_record,omitempty"`
+	LastRecord  string `json:"last_record,omitempty"`
+	Time        string `json:"time"`
+}
+
+// newQueueURL returns the URL which messages are put to on the queue at
+// queueURL, and the pipeline which sends them. A queue URL with a SAS of its
+// own is used as it is; otherwise the credentials of the storage account
+// sign the requests.
+func newQueueURL(queueURL, sas, key string,
+	options azblob.PipelineOptions) (*url.URL, pipeline.Pipeline, error) {
+	u, err := url.Parse(strings.TrimRight(queueURL, "/"))
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Path == "" {
+		return nil, nil, fmt.Errorf("invalid Notify_Queue_URL: %s", queueURL)
+	}
+	u.Path += "/messages"
+
+	var credential azblob.Credential
+	switch {
+	case u.RawQuery != "":
+		credential = azblob.NewAnonymousCredential()
+	case sas != "":
+		credential = azblob.NewAnonymousCredential()
+		u.RawQuery = strings.TrimPrefix(sas, "?")
+	default:
+		account := strings.SplitN(u.Hostname(), ".", 2)[0]
+		credential, err = azblob.NewSharedKeyCredential(account, key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid credential: " + err.Error())
+		}
+	}
+
+	return u, azblob.NewPipeline(credential, options), nil
+}
+
+// notification describes a write of blocks to the blob at objectKey, with the
+// records coming from src.
+func (u *AzblobUploader) notification(container azblob.ContainerURL,
+	objectKey string, blocks [][]byte, src Source) Notification {
+	name := objectKey
+	if u.config.BlobType == AppendBlob {
+		u.blobsMu.Lock()
+		if state, ok := u.blobs.Get(blobID(container, objectKey)); ok {
+			name = partKey(objectKey, state.part)
+		}
+		u.blobsMu.Unlock()
+	}
+
+	size := 0
+	for _, block := range blocks {
+		size += len(block)
+	}
+	containerURL := container.URL()
+	n := Notification{
+		URL:       redactURL(container.NewBlobURL(name).URL()),
+		Container: containerURL.Path[strings.LastIndex(containerURL.Path, "/")+1:],
+		Blob:      name,
+		Size:      size,
+		Records:   countRecords(blocks),
+		Time:      u.now().UTC().Format(time.RFC3339Nano),
+	}
+	if !src.First.IsZero() {
+		n.FirstRecord = src.First.UTC().Format(time.RFC3339Nano)
+		n.LastRecord = src.Last.UTC().Format(time.RFC3339Nano)
+	}
+
+	return n
+}
+
+// notify enqueues n on NotifyQueue. It's best-effort: the records are already
+// written, so a failure is only logged.
+func (u *AzblobUploader) notify(l *logrus.Entry, n Notification) {
+	msg, err := jsoniter.Marshal(n)
+	if err != nil {
+		l.Warnf("encode notification error, blob=%s: %v", n.Blob, err)
+		return
+	}
+
+	// Queue triggers, e.g. of Azure Functions, expect the message text in
+	// base64.
+	body, _ := xml.Marshal(struct {
+		XMLName     xml.Name `xml:"QueueMessage"`
+		MessageText string
+	}{MessageText: base64.StdEncoding.EncodeToString(msg)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), NotifyTimeout)
+	defer cancel()
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	_, _, err = doRequest(ctx, u.config.NotifyPipeline, http.MethodPost,
+		*u.config.NotifyQueue, header, body)
+	if err != nil {
+		l.WithField("error_code", errorCode(err)).Warnf(
+			"enqueue notification error, blob=%s: %v", n.Blob, err)
+	}
+}
+
+// startWebhook posts n to WebhookURL in the background, unless Stop is done
+// waiting for the posts.
+func (u *AzblobUploader) startWebhook(l *logrus.Entry, n Notification) {
+	u.webhooksMu.Lock()
+	defer u.webhooksMu.Unlock()
+
+	if u.webhooksClosed {
+		l.Warnf("uploader stopped, webhook post not sent, blob=%s", n.Blob)
+		return
+	}
+	u.webhooks.Add(1)
+	go u.postWebhook(l, n)
+}
+
+// postWebhook posts n as JSON to WebhookURL. It runs apart from the upload,
+// which neither waits for it nor fails with it. Network errors, timeouts,
+// throttling and server errors are retried up to WebhookRetries times; a post
+// which still fails, or which the webhook rejects, is only logged. Once the
+// uploader is stopping, failed posts aren't retried.
+func (u *AzblobUploader) postWebhook(l *logrus.Entry, n Notification) {
+	defer u.webhooks.Done()
+
+	body, err := jsoniter.Marshal(n)
+	if err != nil {
+		l.Warnf("encode notification error, blob=%s: %v", n.Blob, err)
+		return
+	}
+
+	interval := WebhookRetryInterval
+	for retries := 0; ; retries++ {
+		var status int
+		status, err = u.tryWebhook(body)
+		if err == nil {
+			return
+		}
+		retryable := status == 0 || status == http.StatusRequestTimeout ||
+			status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+		if !retryable || retries >= u.config.WebhookRetries {
+			break
+		}
+		select {
+		case <-time.After(interval):
+		case <-u.quit:
+			l.Warnf("uploader stopped, webhook post not retried, blob=%s endpoint=%s: %v",
+				n.Blob, u.config.WebhookURL.Host, err)
+			return
+		}
+		interval *= 2
+	}
+
+	l.Warnf("post webhook error, blob=%s endpoint=%s: %v", n.Blob, u.config.WebhookURL.Host, err)
+}
+
+// tryWebhook posts body to WebhookURL once, within WebhookTimeout. It returns
+// the HTTP status, which is 0 when there's no response.
+func (u *AzblobUploader) tryWebhook(body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), u.config.WebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		u.config.WebhookURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if u.config.UserAgent != "" {
+		req.Header.Set("User-Agent", u.config.UserAgent)
+	}
+
+	resp, err := u.config.WebhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
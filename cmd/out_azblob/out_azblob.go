@@ -2,22 +2,83 @@ package main
 
 import (
 	"C"
+	"encoding/base64"
 	"fmt"
+	"math"
 	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 	"unsafe"
 
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/fluent/fluent-bit-go/output"
 	jsoniter "github.com/json-iterator/go"
+	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 )
 
+// MissingRecordValue replaces a %{record.<key>} placeholder when the record
+// has no such key.
+const MissingRecordValue = "unknown"
+
+// recordPlaceholder matches %{record.<key>[.<key>...]}, a value of the record
+// itself, e.g. %{record.kubernetes.pod_name}, and the shorthands for the
+// Kubernetes metadata in WorkloadPaths, e.g. %{namespace}.
+var recordPlaceholder = regexp.MustCompile(
+	`%\{(?:record\.([^}]+)|(namespace|pod|container|deployment))\}`)
+
+// WorkloadPaths are the fields of the Kubernetes metadata which the workload
+// placeholders stand for. %{deployment} is derived from the pod name.
+var WorkloadPaths = map[string][]string{
+	"namespace":  {"kubernetes", "namespace_name"},
+	"pod":        {"kubernetes", "pod_name"},
+	"container":  {"kubernetes", "container_name"},
+	"deployment": {"kubernetes", "pod_name"},
+}
+
+// ImagePath is the field of the Kubernetes metadata which %{image} stands for.
+var ImagePath = []string{"kubernetes", "container_image"}
+
+// kubernetesPath returns the path of a field of the Kubernetes metadata in
+// records where it's flattened to top-level fields named with prefix, e.g.
+// kubernetes_pod_name. With no prefix the path is returned as it is.
+func kubernetesPath(path []string, prefix string) []string {
+	if prefix == "" {
+		return path
+	}
+
+	return append([]string{prefix + path[1]}, path[2:]...)
+}
+
+// imageUnsafe matches the characters of image references which don't belong
+// in an object key, such as the slashes of the registry and the colon of the
+// tag.
+var imageUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// imageName makes an image reference fit for one path component, e.g.
+// docker.io/library/nginx:1.19 becomes docker.io_library_nginx_1.19.
+func imageName(image string) string {
+	return imageUnsafe.ReplaceAllString(image, "_")
+}
+
+// ansiEscape matches the ANSI escape sequences of terminal output: CSI
+// sequences such as colors, OSC sequences such as hyperlinks, character set
+// selections and the escapes of a single character.
+var ansiEscape = regexp.MustCompile(
+	`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[ -/]+[0-~]|\x1b[@-Z\\-_]`)
+
 var (
-	Version   string
-	Hostname  string
-	operators []*AzblobOperator
-	logger    *logrus.Entry
+	Version    string
+	Hostname   string
+	InstanceID string
+	operators  []*AzblobOperator
+	logger     *logrus.Entry
 )
 
 type PluginConfig interface {
@@ -29,9 +90,15 @@ type FLBPluginConfig struct {
 }
 
 type AzblobOperator struct {
-	config   *AzblobConfig
-	logger   *logrus.Entry
-	uploader *AzblobUploader
+	config    *AzblobConfig
+	logger    *logrus.Entry
+	uploader  *AzblobUploader
+	formats   map[string]*keyFormat
+	formatsMu sync.Mutex
+	// invalid counts the records which don't match the schema
+	invalid uint64
+	// tagWarnings are the Index_Tags values warned about
+	tagWarnings sync.Map
 }
 
 func (c *FLBPluginConfig) Get(key string) string {
@@ -46,6 +113,10 @@ func NewOperator(id int, cfg *AzblobConfig) (*AzblobOperator, error) {
 	o.config = cfg
 
 	o.logger = NewLogger(fmt.Sprintf("azblob.%d", id), cfg.LogLevel)
+	if cfg.ContainerRenamedFrom != "" {
+		o.logger.Warnf("Azure_Container %s is not a valid container name, using %s",
+			cfg.ContainerRenamedFrom, cfg.Container)
+	}
 
 	o.uploader, err = NewUploader(cfg, o.logger)
 	if err != nil {
@@ -56,25 +127,790 @@ func NewOperator(id int, cfg *AzblobConfig) (*AzblobOperator, error) {
 }
 
 func (o *AzblobOperator) SendRecord(
-	r map[interface{}]interface{}, ts time.Time) error {
+	r map[interface{}]interface{}, ts time.Time, tag string) error {
 	time.Local = o.config.Location
+	ts = o.uploader.clampTime(o.recordTime(r, ts))
 	timeSlice := ts.Local().Format(o.config.TimeSliceFormat)
 
-	raw, err := createJSON(r)
+	if o.config.SkipMissingMessage && !hasMessage(r, o.config.MessageKey) {
+		o.logger.Tracef("skip record without %s", o.config.MessageKey)
+		return nil
+	}
+
+	raw, err := o.encodeRecord(r, ts)
 	if err != nil {
-		return err
+		return permanentError{err}
+	}
+
+	key := o.batchKey(r, timeSlice, tag)
+	if o.config.Schema != nil {
+		if err := o.config.Schema.Validate(r); err != nil {
+			invalid := atomic.AddUint64(&o.invalid, 1)
+			o.logger.Debugf("record doesn't match the schema, invalid=%d: %v", invalid, err)
+			key.ObjectKeyFormat = o.config.InvalidRecordPrefix + key.ObjectKeyFormat
+		}
 	}
 
 	o.logger.Tracef(
 		"add entry, time_slice=%s raw=%s", timeSlice, raw)
-	o.uploader.Entries <- Entry{TimeSlice: timeSlice, Raw: raw}
+	o.uploader.Entries <- Entry{
+		Key:    key,
+		Time:   ts,
+		Tag:    tag,
+		Raw:    raw,
+		Source: o.source(r, tag),
+	}
 
 	return nil
 }
 
+// batchKey returns the key of the batch a record goes to. The object key
+// format always splits batches, the other fields only when they're in
+// BatchKeyFields.
+func (o *AzblobOperator) batchKey(
+	r map[interface{}]interface{}, timeSlice, tag string) BatchKey {
+	route := o.matchRoute(r, tag)
+
+	k := BatchKey{ObjectKeyFormat: o.tagKeyFormat(tag, o.config.ObjectKeyFormat)}
+	if o.config.Mode != FlatMode {
+		format := o.tagKeyFormat(tag, o.objectKeyFormat(r))
+		if route != nil && route.ObjectKeyFormat != "" {
+			format = route.ObjectKeyFormat
+		}
+		k.ObjectKeyFormat = o.keyFormat(format).resolve(r)
+	}
+
+	if o.config.BatchKeyFields[BatchKeyTimeSlice] {
+		k.TimeSlice = timeSlice
+	}
+	if o.config.BatchKeyFields[BatchKeyRoute] {
+		k.Route = o.route(r)
+	}
+	if o.config.BatchKeyFields[BatchKeyTag] {
+		k.Tag = tag
+	}
+	if o.config.BatchKeyFields[BatchKeyLevel] {
+		k.Level = o.level(r)
+	}
+	if o.config.BatchKeyFields[BatchKeyImage] {
+		k.Image = imageName(recordValue(r, kubernetesPath(ImagePath, o.config.KubernetesPrefix)))
+	}
+	k.Container = o.container(r)
+	if route != nil && route.Container != "" {
+		k.Container = route.Container
+		if k.Container == o.config.Container {
+			k.Container = ""
+		}
+	}
+
+	return k
+}
+
+// matchRoute returns the first of Routes whose conditions all match a record,
+// if any. A record without the field of a condition doesn't match it.
+func (o *AzblobOperator) matchRoute(r map[interface{}]interface{}, tag string) *Route {
+	for i, route := range o.config.Routes {
+		matched := true
+		for _, cond := range route.Conditions {
+			v := tag
+			if cond.Path != nil {
+				v = recordValue(r, cond.Path)
+			}
+			if ok, _ := path.Match(cond.Pattern, v); !ok || v == MissingRecordValue {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return &o.config.Routes[i]
+		}
+	}
+
+	return nil
+}
+
+// resolveRecordPlaceholders replaces the %{record.<key>} placeholders of an
+// object key format by the values of the record. It's done per record before
+// batching, so records with different values go to different batches and
+// every record ends up in the blob its own values name.
+func resolveRecordPlaceholders(format string, r map[interface{}]interface{}) string {
+	return newKeyFormat(format, "").resolve(r)
+}
+
+// keyFormat is an object key format split on its %{record.<key>} and
+// workload placeholders once, so resolving it per record needs no regexp.
+//
+// The records of a flush mostly come from the same pod, so they resolve to
+// the same key. The values of the last record and its key are kept, and a
+// record with the same values reuses the key instead of building it again.
+type keyFormat struct {
+	literals []string
+	paths    [][]string
+	// deployment is set for the paths of %{deployment}
+	deployment []bool
+
+	mu      sync.Mutex
+	values  []string
+	scratch []string
+	key     string
+}
+
+func newKeyFormat(format, kubernetesPrefix string) *keyFormat {
+	f := &keyFormat{}
+
+	start := 0
+	for _, m := range recordPlaceholder.FindAllStringSubmatchIndex(format, -1) {
+		f.literals = append(f.literals, format[start:m[0]])
+		if m[2] >= 0 {
+			f.paths = append(f.paths, strings.Split(format[m[2]:m[3]], "."))
+			f.deployment = append(f.deployment, false)
+		} else {
+			name := format[m[4]:m[5]]
+			f.paths = append(f.paths, kubernetesPath(WorkloadPaths[name], kubernetesPrefix))
+			f.deployment = append(f.deployment, name == "deployment")
+		}
+		start = m[1]
+	}
+	f.literals = append(f.literals, format[start:])
+	f.values = make([]string, len(f.paths))
+	f.scratch = make([]string, len(f.paths))
+
+	if len(f.paths) == 0 {
+		f.key = format
+	}
+
+	return f
+}
+
+func (f *keyFormat) resolve(r map[interface{}]interface{}) string {
+	if len(f.paths) == 0 {
+		return f.key
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, path := range f.paths {
+		f.scratch[i] = recordValue(r, path)
+		if f.deployment[i] {
+			f.scratch[i] = deploymentName(f.scratch[i])
+			if f.scratch[i] == "" {
+				f.scratch[i] = MissingRecordValue
+			}
+		}
+	}
+	if f.key != "" && equalStrings(f.scratch, f.values) {
+		return f.key
+	}
+
+	var b strings.Builder
+	for i, v := range f.scratch {
+		b.WriteString(f.literals[i])
+		b.WriteString(v)
+	}
+	b.WriteString(f.literals[len(f.paths)])
+
+	f.values, f.scratch = f.scratch, f.values
+	f.key = b.String()
+
+	return f.key
+}
+
+func equalStrings(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordValue returns the value at path in a record as it's put into an
+// object key, or MissingRecordValue.
+func recordValue(r map[interface{}]interface{}, path []string) string {
+	var v interface{} = r
+	for _, key := range path {
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return MissingRecordValue
+		}
+		v = m[key]
+	}
+
+	switch t := v.(type) {
+	case nil:
+		return MissingRecordValue
+	case []byte:
+		if len(t) == 0 {
+			return MissingRecordValue
+		}
+		return string(t)
+	case string:
+		if t == "" {
+			return MissingRecordValue
+		}
+		return t
+	case map[interface{}]interface{}, []interface{}:
+		return MissingRecordValue
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// keyFormat returns the parsed object key format, which is shared by all the
+// records using it.
+func (o *AzblobOperator) keyFormat(format string) *keyFormat {
+	o.formatsMu.Lock()
+	defer o.formatsMu.Unlock()
+
+	if o.formats == nil {
+		o.formats = map[string]*keyFormat{}
+	}
+
+	f, ok := o.formats[format]
+	if !ok {
+		f = newKeyFormat(format, o.config.KubernetesPrefix)
+		o.formats[format] = f
+	}
+
+	return f
+}
+
+// objectKeyFormat returns the object key format for a record. Records without
+// Kubernetes metadata use the fallback format when one is configured.
+func (o *AzblobOperator) objectKeyFormat(r map[interface{}]interface{}) string {
+	if o.config.FallbackObjectKeyFormat == "" {
+		return o.config.ObjectKeyFormat
+	}
+
+	if _, ok := o.kubernetes(r); !ok {
+		return o.config.FallbackObjectKeyFormat
+	}
+
+	return o.config.ObjectKeyFormat
+}
+
+// tagKeyFormat returns the object key format of the first of TagKeyFormats
+// matching a tag, or format when none does.
+func (o *AzblobOperator) tagKeyFormat(tag, format string) string {
+	for _, f := range o.config.TagKeyFormats {
+		if ok, _ := path.Match(f.Pattern, tag); ok {
+			return f.ObjectKeyFormat
+		}
+	}
+
+	return format
+}
+
+// container returns the container named by the ContainerKey field of a
+// record, e.g. the cluster it comes from, which lets one agent write the
+// records of several clusters to their own containers. The name is sanitized
+// per Container_Name_Policy like Azure_Container. Records without a usable
+// name go to Azure_Container, for which it's empty.
+func (o *AzblobOperator) container(r map[interface{}]interface{}) string {
+	if len(o.config.ContainerKey) == 0 {
+		return ""
+	}
+
+	v := recordValue(r, o.config.ContainerKey)
+	if v == MissingRecordValue {
+		return ""
+	}
+
+	name := v
+	if o.config.ContainerNamePolicy != StrictContainerName {
+		name, _ = sanitizeContainerName(v)
+	}
+	// the system containers aren't for records
+	if !validContainerName(name) {
+		o.logger.Debugf("invalid container name in record: %s", v)
+		return ""
+	}
+	if name == o.config.Container {
+		return ""
+	}
+
+	return name
+}
+
+// route returns the value of the RouteKey field of a record, e.g. a tenant,
+// which keeps the records of different routes in separate blobs. Records
+// without the field go to RouteDefault.
+func (o *AzblobOperator) route(r map[interface{}]interface{}) string {
+	if o.config.RouteKey == "" {
+		return ""
+	}
+
+	var route string
+	switch v := r[o.config.RouteKey].(type) {
+	case nil:
+	case []byte:
+		route = string(v)
+	case string:
+		route = v
+	default:
+		route = fmt.Sprint(v)
+	}
+
+	if route == "" {
+		return o.config.RouteDefault
+	}
+
+	return route
+}
+
+// levels maps the severities found in records to the values of %{level}.
+var levels = map[string]string{
+	"trace":    "trace",
+	"debug":    "debug",
+	"info":     "info",
+	"notice":   "info",
+	"warn":     "warn",
+	"warning":  "warn",
+	"error":    "error",
+	"err":      "error",
+	"fatal":    "fatal",
+	"critical": "fatal",
+	"crit":     "fatal",
+	"alert":    "fatal",
+	"emerg":    "fatal",
+	"panic":    "fatal",
+}
+
+// syslogLevels maps the numeric syslog severities to the values of %{level}.
+var syslogLevels = []string{"fatal", "fatal", "fatal", "error", "warn", "info", "info", "debug"}
+
+// severities ranks the values of %{level}.
+var severities = map[string]int{
+	"trace": 0,
+	"debug": 1,
+	"info":  2,
+	"warn":  3,
+	"error": 4,
+	"fatal": 5,
+}
+
+// level returns the severity of a record from its LevelKey field, so e.g.
+// errors can be kept apart from debug logs. Names are matched regardless of
+// case, numbers are syslog severities. Records without a known severity go to
+// LevelDefault.
+func (o *AzblobOperator) level(r map[interface{}]interface{}) string {
+	return parseLevel(r[o.config.LevelKey], o.config.LevelDefault)
+}
+
+// parseLevel returns the value of %{level} for a severity as decoded from
+// msgpack or JSON, or def when it isn't known.
+func parseLevel(v interface{}, def string) string {
+	var level string
+	switch v := v.(type) {
+	case []byte:
+		level = string(v)
+	case string:
+		level = v
+	case int64:
+		if v >= 0 && v < int64(len(syslogLevels)) {
+			return syslogLevels[v]
+		}
+	case uint64:
+		if v < uint64(len(syslogLevels)) {
+			return syslogLevels[v]
+		}
+	case float64:
+		if v >= 0 && v < float64(len(syslogLevels)) && v == float64(int(v)) {
+			return syslogLevels[int(v)]
+		}
+	}
+
+	level = strings.ToLower(strings.TrimSpace(level))
+	if l, ok := levels[level]; ok {
+		return l
+	}
+	if n, err := strconv.Atoi(level); err == nil && n >= 0 && n < len(syslogLevels) {
+		return syslogLevels[n]
+	}
+
+	return def
+}
+
+// source returns the Kubernetes workload of a record from the metadata added
+// by the kubernetes filter of fluent-bit. Records without it, and all records
+// in flat mode, have no source. Its labels include the IndexTags, resolved
+// for the record and its tag.
+func (o *AzblobOperator) source(r map[interface{}]interface{}, tag string) Source {
+	var s Source
+	if o.config.Mode != FlatMode {
+		if k, ok := o.kubernetes(r); ok {
+			s = o.workload(k)
+		}
+	}
+
+	for name, value := range o.config.IndexTags {
+		if s.Labels == nil {
+			s.Labels = map[string]string{}
+		}
+		s.Labels[name] = o.indexTag(name, value, s, tag)
+	}
+
+	return s
+}
+
+// kubernetes returns the Kubernetes metadata of a record: its kubernetes
+// field, or with KubernetesPrefix the fields named with the prefix, gathered
+// under their names without it.
+func (o *AzblobOperator) kubernetes(
+	r map[interface{}]interface{}) (map[interface{}]interface{}, bool) {
+	prefix := o.config.KubernetesPrefix
+	if prefix == "" {
+		k, ok := r["kubernetes"].(map[interface{}]interface{})
+		return k, ok
+	}
+
+	var k map[interface{}]interface{}
+	for key, v := range r {
+		name, ok := key.(string)
+		if !ok || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if k == nil {
+			k = map[interface{}]interface{}{}
+		}
+		k[name[len(prefix):]] = v
+	}
+
+	return k, k != nil
+}
+
+// workload returns the source of a record from its Kubernetes metadata.
+func (o *AzblobOperator) workload(k map[interface{}]interface{}) Source {
+	field := func(key string) string {
+		if v := recordValue(k, []string{key}); v != MissingRecordValue {
+			return v
+		}
+		return ""
+	}
+
+	s := Source{
+		Namespace: field("namespace_name"),
+		Pod:       field("pod_name"),
+		Container: field("container_name"),
+	}
+	s.Deployment = deploymentName(s.Pod)
+
+	if labels, ok := k["labels"].(map[interface{}]interface{}); ok {
+		for _, name := range o.config.IndexTagLabels {
+			v := recordValue(labels, []string{name})
+			if v == MissingRecordValue {
+				continue
+			}
+			if s.Labels == nil {
+				s.Labels = map[string]string{}
+			}
+			s.Labels[name] = indexTagValue(v)
+		}
+	}
+
+	return s
+}
+
+// indexTag resolves the placeholders of the value of one of IndexTags for a
+// record. Invalid characters are dropped with a warning, once per value, and
+// the value is cut to 256 characters.
+func (o *AzblobOperator) indexTag(name, value string, s Source, tag string) string {
+	if strings.Contains(value, "%{") {
+		value = strings.NewReplacer(
+			"%{tag}", tag,
+			"%{hostname}", Hostname,
+			"%{namespace}", s.Namespace,
+			"%{deployment}", s.Deployment,
+		).Replace(value)
+	}
+
+	if indexTagChars.MatchString(value) {
+		if _, warned := o.tagWarnings.LoadOrStore(name+"="+value, true); !warned {
+			o.logger.Warnf("index tag %s has invalid characters, which are dropped: %s", name, value)
+		}
+		value = indexTagChars.ReplaceAllString(value, "")
+	}
+	if len(value) > MaxIndexTagValue {
+		value = value[:MaxIndexTagValue]
+	}
+
+	return value
+}
+
+// indexTagChars matches the characters index tags can't have.
+var indexTagChars = regexp.MustCompile(`[^A-Za-z0-9 +\-./:=_]`)
+
+// indexTagValue makes a label value fit for the value of an index tag: at
+// most 256 characters out of letters, digits, spaces and +-./:=_.
+func indexTagValue(v string) string {
+	v = indexTagChars.ReplaceAllString(v, "_")
+	if len(v) > MaxIndexTagValue {
+		v = v[:MaxIndexTagValue]
+	}
+
+	return v
+}
+
+// podNameChars are the characters of the generated suffixes of pod names.
+const podNameChars = "bcdfghjklmnpqrstvwxz2456789"
+
+// deploymentName returns the deployment of a pod from its name, which is the
+// deployment name followed by the pod template hash and a random suffix, e.g.
+// "web-5d9c8b7f94-x2lpq". It's empty when the name doesn't look like that.
+func deploymentName(pod string) string {
+	i := strings.LastIndexByte(pod, '-')
+	if i < 0 || !isPodNameSuffix(pod[i+1:], 5, 5) {
+		return ""
+	}
+	j := strings.LastIndexByte(pod[:i], '-')
+	if j <= 0 || !isPodNameSuffix(pod[j+1:i], 6, 10) {
+		return ""
+	}
+
+	return pod[:j]
+}
+
+func isPodNameSuffix(s string, min, max int) bool {
+	if len(s) < min || len(s) > max {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(podNameChars, s[i]) < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordTime returns the time of a record from its TimeKey field, so records
+// which arrive late still go to the time slice of the event rather than the
+// one they are received in. Strings are parsed with TimeFormat, in the
+// TimeZone unless they have a zone of their own, numbers are Unix times in
+// seconds. Records without a valid time keep ts, the time from fluent-bit.
+func (o *AzblobOperator) recordTime(r map[interface{}]interface{}, ts time.Time) time.Time {
+	if o.config.TimeKey == "" {
+		return ts
+	}
+
+	var v string
+	switch t := r[o.config.TimeKey].(type) {
+	case []byte:
+		v = string(t)
+	case string:
+		v = t
+	case int64:
+		return time.Unix(t, 0)
+	case uint64:
+		return time.Unix(int64(t), 0)
+	case float64:
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*1e9))
+	default:
+		return ts
+	}
+
+	loc := o.config.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t, err := time.ParseInLocation(o.config.TimeFormat, strings.TrimSpace(v), loc)
+	if err != nil {
+		return ts
+	}
+
+	return t
+}
+
+// hasMessage tells whether a record has a non-empty message.
+func hasMessage(r map[interface{}]interface{}, messageKey string) bool {
+	switch v := r[messageKey].(type) {
+	case nil:
+		return false
+	case []byte:
+		return len(v) > 0
+	case string:
+		return v != ""
+	default:
+		return true
+	}
+}
+
+// encodeRecord converts a record to the JSON line stored in the blob. With
+// PreserveRaw the record as received is kept under RawKey, so nothing from
+// the input is lost whatever the output does to the record.
+func (o *AzblobOperator) encodeRecord(
+	r map[interface{}]interface{}, ts time.Time) ([]byte, error) {
+	var err error
+	var original []byte
+
+	m := encodeJSON(r)
+
+	if o.config.PreserveRaw {
+		original, err = marshalJSON(m)
+		if err != nil {
+			return original, err
+		}
+	}
+
+	o.addOrigin(m)
+
+	if o.config.StripANSI {
+		stripANSI(m, o.config.MessageKey)
+	}
+
+	if o.config.EncodeInvalidUTF8 {
+		encodeInvalidUTF8(m, o.config.MessageKey)
+	}
+
+	if o.config.Format == LogAnalyticsFormat {
+		o.toLogAnalytics(m, ts)
+	}
+
+	if o.config.FieldRename != nil {
+		renameFields(m, o.config.FieldRename)
+	}
+
+	if original != nil {
+		m[o.config.RawKey] = jsoniter.RawMessage(original)
+	}
+
+	return marshalJSON(m)
+}
+
+// addOrigin adds the cluster and region to a record, so logs of several
+// clusters can be told apart without parsing the blob path. Keys which are
+// already in the record are left untouched.
+func (o *AzblobOperator) addOrigin(m map[string]interface{}) {
+	origin := map[string]string{
+		o.config.ClusterKey: o.config.ClusterName,
+		o.config.RegionKey:  o.config.Region,
+	}
+
+	for k, v := range origin {
+		if v == "" {
+			continue
+		}
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+}
+
+// logAnalyticsFields map the fields of the kubernetes filter of fluent-bit to
+// the columns of the ContainerLogV2 table.
+var logAnalyticsFields = map[string]string{
+	"container_id":   "ContainerId",
+	"container_name": "ContainerName",
+	"pod_name":       "PodName",
+	"namespace_name": "PodNamespace",
+}
+
+// toLogAnalytics shapes a record like a row of the ContainerLogV2 table of
+// Azure Monitor, so the blobs can be ingested into Log Analytics as they are:
+// the message becomes LogMessage, the stream LogSource and the Kubernetes
+// metadata KubernetesMetadata, with the pod and container in columns of their
+// own. TimeGenerated is the time of the record and Computer the node. Other
+// fields are kept as they are.
+func (o *AzblobOperator) toLogAnalytics(m map[string]interface{}, ts time.Time) {
+	m["TimeGenerated"] = ts.UTC().Format(time.RFC3339Nano)
+	m["Computer"] = Hostname
+
+	if msg, ok := m[o.config.MessageKey]; ok {
+		m["LogMessage"] = msg
+		delete(m, o.config.MessageKey)
+	}
+	if stream, ok := m["stream"]; ok {
+		m["LogSource"] = stream
+		delete(m, "stream")
+	}
+
+	k, ok := m["kubernetes"].(map[string]interface{})
+	if prefix := o.config.KubernetesPrefix; prefix != "" {
+		k, ok = nil, false
+		for name, v := range m {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if k == nil {
+				k, ok = map[string]interface{}{}, true
+			}
+			k[name[len(prefix):]] = v
+			delete(m, name)
+		}
+	}
+	if !ok {
+		return
+	}
+	for from, to := range logAnalyticsFields {
+		if v, ok := k[from]; ok {
+			m[to] = v
+		}
+	}
+	if host, ok := k["host"].(string); ok && host != "" {
+		m["Computer"] = host
+	}
+	m["KubernetesMetadata"] = k
+	delete(m, "kubernetes")
+}
+
+// renameFields renames the fields of a record, at any depth, to the names
+// given by rename, so the stored schema matches what its consumers expect.
+// Other fields keep their names.
+func renameFields(m map[string]interface{}, rename map[string]string) {
+	for _, v := range m {
+		if nested, ok := v.(map[string]interface{}); ok {
+			renameFields(nested, rename)
+		}
+	}
+
+	// Fields are moved in two steps, so two fields can swap names.
+	var moved map[string]interface{}
+	for from, to := range rename {
+		if v, ok := m[from]; ok {
+			if moved == nil {
+				moved = map[string]interface{}{}
+			}
+			moved[to] = v
+			delete(m, from)
+		}
+	}
+	for k, v := range moved {
+		m[k] = v
+	}
+}
+
+// stripANSI removes the ANSI escape sequences, e.g. colors, from a message, so
+// it's stored as plain text.
+func stripANSI(m map[string]interface{}, messageKey string) {
+	msg, ok := m[messageKey].(string)
+	if !ok || !strings.ContainsRune(msg, '\x1b') {
+		return
+	}
+
+	m[messageKey] = ansiEscape.ReplaceAllString(msg, "")
+}
+
+// encodeInvalidUTF8 replaces a message which isn't valid UTF-8, e.g. binary
+// output of a container, by its base64 encoding and flags it with
+// "encoding":"base64". JSON can't carry such a message as it is.
+func encodeInvalidUTF8(m map[string]interface{}, messageKey string) {
+	msg, ok := m[messageKey].(string)
+	if !ok || utf8.ValidString(msg) {
+		return
+	}
+
+	m[messageKey] = base64.StdEncoding.EncodeToString([]byte(msg))
+	m["encoding"] = "base64"
+}
+
 func createJSON(record map[interface{}]interface{}) ([]byte, error) {
-	m := encodeJSON(record)
+	return marshalJSON(encodeJSON(record))
+}
 
+func marshalJSON(m map[string]interface{}) ([]byte, error) {
 	js, err := jsoniter.Marshal(m)
 	if err != nil {
 		return []byte("{}"), err
@@ -130,13 +966,29 @@ func FLBPluginInit(ctx unsafe.Pointer) int {
 	output.FLBPluginSetContext(ctx, id)
 	operators = append(operators, operator)
 
-	operator.logger.Infof("container_url=%v", cfg.ContainerURL)
+	for _, containerURL := range cfg.ContainerURLs {
+		operator.logger.Infof("container_url=%v", containerURL)
+	}
 	operator.logger.Infof("auto_create_container=%v", cfg.AutoCreateContainer)
 	operator.logger.Infof("object_key_format=%s", cfg.ObjectKeyFormat)
+	if cfg.FallbackObjectKeyFormat != "" {
+		operator.logger.Infof("fallback_object_key_format=%s", cfg.FallbackObjectKeyFormat)
+	}
+	if cfg.RouteKey != "" {
+		operator.logger.Infof("route_key=%s route_default=%s", cfg.RouteKey, cfg.RouteDefault)
+	}
+	if len(cfg.ContainerKey) > 0 {
+		operator.logger.Infof("container_key=%s", strings.Join(cfg.ContainerKey, "."))
+	}
 	operator.logger.Infof("time_slice_format=%s", cfg.TimeSliceFormat)
 	operator.logger.Infof("store_as=%v", cfg.StoreAs)
+	operator.logger.Infof("blob_type=%v", cfg.BlobType)
 	operator.logger.Infof("batch_wait=%v", cfg.BatchWait)
 	operator.logger.Infof("batch_limit_size=%s", bytefmt.ByteSize(cfg.BatchLimitSize))
+	for _, rule := range cfg.BatchRules {
+		operator.logger.Infof("batch_rule=%s wait=%v limit_size=%s",
+			rule.Pattern, rule.Wait, bytefmt.ByteSize(rule.LimitSize))
+	}
 
 	return output.FLB_OK
 }
@@ -154,6 +1006,11 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 	var record map[interface{}]interface{}
 
 	operator := operators[output.FLBPluginGetContext(ctx).(int)]
+
+	if ret := operator.admitFlush(); ret != output.FLB_OK {
+		return ret
+	}
+
 	dec := output.NewDecoder(data, int(length))
 
 	for {
@@ -174,30 +1031,108 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 			timestamp = time.Now()
 		}
 
-		err := operator.SendRecord(record, timestamp)
+		err := operator.SendRecord(record, timestamp, C.GoString(tag))
 		if err != nil {
 			operator.logger.Warnf("sending record error: %v", err)
 
-			return output.FLB_RETRY
+			return flushCode(err)
 		}
 	}
 
 	return output.FLB_OK
 }
 
+// admitFlush returns FLB_OK when a flush may hand its records over, and
+// FLB_RETRY while the last batch is lost. The chunk itself wasn't tried, so
+// it's retried even when the lost batch failed permanently.
+func (o *AzblobOperator) admitFlush() int {
+	if err := o.uploader.FlushErr(); err != nil {
+		o.logger.Warnf("last batch was lost, rejecting flush: %v", err)
+		return output.FLB_RETRY
+	}
+
+	return output.FLB_OK
+}
+
+// flushCode maps an error to the return code of a flush, so the scheduler of
+// fluent-bit retries the chunk on transient errors and drops it on permanent
+// ones.
+func flushCode(err error) int {
+	switch {
+	case err == nil:
+		return output.FLB_OK
+	case isPermanent(err):
+		return output.FLB_ERROR
+	default:
+		return output.FLB_RETRY
+	}
+}
+
 //export FLBPluginExit
 func FLBPluginExit() int {
+	// The operators share the grace period of fluent-bit, so they're stopped
+	// at the same time.
+	var wg sync.WaitGroup
 	for _, o := range operators {
 		if o.uploader != nil {
-			o.uploader.Stop()
+			wg.Add(1)
+			go func(u *AzblobUploader) {
+				defer wg.Done()
+				u.Stop()
+			}(o.uploader)
 		}
 	}
+	wg.Wait()
+
 	return output.FLB_OK
 }
 
+// resolveHostname returns the value used for %{hostname} and the source it
+// was read from. AZBLOB_HOSTNAME takes precedence, then NODE_NAME (commonly
+// injected through the downward API), then os.Hostname().
+func resolveHostname() (string, string) {
+	for _, env := range []string{"AZBLOB_HOSTNAME", "NODE_NAME"} {
+		if h := strings.TrimSpace(os.Getenv(env)); h != "" {
+			return h, env
+		}
+	}
+
+	h, err := os.Hostname()
+	if err != nil {
+		return "", "os.Hostname"
+	}
+
+	return h, "os.Hostname"
+}
+
+// resolveInstanceID returns the value used for %{instance_id}, which tells
+// the replicas writing to the same storage apart, and the source it was read
+// from. AZBLOB_INSTANCE_ID takes precedence, then POD_NAME (injected through
+// the downward API), which stays the same over restarts of the container.
+// Otherwise it's a UUID of the process.
+func resolveInstanceID() (string, string) {
+	for _, env := range []string{"AZBLOB_INSTANCE_ID", "POD_NAME"} {
+		if id := strings.TrimSpace(os.Getenv(env)); id != "" {
+			return id, env
+		}
+	}
+
+	return uuid.NewV4().String(), "uuid"
+}
+
 func init() {
-	Hostname, _ = os.Hostname()
 	logger = NewLogger("flb-go", logrus.InfoLevel)
+
+	var source string
+	Hostname, source = resolveHostname()
+	if Hostname == "" {
+		logger.Warnf("cannot resolve hostname, source=%s", source)
+	} else {
+		logger.Infof("hostname=%s source=%s", Hostname, source)
+	}
+
+	InstanceID, source = resolveInstanceID()
+	logger.Infof("instance_id=%s source=%s", InstanceID, source)
 }
 
 func main() {}
@@ -1,20 +1,36 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/fluent/fluent-bit-go/output"
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,6 +51,12 @@ func (mc mockConfig) Get(key string) string {
 	return os.Getenv(key)
 }
 
+type mapConfig map[string]string
+
+func (mc mapConfig) Get(key string) string {
+	return mc[key]
+}
+
 func TestNewConfig(t *testing.T) {
 	testCfg := &mockConfig{}
 	cfg, err := NewConfig(testCfg)
@@ -50,172 +72,4906 @@ func TestNewConfig(t *testing.T) {
 	assert.Equal(t, cfg.BatchWait, DefaultBatchWait)
 	assert.Equal(t, cfg.BatchLimitSize, uint64(DefaultBatchLimitSize))
 	assert.Equal(t, cfg.Location, time.UTC)
-	assert.False(t, strings.Contains(cfg.ContainerURL.String(), "fluentSAS"))
+	assert.False(t, strings.Contains(cfg.ContainerURLs[0].String(), "fluentSAS"))
 
 	testCfg.useSAS = true
 	cfg, err = NewConfig(testCfg)
 	if err != nil {
 		assert.Fail(t, "NewConfig fails: %v", err)
 	}
-	assert.True(t, strings.Contains(cfg.ContainerURL.String(), "fluentSAS"))
+	assert.True(t, strings.Contains(cfg.ContainerURLs[0].String(), "fluentSAS"))
 }
 
-func TestCreateJSON(t *testing.T) {
-	record := make(map[interface{}]interface{})
-	record["key"] = "value"
-	record["number"] = 8
+func TestNewConfigWithStorageAccounts(t *testing.T) {
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":        "testcontainer",
+		"Azure_Storage_Accounts": "account1, account2",
+		"Azure_Storage_SAS":      "sas1,sas2",
+	})
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Len(t, cfg.ContainerURLs, 2)
+	assert.Equal(t, "account1.blob.core.windows.net", cfg.ContainerURLs[0].URL().Host)
+	assert.Equal(t, "sas2", cfg.ContainerURLs[1].URL().RawQuery)
 
-	jsonBytes, err := createJSON(record)
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":        "testcontainer",
+		"Azure_Storage_Accounts": "account1,account2,account3",
+		"Azure_Storage_SAS":      "sas1,sas2",
+	})
+	assert.Error(t, err)
+
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":        "testcontainer",
+		"Azure_Storage_Account":  "account1",
+		"Azure_Storage_Accounts": "account1,account2",
+		"Azure_Storage_SAS":      "sas",
+	})
+	assert.Error(t, err)
+}
+
+func TestNewConfigWithServiceURL(t *testing.T) {
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":   "testcontainer",
+		"Azure_Service_URL": "https://mystorage.privatelink.blob.core.windows.net/",
+		"Azure_Storage_SAS": "sas",
+	})
 	if err != nil {
-		assert.Fail(t, "CreateJSON fails: %v", err)
+		assert.Fail(t, "NewConfig fails: %v", err)
 	}
-	assert.NotEqual(t, string(jsonBytes), "{}")
+	assert.Equal(t,
+		"https://mystorage.privatelink.blob.core.windows.net/testcontainer?sas",
+		cfg.ContainerURLs[0].String())
 
-	result := make(map[string]interface{})
-	err = json.Unmarshal(jsonBytes, &result)
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "mystorage",
+		"Azure_Service_URL":     "https://mystorage.privatelink.blob.core.windows.net",
+		"Azure_Storage_SAS":     "sas",
+	})
+	assert.Error(t, err)
+
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":   "testcontainer",
+		"Azure_Storage_SAS": "sas",
+	})
+	assert.Error(t, err)
+}
+
+func TestNewConfigWithSecretFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "azblob-sas")
 	if err != nil {
-		assert.Fail(t, "unmarshal of json fails: %v", err)
+		assert.Fail(t, "create secret file fails: %v", err)
 	}
+	defer os.Remove(f.Name())
+	f.WriteString("sasfromfile\n")
+	f.Close()
 
-	assert.Equal(t, result["key"], "value")
-	assert.Equal(t, result["number"], float64(8))
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":        "testcontainer",
+		"Azure_Storage_Account":  "testaccount",
+		"Azure_Storage_SAS_File": f.Name(),
+	})
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, "sasfromfile", cfg.ContainerURLs[0].URL().RawQuery)
+
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":        "testcontainer",
+		"Azure_Storage_Account":  "testaccount",
+		"Azure_Storage_SAS":      "sas",
+		"Azure_Storage_SAS_File": f.Name(),
+	})
+	assert.Error(t, err)
+
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":               "testcontainer",
+		"Azure_Storage_Account":         "testaccount",
+		"Azure_Storage_Access_Key_File": f.Name() + ".missing",
+	})
+	assert.Error(t, err)
 }
 
-// ref: https://gist.github.com/ChristopherThorpe/fd3720efe2ba83c929bf4105719ee967
-// NestedMapLookup
-// m:  a map from strings to other maps or values, of arbitrary depth
-// ks: successive keys to reach an internal or leaf node (variadic)
-// If an internal node is reached, will return the internal map
-//
-// Returns: (Exactly one of these will be nil)
-// rval: the target node (if found)
-// err:  an error created by fmt.Errorf
-//
-func NestedMapLookup(m map[string]interface{}, ks ...string) (rval interface{}, err error) {
-	var ok bool
+func TestSanitizeContainerName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"logs":                          "logs",
+		"$root":                         "$root",
+		"Prod_Cluster":                  "prod-cluster",
+		"_eu--west__1_":                 "eu-west-1",
+		"my.cluster name":               "my-cluster-name",
+		strings.Repeat("a_", 40):        strings.Repeat("a-", 31) + "a",
+		"k8s" + strings.Repeat("x", 70): "k8s" + strings.Repeat("x", 60),
+	} {
+		sanitized, err := sanitizeContainerName(name)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, expected, sanitized, name)
+		}
+	}
 
-	if len(ks) == 0 { // degenerate input
-		return nil, fmt.Errorf("NestedMapLookup needs at least one key")
+	for _, name := range []string{"a_", "__", "$"} {
+		_, err := sanitizeContainerName(name)
+		assert.Error(t, err, name)
 	}
-	if rval, ok = m[ks[0]]; !ok {
-		return nil, fmt.Errorf("key not found; remaining keys: %v", ks)
-	} else if len(ks) == 1 { // we've reached the final key
-		return rval, nil
-	} else if m, ok = rval.(map[string]interface{}); !ok {
-		return nil, fmt.Errorf("malformed structure at %#v", rval)
-	} else { // 1+ more keys
-		return NestedMapLookup(m, ks[1:]...)
+
+	conf := mapConfig{
+		"Azure_Container":       "Prod_Cluster",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Dead_Letter_Prefix":    "failed/",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
 	}
+	assert.Equal(t, "prod-cluster", cfg.Container)
+	assert.Equal(t, "Prod_Cluster", cfg.ContainerRenamedFrom)
+	assert.Equal(t, "/prod-cluster", cfg.ContainerURLs[0].URL().Path)
+	assert.Equal(t, "prod-cluster", cfg.DeadLetterContainer)
+
+	conf["Container_Name_Policy"] = "strict"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Azure_Container: Prod_Cluster is not a valid container name")
+
+	conf["Container_Name_Policy"] = "lenient"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Container_Name_Policy: lenient")
 }
 
-func TestCreateJSONWithNestedKey(t *testing.T) {
-	record := make(map[interface{}]interface{})
-	record["key"] = "value"
-	record["number"] = 8
-	record["nested"] = map[interface{}]interface{}{
-		"key": map[interface{}]interface{}{
-			"key2": "not base64 encoded",
-		},
+func TestNewConfigWithMaxIdleConns(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":         "testcontainer",
+		"Azure_Storage_Account":   "testaccount",
+		"Azure_Storage_SAS":       "sas",
+		"Max_Idle_Conns_Per_Host": "8",
 	}
-
-	jsonBytes, err := createJSON(record)
+	cfg, err := NewConfig(conf)
 	if err != nil {
-		assert.Fail(t, "CreateJSON fails: %v", err)
+		assert.Fail(t, "NewConfig fails: %v", err)
 	}
-	assert.NotEqual(t, string(jsonBytes), "{}")
+	assert.Equal(t, 8, cfg.MaxIdleConnsPerHost)
+	client := newHTTPClient(cfg)
+	assert.Equal(t, 8, client.Transport.(*http.Transport).MaxIdleConnsPerHost)
 
-	result := make(map[string]interface{})
-	err = json.Unmarshal(jsonBytes, &result)
+	delete(conf, "Max_Idle_Conns_Per_Host")
+	cfg, _ = NewConfig(conf)
+	assert.Equal(t, DefaultMaxIdleConns, cfg.MaxIdleConnsPerHost)
+
+	conf["Max_Idle_Conns_Per_Host"] = "0"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Max_Idle_Conns_Per_Host: 0")
+
+	// the blob clients send their requests with the shared client
+	fs := newFakeStorage()
+	defer fs.Close()
+	containerURL, _ := fs.ContainerURL()
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(),
+		azblob.PipelineOptions{HTTPSender: newHTTPSender(client)})
+	blobURL := containerURL.WithPipeline(p).NewAppendBlobURL("shared.log")
+	_, err = blobURL.Create(context.Background(), azblob.BlobHTTPHeaders{},
+		azblob.Metadata{}, azblob.BlobAccessConditions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "AppendBlob", fs.Blob("shared.log").blobType)
+}
+
+func TestNewConfigWithIdleConnTimeout(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+	}
+	cfg, err := NewConfig(conf)
 	if err != nil {
-		assert.Fail(t, "unmarshal of json fails: %v", err)
+		assert.Fail(t, "NewConfig fails: %v", err)
 	}
+	assert.Equal(t, DefaultIdleConnTimeout, cfg.IdleConnTimeout)
+	assert.Equal(t, DefaultKeepAlive, cfg.KeepAlive)
 
-	assert.Equal(t, result["key"], "value")
-	assert.Equal(t, result["number"], float64(8))
+	conf["Idle_Conn_Timeout"] = "4m"
+	conf["Keep_Alive"] = "15"
+	cfg, _ = NewConfig(conf)
+	assert.Equal(t, 4*time.Minute, cfg.IdleConnTimeout)
+	assert.Equal(t, 15*time.Second, cfg.KeepAlive)
+	assert.Equal(t, 4*time.Minute, newHTTPClient(cfg).Transport.(*http.Transport).IdleConnTimeout)
 
-	val, err := NestedMapLookup(result, "nested", "key", "key2")
-	assert.Equal(t, val, "not base64 encoded")
+	conf["Keep_Alive"] = "-5"
+	_, err = NewConfig(conf)
+	assert.Error(t, err)
 }
 
-// based on https://text.baldanders.info/golang/gzip-operation/
-func readGzip(dst io.Writer, src io.Reader) error {
-	zr, err := gzip.NewReader(src)
+func TestNewConfigWithRetryOptions(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Retry_Max_Tries":       "2",
+		"Retry_Try_Timeout":     "10",
+		"Retry_Delay":           "1",
+		"Retry_Max_Delay":       "5",
+	}
+	cfg, err := NewConfig(conf)
 	if err != nil {
-		return err
+		assert.Fail(t, "NewConfig fails: %v", err)
 	}
-	defer zr.Close()
+	assert.Equal(t, azblob.RetryOptions{
+		Policy:        azblob.RetryPolicyExponential,
+		MaxTries:      2,
+		TryTimeout:    10 * time.Second,
+		RetryDelay:    time.Second,
+		MaxRetryDelay: 5 * time.Second,
+	}, cfg.Retry)
 
-	io.Copy(dst, zr)
+	conf["Retry_Delay"] = "10"
+	_, err = NewConfig(conf)
+	assert.Error(t, err)
 
-	return nil
+	conf["Retry_Max_Tries"] = "-1"
+	_, err = NewConfig(conf)
+	assert.Error(t, err)
 }
 
-func TestMakeGzip(t *testing.T) {
-	var line = "a gzipped string line which is compressed by compress/gzip library written in Go."
+func TestUserAgent(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
 
-	compressed, err := makeGzip([]byte(line))
+	var ua string
+	fs.fail = func(r *http.Request) (int, string) {
+		ua = r.UserAgent()
+		return 0, ""
+	}
+
+	version := Version
+	defer func() { Version = version }()
+	Version = "1.2.3"
+
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":   "container",
+		"Azure_Service_URL": fs.srv.URL + "/account",
+		"Azure_Storage_SAS": "sv=2019-02-02",
+		"User_Agent_Suffix": "cluster=prod",
+	})
 	if err != nil {
-		assert.Fail(t, "compress string with gzip fails: %v", err)
+		assert.Fail(t, "NewConfig fails: %v", err)
 	}
+	assert.Equal(t, "fluent-bit-go-azblob/1.2.3 cluster=prod", cfg.UserAgent)
 
-	var b bytes.Buffer
-	err = readGzip(&b, bytes.NewReader(compressed))
+	_, err = cfg.ContainerURLs[0].NewBlockBlobURL("ua.log").Upload(context.Background(),
+		bytes.NewReader([]byte("a\n")), azblob.BlobHTTPHeaders{}, azblob.Metadata{},
+		azblob.BlobAccessConditions{})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(ua, "fluent-bit-go-azblob/1.2.3 cluster=prod "), ua)
+
+	Version = ""
+	assert.Equal(t, "fluent-bit-go-azblob/dev", userAgent(""))
+}
+
+func TestParseSecondsAndSize(t *testing.T) {
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Batch_Wait":            "1m30s",
+		"Batch_Max_Age":         "120",
+		"Batch_Limit_Size":      "10MB",
+	})
 	if err != nil {
-		assert.Fail(t, "decompress from gzippped string fails: %v", err)
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, 90*time.Second, cfg.BatchWait)
+	assert.Equal(t, 2*time.Minute, cfg.BatchMaxAge)
+	assert.Equal(t, uint64(10*1024*1024), cfg.BatchLimitSize)
+
+	for v, d := range map[string]time.Duration{
+		"5":     5 * time.Second,
+		"500ms": 500 * time.Millisecond,
+		" 2h ":  2 * time.Hour,
+	} {
+		got, err := parseSeconds("Batch_Wait", v)
+		assert.Nil(t, err, v)
+		assert.Equal(t, d, got, v)
+	}
+	for _, v := range []string{"-1", "5 minutes", "-1s", "1.5"} {
+		_, err := parseSeconds("Batch_Wait", v)
+		assert.Error(t, err, v)
+	}
+
+	for v, size := range map[string]uint64{
+		"32768": 32768,
+		"256KB": 256 * 1024,
+		"256k":  256 * 1024,
+		"1.5M":  1536 * 1024,
+	} {
+		got, err := parseSize("Batch_Limit_Size", v)
+		assert.Nil(t, err, v)
+		assert.Equal(t, size, got, v)
+	}
+	for _, v := range []string{"-1", "10 apples", "MB", ""} {
+		_, err := parseSize("Batch_Limit_Size", v)
+		assert.Error(t, err, v)
 	}
-	assert.Equal(t, line, b.String())
 }
 
-func TestFLBPluginExit(t *testing.T) {
-	c, _ := NewConfig(&mockConfig{})
-	o, _ := NewOperator(0, c)
-	operators = append(operators, o)
+func TestAccountIndex(t *testing.T) {
+	assert.Equal(t, 0, accountIndex("any", 1))
+	for _, key := range []string{"a", "b", "c/d.gz"} {
+		i := accountIndex(key, 3)
+		assert.True(t, i >= 0 && i < 3)
+		assert.Equal(t, i, accountIndex(key, 3))
+	}
+}
 
-	ret := FLBPluginExit()
-	assert.Equal(t, 1, ret)
+func TestAccountFailover(t *testing.T) {
+	degraded, healthy := newFakeStorage(), newFakeStorage()
+	defer degraded.Close()
+	defer healthy.Close()
+
+	tries := 0
+	degraded.fail = func(r *http.Request) (int, string) {
+		tries++
+		return http.StatusServiceUnavailable, "ServerBusy"
+	}
+
+	// The account of the blob always fails. Without a retry limit, the batch
+	// is still written to the other one.
+	objectKey := "logs/app.log"
+	storages := []*fakeStorage{healthy, healthy}
+	storages[accountIndex(objectKey, 2)] = degraded
+	cfg := &AzblobConfig{
+		BlobType:       BlockBlob,
+		StoreAs:        PlainTextFormat,
+		BatchLimitSize: DefaultBatchLimitSize,
+	}
+	for _, fs := range storages {
+		containerURL, _ := url.Parse(fs.srv.URL + "/account/container")
+		p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+			Retry: azblob.RetryOptions{MaxTries: 1},
+		})
+		cfg.ContainerURLs = append(cfg.ContainerURLs, azblob.NewContainerURL(*containerURL, p))
+		cfg.Pipelines = append(cfg.Pipelines, p)
+	}
+	u := newUploader(cfg, NewLogger("testing", logrus.TraceLevel))
+	u.clock = newFakeClock()
+
+	u.sendBatch(BatchKey{ObjectKeyFormat: objectKey}, []byte("a\n"), Source{})
+	assert.NoError(t, u.Err())
+	if assert.NotNil(t, healthy.Blob(objectKey)) {
+		assert.Equal(t, "a\n", string(healthy.Blob(objectKey).data))
+	}
+	degraded.mu.Lock()
+	assert.Equal(t, AccountRetries+1, tries)
+	degraded.mu.Unlock()
 }
 
-func TestRetry(t *testing.T) {
-	attempts := uint64(3)
-	count := uint64(0)
+func TestFallbackObjectKeyFormat(t *testing.T) {
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":                  "testcontainer",
+		"Azure_Storage_Account":            "testaccount",
+		"Azure_Storage_SAS":                "sas",
+		"Path":                             "logs/",
+		"Azure_Object_Key_Format":          "%{path}pods/%{time_slice}.%{file_extension}",
+		"Azure_Fallback_Object_Key_Format": "%{path}host/%{hostname}/%{time_slice}.%{file_extension}",
+	})
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	o := &AzblobOperator{config: cfg}
 
-	err := retry(&attempts, func() error {
-		count = count + 1
-		return errors.New("test")
+	pod := map[interface{}]interface{}{
+		"log":        "line",
+		"kubernetes": map[interface{}]interface{}{"pod_name": "pod"},
+	}
+	host := map[interface{}]interface{}{"log": "line"}
+
+	assert.Equal(t, "logs/pods/%{time_slice}.gz", o.objectKeyFormat(pod))
+	assert.Equal(t, "logs/host/%{hostname}/%{time_slice}.gz", o.objectKeyFormat(host))
+
+	cfg.FallbackObjectKeyFormat = ""
+	assert.Equal(t, cfg.ObjectKeyFormat, o.objectKeyFormat(host))
+}
+
+func TestRoute(t *testing.T) {
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":         "testcontainer",
+		"Azure_Storage_Account":   "testaccount",
+		"Azure_Storage_SAS":       "sas",
+		"Azure_Object_Key_Format": "%{route}/%{time_slice}.log",
+		"Route_Key":               "tenant",
+		"Route_Default":           "shared",
 	})
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	o := &AzblobOperator{config: cfg}
+
+	assert.Equal(t, "acme", o.route(map[interface{}]interface{}{"tenant": []byte("acme")}))
+	assert.Equal(t, "42", o.route(map[interface{}]interface{}{"tenant": 42}))
+	assert.Equal(t, "shared", o.route(map[interface{}]interface{}{"tenant": ""}))
+	assert.Equal(t, "shared", o.route(map[interface{}]interface{}{"log": "line"}))
+
+	u := &AzblobUploader{config: cfg, clock: newFakeClock()}
+	k := BatchKey{
+		TimeSlice:       "2020010203-04",
+		ObjectKeyFormat: cfg.ObjectKeyFormat,
+		Route:           "acme",
+	}
+	assert.Equal(t, "acme/2020010203-04.log", u.objectKey(k))
+}
+
+func TestBatchKeyFields(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":         "testcontainer",
+		"Azure_Storage_Account":   "testaccount",
+		"Azure_Storage_SAS":       "sas",
+		"Azure_Object_Key_Format": "%{tag}/%{time_slice}.log",
+	}
+	_, err := NewConfig(conf)
+	assert.Error(t, err)
 
+	conf["Batch_Key_Fields"] = "time_slice, stream"
+	_, err = NewConfig(conf)
 	assert.Error(t, err)
-	assert.Equal(t, attempts+1, count)
 
+	conf["Batch_Key_Fields"] = "time_slice,tag"
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	cfg.RouteKey = "tenant"
+	o := &AzblobOperator{config: cfg}
+
+	r := map[interface{}]interface{}{"tenant": "acme"}
+	assert.Equal(t, BatchKey{
+		TimeSlice:       "2020010203-04",
+		ObjectKeyFormat: "%{tag}/%{time_slice}.log",
+		Tag:             "kube.app",
+	}, o.batchKey(r, "2020010203-04", "kube.app"))
+
+	u := &AzblobUploader{config: cfg, clock: newFakeClock()}
+	assert.Equal(t, "kube.app/2020010203-04.log",
+		u.objectKey(o.batchKey(r, "2020010203-04", "kube.app")))
 }
 
-func TestSendRecord(t *testing.T) {
-	c, _ := NewConfig(&mockConfig{})
-	o, _ := NewOperator(0, c)
+func TestLevel(t *testing.T) {
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":         "testcontainer",
+		"Azure_Storage_Account":   "testaccount",
+		"Azure_Storage_SAS":       "sas",
+		"Azure_Object_Key_Format": "%{level}/%{time_slice}.log",
+		"Batch_Key_Fields":        "time_slice,level",
+		"Level_Key":               "severity",
+	})
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	o := &AzblobOperator{config: cfg}
 
-	record := make(map[interface{}]interface{})
-	record["key"] = "value"
-	err := o.SendRecord(record, time.Now())
-	assert.Nil(t, err)
+	for _, c := range []struct {
+		value interface{}
+		level string
+	}{
+		{"ERROR", "error"},
+		{[]byte(" warning"), "warn"},
+		{"crit", "fatal"},
+		{int64(3), "error"},
+		{uint64(7), "debug"},
+		{"6", "info"},
+		{"verbose", "unknown"},
+		{int64(42), "unknown"},
+	} {
+		assert.Equal(t, c.level, o.level(map[interface{}]interface{}{"severity": c.value}), c.value)
+	}
+	assert.Equal(t, "unknown", o.level(map[interface{}]interface{}{"log": "line"}))
 
-	o = nil
+	r := map[interface{}]interface{}{"severity": "Error"}
+	k := o.batchKey(r, "2020010203-04", "kube.app")
+	assert.Equal(t, BatchKey{
+		TimeSlice:       "2020010203-04",
+		ObjectKeyFormat: "%{level}/%{time_slice}.log",
+		Level:           "error",
+	}, k)
+
+	u := &AzblobUploader{config: cfg, clock: newFakeClock()}
+	assert.Equal(t, "error/2020010203-04.log", u.objectKey(k))
 }
 
-func TestEnsureContainer(t *testing.T) {
-	l := NewLogger("testing", logrus.TraceLevel)
-	c, _ := NewConfig(&mockConfig{})
-	u, _ := NewUploader(c, l)
-	err := u.ensureContainer(context.Background())
-	assert.Nil(t, err)
+func TestRecordTime(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Time_Key":              "timestamp",
+		"Time_Format":           "2006-01-02 15:04:05",
+		"TimeZone":              "Asia/Taipei",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	o := &AzblobOperator{config: cfg}
+	ingest := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, c := range []struct {
+		value interface{}
+		time  time.Time
+	}{
+		{[]byte("2020-01-01 08:00:00"), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"2020-01-01 08:00:00", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{int64(1577836800), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{uint64(1577836800), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{1577836800.5, time.Date(2020, 1, 1, 0, 0, 0, 5e8, time.UTC)},
+		{"yesterday", ingest},
+		{nil, ingest},
+	} {
+		r := map[interface{}]interface{}{"timestamp": c.value}
+		assert.True(t, c.time.Equal(o.recordTime(r, ingest)), "%v", c.value)
+	}
+
+	// the default format is RFC 3339
+	delete(conf, "Time_Format")
+	cfg, _ = NewConfig(conf)
+	o = &AzblobOperator{config: cfg}
+	r := map[interface{}]interface{}{"timestamp": "2020-01-01T00:00:00.123Z"}
+	assert.True(t, time.Date(2020, 1, 1, 0, 0, 0, 123e6, time.UTC).Equal(o.recordTime(r, ingest)))
+
+	conf["Mode"] = "flat"
+	conf["StoreAs"] = "text"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "cannot specify Time_Key with Mode flat")
 }
 
-func TestUpload(t *testing.T) {
-	l := NewLogger("testing", logrus.TraceLevel)
-	c, _ := NewConfig(&mockConfig{})
-	u, _ := NewUploader(c, l)
+func TestFlatMode(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Mode":                  "flat",
+		"StoreAs":               "text",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, FlatMode, cfg.Mode)
+	o := &AzblobOperator{config: cfg}
 
-	err := u.upload("testing", []byte(`{"key":"value"}`))
-	assert.Nil(t, err)
+	r := map[interface{}]interface{}{
+		"log":        "line",
+		"kubernetes": map[interface{}]interface{}{"pod_name": "pod"},
+	}
+	k := o.batchKey(r, "2020010203-04", "syslog")
+	assert.Equal(t, BatchKey{
+		TimeSlice:       "2020010203-04",
+		ObjectKeyFormat: "%{tag}/%{hostname}/%{time_slice}_%{uuid}.txt",
+		Tag:             "syslog",
+	}, k)
+
+	u := &AzblobUploader{config: cfg, clock: newFakeClock()}
+	assert.Regexp(t, "^syslog/"+regexp.QuoteMeta(Hostname)+"/2020010203-04_[0-9a-f-]{36}\\.txt$",
+		u.objectKey(k))
+
+	for key, value := range map[string]string{
+		"Azure_Fallback_Object_Key_Format": "host/%{time_slice}.log",
+		"Route_Key":                        "tenant",
+		"Azure_Object_Key_Format":          "%{record.host}/%{time_slice}.log",
+	} {
+		conf[key] = value
+		_, err = NewConfig(conf)
+		assert.Error(t, err, key)
+		delete(conf, key)
+	}
+
+	conf["Mode"] = "vm"
+	_, err = NewConfig(conf)
+	assert.Error(t, err)
+}
+
+func TestResolveRecordPlaceholders(t *testing.T) {
+	r := map[interface{}]interface{}{
+		"log": "line",
+		"kubernetes": map[interface{}]interface{}{
+			"namespace_name": []byte("prod"),
+			"pod_name":       "api-1",
+			"labels":         map[interface{}]interface{}{"app": "api"},
+		},
+		"shard": 3,
+	}
+
+	assert.Equal(t, "prod/api-1/3/unknown/unknown.log", resolveRecordPlaceholders(
+		"%{record.kubernetes.namespace_name}/%{record.kubernetes.pod_name}/"+
+			"%{record.shard}/%{record.kubernetes.labels}/%{record.log.x}.log", r))
+	assert.Equal(t, "%{time_slice}.log", resolveRecordPlaceholders("%{time_slice}.log", r))
+
+	o := &AzblobOperator{config: &AzblobConfig{
+		ObjectKeyFormat: "%{record.kubernetes.pod_name}/%{time_slice}.log",
+	}}
+	other := map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{"pod_name": "web-1"},
+	}
+	assert.NotEqual(t, o.batchKey(r, "slice", "tag"), o.batchKey(other, "slice", "tag"))
+}
+
+func TestKeyFormat(t *testing.T) {
+	f := newKeyFormat("%{record.ns}/%{record.k.pod}/%{time_slice}.log", "")
+	pod := func(ns, name string) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			"ns": ns,
+			"k":  map[interface{}]interface{}{"pod": []byte(name)},
+		}
+	}
+
+	assert.Equal(t, "a/p1/%{time_slice}.log", f.resolve(pod("a", "p1")))
+	assert.Equal(t, "a/p1/%{time_slice}.log", f.resolve(pod("a", "p1")))
+	assert.Equal(t, "a/p2/%{time_slice}.log", f.resolve(pod("a", "p2")))
+	assert.Equal(t, "b/p2/%{time_slice}.log", f.resolve(pod("b", "p2")))
+	assert.Equal(t, "unknown/unknown/%{time_slice}.log", f.resolve(map[interface{}]interface{}{}))
+	assert.Equal(t, "a/p1/%{time_slice}.log", f.resolve(pod("a", "p1")))
+
+	f = newKeyFormat("%{time_slice}.log", "")
+	assert.Equal(t, "%{time_slice}.log", f.resolve(pod("a", "p1")))
+}
+
+func benchmarkBatchKey(b *testing.B, pods int) {
+	o := &AzblobOperator{config: &AzblobConfig{
+		ObjectKeyFormat: "%{record.kubernetes.namespace_name}/%{record.kubernetes.pod_name}/%{time_slice}.log",
+		BatchKeyFields:  map[string]bool{BatchKeyTimeSlice: true},
+	}}
+
+	records := make([]map[interface{}]interface{}, pods)
+	for i := range records {
+		records[i] = map[interface{}]interface{}{
+			"log": []byte("line"),
+			"kubernetes": map[interface{}]interface{}{
+				"namespace_name": []byte("default"),
+				"pod_name":       []byte(fmt.Sprintf("app-%d", i)),
+			},
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		o.batchKey(records[i%pods], "2020010203-04", "kube.app")
+	}
+}
+
+// BenchmarkBatchKeyHomogeneous is the common case of a flush of one pod,
+// whose records reuse the key of the record before.
+func BenchmarkBatchKeyHomogeneous(b *testing.B) {
+	benchmarkBatchKey(b, 1)
+}
+
+func BenchmarkBatchKeyHeterogeneous(b *testing.B) {
+	benchmarkBatchKey(b, 16)
+}
+
+func TestCreateJSON(t *testing.T) {
+	record := make(map[interface{}]interface{})
+	record["key"] = "value"
+	record["number"] = 8
+
+	jsonBytes, err := createJSON(record)
+	if err != nil {
+		assert.Fail(t, "CreateJSON fails: %v", err)
+	}
+	assert.NotEqual(t, string(jsonBytes), "{}")
+
+	result := make(map[string]interface{})
+	err = json.Unmarshal(jsonBytes, &result)
+	if err != nil {
+		assert.Fail(t, "unmarshal of json fails: %v", err)
+	}
+
+	assert.Equal(t, result["key"], "value")
+	assert.Equal(t, result["number"], float64(8))
+}
+
+func TestEncodeRecordWithPreserveRaw(t *testing.T) {
+	o := &AzblobOperator{config: &AzblobConfig{PreserveRaw: true, RawKey: "_raw"}}
+
+	record := make(map[interface{}]interface{})
+	record["key"] = "value"
+	record["nested"] = map[interface{}]interface{}{"key2": []byte("value2")}
+
+	jsonBytes, err := o.encodeRecord(record, time.Time{})
+	if err != nil {
+		assert.Fail(t, "encodeRecord fails: %v", err)
+	}
+
+	result := make(map[string]interface{})
+	err = json.Unmarshal(jsonBytes, &result)
+	if err != nil {
+		assert.Fail(t, "unmarshal of json fails: %v", err)
+	}
+
+	assert.Equal(t, "value", result["key"])
+	val, err := NestedMapLookup(result, "_raw", "nested", "key2")
+	assert.Nil(t, err)
+	assert.Equal(t, "value2", val)
+}
+
+func TestEncodeRecordWithOrigin(t *testing.T) {
+	o := &AzblobOperator{config: &AzblobConfig{
+		ClusterName: "prod-westeu",
+		ClusterKey:  "cluster",
+		Region:      "westeurope",
+		RegionKey:   "region",
+	}}
+
+	record := make(map[interface{}]interface{})
+	record["key"] = "value"
+	record["region"] = "kept"
+
+	jsonBytes, err := o.encodeRecord(record, time.Time{})
+	if err != nil {
+		assert.Fail(t, "encodeRecord fails: %v", err)
+	}
+
+	result := make(map[string]interface{})
+	err = json.Unmarshal(jsonBytes, &result)
+	if err != nil {
+		assert.Fail(t, "unmarshal of json fails: %v", err)
+	}
+
+	assert.Equal(t, "prod-westeu", result["cluster"])
+	assert.Equal(t, "kept", result["region"])
+}
+
+func TestEncodeRecordForLogAnalytics(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Format":                "loganalytics",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, LogAnalyticsFormat, cfg.Format)
+	o := &AzblobOperator{config: cfg}
+
+	decode := func(r map[interface{}]interface{}) map[string]interface{} {
+		ts := time.Date(2020, 1, 2, 3, 4, 5, 6e8, time.UTC)
+		jsonBytes, err := o.encodeRecord(r, ts)
+		if err != nil {
+			assert.Fail(t, "encodeRecord fails: %v", err)
+		}
+		result := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(jsonBytes, &result))
+		return result
+	}
+
+	result := decode(map[interface{}]interface{}{
+		"log":    []byte("hello"),
+		"stream": []byte("stderr"),
+		"user":   []byte("alice"),
+		"kubernetes": map[interface{}]interface{}{
+			"namespace_name": []byte("shop"),
+			"pod_name":       []byte("web-5d9c8b7f94-x2lpq"),
+			"container_name": []byte("nginx"),
+			"container_id":   []byte("containerd://abc"),
+			"host":           []byte("node-1"),
+		},
+	})
+	assert.Equal(t, map[string]interface{}{
+		"TimeGenerated": "2020-01-02T03:04:05.6Z",
+		"Computer":      "node-1",
+		"LogMessage":    "hello",
+		"LogSource":     "stderr",
+		"PodNamespace":  "shop",
+		"PodName":       "web-5d9c8b7f94-x2lpq",
+		"ContainerName": "nginx",
+		"ContainerId":   "containerd://abc",
+		"KubernetesMetadata": map[string]interface{}{
+			"namespace_name": "shop",
+			"pod_name":       "web-5d9c8b7f94-x2lpq",
+			"container_name": "nginx",
+			"container_id":   "containerd://abc",
+			"host":           "node-1",
+		},
+		"user": "alice",
+	}, result)
+
+	// records without Kubernetes metadata come from the host itself
+	result = decode(map[interface{}]interface{}{"log": []byte("boot")})
+	assert.Equal(t, map[string]interface{}{
+		"TimeGenerated": "2020-01-02T03:04:05.6Z",
+		"Computer":      Hostname,
+		"LogMessage":    "boot",
+	}, result)
+
+	conf["Format"] = "csv"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Format: csv")
+}
+
+func TestEncodeRecordWithStripANSI(t *testing.T) {
+	o := &AzblobOperator{config: &AzblobConfig{
+		StripANSI:  true,
+		MessageKey: DefaultMessageKey,
+	}}
+
+	for in, out := range map[string]string{
+		"\x1b[32mINFO\x1b[0m server started":                   "INFO server started",
+		"\x1b[1;31mERROR\x1b[m failed":                         "ERROR failed",
+		"\x1b[38;5;208mwarn\x1b[39m":                           "warn",
+		"\x1b[38;2;255;0;0mred\x1b[0m":                         "red",
+		"\x1b[2K\x1b[1Gprogress 50%":                           "progress 50%",
+		"\x1b]8;;https://example.com\x07link\x1b]8;;\x07":      "link",
+		"\x1b]0;title\x1b\\prompt":                             "prompt",
+		"\x1b(Bplain":                                          "plain",
+		"no colors [32m here":                                  "no colors [32m here",
+		"npm \x1b[37;40mWARN\x1b[0m \x1b[35mdeprecated\x1b[0m": "npm WARN deprecated",
+	} {
+		jsonBytes, err := o.encodeRecord(map[interface{}]interface{}{"log": []byte(in)}, time.Time{})
+		if err != nil {
+			assert.Fail(t, "encodeRecord fails: %v", err)
+		}
+		result := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(jsonBytes, &result))
+		assert.Equal(t, out, result["log"], "%q", in)
+	}
+
+	// only the message is stripped
+	jsonBytes, _ := o.encodeRecord(map[interface{}]interface{}{
+		"log":   []byte("\x1b[32mok\x1b[0m"),
+		"other": []byte("\x1b[32mok\x1b[0m"),
+	}, time.Time{})
+	assert.Equal(t, `{"log":"ok","other":"\u001b[32mok\u001b[0m"}`, string(jsonBytes))
+}
+
+func TestEncodeRecordWithFieldRename(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Field_Rename":          "pod_name:podName, namespace_name:namespace,log:message,message:text",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	o := &AzblobOperator{config: cfg}
+
+	jsonBytes, err := o.encodeRecord(map[interface{}]interface{}{
+		"log":     []byte("hello"),
+		"message": []byte("parsed"),
+		"stream":  []byte("stdout"),
+		"kubernetes": map[interface{}]interface{}{
+			"pod_name":       []byte("web-1"),
+			"namespace_name": []byte("shop"),
+		},
+	}, time.Time{})
+	if err != nil {
+		assert.Fail(t, "encodeRecord fails: %v", err)
+	}
+	assert.JSONEq(t, `{
+		"message": "hello",
+		"text": "parsed",
+		"stream": "stdout",
+		"kubernetes": {"podName": "web-1", "namespace": "shop"}
+	}`, string(jsonBytes))
+
+	for _, v := range []string{"pod_name", "pod_name:", ":podName", "a:b,a:c"} {
+		conf["Field_Rename"] = v
+		_, err = NewConfig(conf)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestEncodeRecordWithInvalidUTF8(t *testing.T) {
+	o := &AzblobOperator{config: &AzblobConfig{
+		EncodeInvalidUTF8: true,
+		MessageKey:        DefaultMessageKey,
+	}}
+
+	decode := func(r map[interface{}]interface{}) map[string]interface{} {
+		jsonBytes, err := o.encodeRecord(r, time.Time{})
+		if err != nil {
+			assert.Fail(t, "encodeRecord fails: %v", err)
+		}
+		result := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(jsonBytes, &result))
+		return result
+	}
+
+	binary := []byte{'a', 0xff, 0xfe, 'b'}
+	result := decode(map[interface{}]interface{}{"log": binary})
+	assert.Equal(t, base64.StdEncoding.EncodeToString(binary), result["log"])
+	assert.Equal(t, "base64", result["encoding"])
+
+	result = decode(map[interface{}]interface{}{"log": []byte("plain ü")})
+	assert.Equal(t, "plain ü", result["log"])
+	assert.Nil(t, result["encoding"])
+}
+
+// ref: https://gist.github.com/ChristopherThorpe/fd3720efe2ba83c929bf4105719ee967
+// NestedMapLookup
+// m:  a map from strings to other maps or values, of arbitrary depth
+// ks: successive keys to reach an internal or leaf node (variadic)
+// If an internal node is reached, will return the internal map
+//
+// Returns: (Exactly one of these will be nil)
+// rval: the target node (if found)
+// err:  an error created by fmt.Errorf
+//
+func NestedMapLookup(m map[string]interface{}, ks ...string) (rval interface{}, err error) {
+	var ok bool
+
+	if len(ks) == 0 { // degenerate input
+		return nil, fmt.Errorf("NestedMapLookup needs at least one key")
+	}
+	if rval, ok = m[ks[0]]; !ok {
+		return nil, fmt.Errorf("key not found; remaining keys: %v", ks)
+	} else if len(ks) == 1 { // we've reached the final key
+		return rval, nil
+	} else if m, ok = rval.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("malformed structure at %#v", rval)
+	} else { // 1+ more keys
+		return NestedMapLookup(m, ks[1:]...)
+	}
+}
+
+func TestMissingMessage(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, "log", cfg.MessageKey)
+	assert.False(t, cfg.SkipMissingMessage)
+
+	conf["Missing_Message"] = "drop"
+	_, err = NewConfig(conf)
+	assert.Error(t, err)
+
+	conf["Message_Key"] = "message"
+	conf["Missing_Message"] = "skip"
+	cfg, err = NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, "message", cfg.MessageKey)
+	assert.True(t, cfg.SkipMissingMessage)
+
+	u := newUploader(cfg, NewLogger("testing", logrus.TraceLevel))
+	u.Entries = make(chan Entry, 3)
+	o := &AzblobOperator{config: cfg, logger: u.logger, uploader: u}
+
+	now := time.Now()
+	assert.Nil(t, o.SendRecord(map[interface{}]interface{}{"message": []byte("a")}, now, "app"))
+	assert.Nil(t, o.SendRecord(map[interface{}]interface{}{"message": []byte("")}, now, "app"))
+	assert.Nil(t, o.SendRecord(map[interface{}]interface{}{"cpu": 0.5}, now, "app"))
+	assert.Nil(t, o.SendRecord(map[interface{}]interface{}{"message": 42}, now, "app"))
+	assert.Len(t, u.Entries, 2)
+}
+
+func TestCreateJSONWithNestedKey(t *testing.T) {
+	record := make(map[interface{}]interface{})
+	record["key"] = "value"
+	record["number"] = 8
+	record["nested"] = map[interface{}]interface{}{
+		"key": map[interface{}]interface{}{
+			"key2": "not base64 encoded",
+		},
+	}
+
+	jsonBytes, err := createJSON(record)
+	if err != nil {
+		assert.Fail(t, "CreateJSON fails: %v", err)
+	}
+	assert.NotEqual(t, string(jsonBytes), "{}")
+
+	result := make(map[string]interface{})
+	err = json.Unmarshal(jsonBytes, &result)
+	if err != nil {
+		assert.Fail(t, "unmarshal of json fails: %v", err)
+	}
+
+	assert.Equal(t, result["key"], "value")
+	assert.Equal(t, result["number"], float64(8))
+
+	val, err := NestedMapLookup(result, "nested", "key", "key2")
+	assert.Equal(t, val, "not base64 encoded")
+}
+
+// based on https://text.baldanders.info/golang/gzip-operation/
+func readGzip(dst io.Writer, src io.Reader) error {
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	io.Copy(dst, zr)
+
+	return nil
+}
+
+func TestMakeGzip(t *testing.T) {
+	var line = "a gzipped string line which is compressed by compress/gzip library written in Go."
+
+	compressed, err := makeGzip([]byte(line))
+	if err != nil {
+		assert.Fail(t, "compress string with gzip fails: %v", err)
+	}
+
+	var b bytes.Buffer
+	err = readGzip(&b, bytes.NewReader(compressed))
+	if err != nil {
+		assert.Fail(t, "decompress from gzippped string fails: %v", err)
+	}
+	assert.Equal(t, line, b.String())
+}
+
+func TestSplitChunks(t *testing.T) {
+	chunks := splitChunks([]byte("aaa\nbb\ncccc\nd\n"), 8)
+	assert.Equal(t, [][]byte{
+		[]byte("aaa\nbb\n"),
+		[]byte("cccc\nd\n"),
+	}, chunks)
+
+	// a single record longer than the limit is split anyway
+	chunks = splitChunks([]byte("aaaaaaaaaa\nb"), 4)
+	assert.Equal(t, [][]byte{
+		[]byte("aaaa"),
+		[]byte("aaaa"),
+		[]byte("aa\nb"),
+	}, chunks)
+
+	assert.Nil(t, splitChunks(nil, 4))
+}
+
+func TestEncodeBatchForAppendBlob(t *testing.T) {
+	u := &AzblobUploader{
+		config: &AzblobConfig{BlobType: AppendBlob, StoreAs: GzipFormat},
+	}
+
+	line := strings.Repeat("x", 1024*1024-1) + "\n"
+	body := []byte(strings.Repeat(line, 9) + "last\n")
+	blocks, err := u.encodeBatch(body, GzipFormat)
+	if err != nil {
+		assert.Fail(t, "encodeBatch fails: %v", err)
+	}
+	assert.Len(t, blocks, 3)
+
+	var b bytes.Buffer
+	for _, block := range blocks {
+		assert.True(t, len(block) <= AppendBlockSize)
+		err = readGzip(&b, bytes.NewReader(block))
+		if err != nil {
+			assert.Fail(t, "decompress block fails: %v", err)
+		}
+	}
+	assert.Equal(t, string(body), b.String())
+}
+
+func TestLogFormatWithFields(t *testing.T) {
+	l := NewLogger("testing", logrus.InfoLevel).WithFields(logrus.Fields{
+		"bytes": 10,
+		"blob":  "https://account.blob.core.windows.net/container/blob",
+	})
+	l.Message = "upload to blob"
+	l.Level = logrus.InfoLevel
+
+	b, err := new(FluentBitLogFormat).Format(l)
+	if err != nil {
+		assert.Fail(t, "Format fails: %v", err)
+	}
+	assert.True(t, strings.HasSuffix(string(b),
+		"[testing] upload to blob blob=https://account.blob.core.windows.net/container/blob bytes=10\n"))
+}
+
+func TestPartKey(t *testing.T) {
+	assert.Equal(t, "logs/app.log.gz", partKey("logs/app.log.gz", 0))
+	assert.Equal(t, "logs/app-2.log.gz", partKey("logs/app.log.gz", 2))
+	assert.Equal(t, "logs/app-1", partKey("logs/app", 1))
+	assert.Equal(t, "logs/app.1.gz", partKey("logs/app.%{part}.gz", 1))
+	assert.Equal(t, "logs/.hidden-1", partKey("logs/.hidden", 1))
+}
+
+type fakeBlob struct {
+	blobType string
+	data     []byte
+	blocks   int
+	metadata map[string]string
+	headers  http.Header
+	// immutableUntil is the retain-until date of the immutability policy,
+	// legalHold whether the blob is under legal hold
+	immutableUntil string
+	legalHold      bool
+	// tags is the body of the last Set Blob Tags request, tagSets their count
+	tags    string
+	tagSets int
+	// lease is the ID of the lease held on the blob, leases their count
+	lease  string
+	leases int
+	// committed are the blocks of a blob written from a block list
+	committed map[string][]byte
+}
+
+// fakeStorage is a minimal in-memory Blob service serving a single
+// container, enough for the requests made by the uploader.
+type fakeStorage struct {
+	mu    sync.Mutex
+	blobs map[string]*fakeBlob
+	// staged are the uncommitted blocks, by blob and block ID
+	staged map[string][]byte
+	// noContainer is set while the container doesn't exist
+	noContainer      bool
+	containerCreates int
+	// fail, when set, may answer a request with an error status and code
+	fail func(r *http.Request) (int, string)
+	srv  *httptest.Server
+}
+
+func newFakeStorage() *fakeStorage {
+	fs := &fakeStorage{blobs: map[string]*fakeBlob{}, staged: map[string][]byte{}}
+	fs.srv = httptest.NewServer(fs)
+
+	return fs
+}
+
+func (fs *fakeStorage) Close() {
+	fs.srv.Close()
+}
+
+func (fs *fakeStorage) ContainerURL() (azblob.ContainerURL, pipeline.Pipeline) {
+	u, _ := url.Parse(fs.srv.URL + "/account/container")
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{})
+
+	return azblob.NewContainerURL(*u, p), p
+}
+
+func (fs *fakeStorage) Blob(name string) *fakeBlob {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.blobs[name]
+}
+
+func (fs *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	name := strings.TrimPrefix(r.URL.Path, "/account/container")
+	name = strings.TrimPrefix(name, "/")
+	comp := r.URL.Query().Get("comp")
+
+	reply := func(status int, code string) {
+		if code != "" {
+			w.Header().Set("x-ms-error-code", code)
+		}
+		w.WriteHeader(status)
+	}
+
+	if fs.fail != nil {
+		if status, code := fs.fail(r); status != 0 {
+			reply(status, code)
+			return
+		}
+	}
+
+	if name == "" {
+		switch {
+		case r.Method == http.MethodPut:
+			fs.containerCreates++
+			if !fs.noContainer {
+				reply(http.StatusConflict, string(azblob.ServiceCodeContainerAlreadyExists))
+				return
+			}
+			fs.noContainer = false
+			reply(http.StatusCreated, "")
+		case fs.noContainer:
+			reply(http.StatusNotFound, string(azblob.ServiceCodeContainerNotFound))
+		default:
+			reply(http.StatusOK, "")
+		}
+		return
+	}
+
+	blob := fs.blobs[name]
+	if blob != nil && blob.lease != "" && comp != "lease" &&
+		r.Method == http.MethodPut && r.Header.Get("x-ms-lease-id") != blob.lease {
+		reply(http.StatusPreconditionFailed, string(azblob.ServiceCodeLeaseIDMissing))
+		return
+	}
+	switch {
+	case r.Method == http.MethodPut && comp == "":
+		if r.Header.Get("If-None-Match") == "*" && blob != nil {
+			reply(http.StatusConflict, string(azblob.ServiceCodeBlobAlreadyExists))
+			return
+		}
+		blob = &fakeBlob{
+			blobType: r.Header.Get("x-ms-blob-type"),
+			metadata: map[string]string{},
+			headers:  r.Header,
+		}
+		if blob.blobType == "BlockBlob" {
+			blob.data = body
+		}
+		for k, v := range r.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+				blob.metadata[strings.ToLower(k[len("x-ms-meta-"):])] = v[0]
+			}
+		}
+		fs.blobs[name] = blob
+		reply(http.StatusCreated, "")
+	case r.Method == http.MethodPut && comp == "block":
+		fs.staged[name+"/"+r.URL.Query().Get("blockid")] = body
+		reply(http.StatusCreated, "")
+	case r.Method == http.MethodPut && comp == "blocklist":
+		var list struct {
+			Latest []string
+		}
+		if err := xml.Unmarshal(body, &list); err != nil {
+			reply(http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		next := &fakeBlob{
+			blobType:  "BlockBlob",
+			metadata:  map[string]string{},
+			headers:   r.Header,
+			committed: map[string][]byte{},
+		}
+		for _, id := range list.Latest {
+			block, ok := fs.staged[name+"/"+id]
+			if !ok && blob != nil {
+				block, ok = blob.committed[id]
+			}
+			if !ok {
+				reply(http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			next.committed[id] = block
+			next.data = append(next.data, block...)
+			next.blocks++
+		}
+		for k, v := range r.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+				next.metadata[strings.ToLower(k[len("x-ms-meta-"):])] = v[0]
+			}
+		}
+		fs.blobs[name] = next
+		reply(http.StatusCreated, "")
+	case r.Method == http.MethodPut && comp == "metadata":
+		if blob == nil {
+			reply(http.StatusNotFound, string(azblob.ServiceCodeBlobNotFound))
+			return
+		}
+		blob.metadata = map[string]string{}
+		for k, v := range r.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+				blob.metadata[strings.ToLower(k[len("x-ms-meta-"):])] = v[0]
+			}
+		}
+		reply(http.StatusOK, "")
+	case r.Method == http.MethodPut && comp == "immutabilityPolicies":
+		if blob == nil {
+			reply(http.StatusNotFound, string(azblob.ServiceCodeBlobNotFound))
+			return
+		}
+		blob.immutableUntil = r.Header.Get("x-ms-immutability-policy-until-date")
+		reply(http.StatusOK, "")
+	case r.Method == http.MethodPut && comp == "legalhold":
+		if blob == nil {
+			reply(http.StatusNotFound, string(azblob.ServiceCodeBlobNotFound))
+			return
+		}
+		blob.legalHold = r.Header.Get("x-ms-legal-hold") == "true"
+		reply(http.StatusOK, "")
+	case r.Method == http.MethodPut && comp == "tags":
+		if blob == nil {
+			reply(http.StatusNotFound, string(azblob.ServiceCodeBlobNotFound))
+			return
+		}
+		blob.tags = string(body)
+		blob.tagSets++
+		reply(http.StatusNoContent, "")
+	case r.Method == http.MethodPut && comp == "lease":
+		if blob == nil {
+			reply(http.StatusNotFound, string(azblob.ServiceCodeBlobNotFound))
+			return
+		}
+		switch r.Header.Get("x-ms-lease-action") {
+		case "acquire":
+			if blob.lease != "" {
+				reply(http.StatusConflict, string(azblob.ServiceCodeLeaseAlreadyPresent))
+				return
+			}
+			blob.leases++
+			blob.lease = fmt.Sprintf("lease-%d", blob.leases)
+			w.Header().Set("x-ms-lease-id", blob.lease)
+			reply(http.StatusCreated, "")
+		case "release":
+			blob.lease = ""
+			reply(http.StatusOK, "")
+		}
+	case r.Method == http.MethodPut && comp == "appendblock":
+		if blob == nil {
+			reply(http.StatusNotFound, string(azblob.ServiceCodeBlobNotFound))
+			return
+		}
+		if blob.blobType != "AppendBlob" {
+			reply(http.StatusConflict, string(azblob.ServiceCodeInvalidBlobType))
+			return
+		}
+		if pos := r.Header.Get("x-ms-blob-condition-appendpos"); pos != "" &&
+			pos != strconv.Itoa(len(blob.data)) {
+			reply(http.StatusPreconditionFailed, string(azblob.ServiceCodeAppendPositionConditionNotMet))
+			return
+		}
+		blob.data = append(blob.data, body...)
+		blob.blocks++
+		reply(http.StatusCreated, "")
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		if blob == nil {
+			reply(http.StatusNotFound, string(azblob.ServiceCodeBlobNotFound))
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob.data)))
+		w.Header().Set("x-ms-blob-type", blob.blobType)
+		w.Header().Set("x-ms-blob-committed-block-count", strconv.Itoa(blob.blocks))
+		for k, v := range blob.metadata {
+			w.Header().Set("x-ms-meta-"+k, v)
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(blob.data)
+		}
+	default:
+		reply(http.StatusBadRequest, "UnsupportedRequest")
+	}
+}
+
+// newFakeUploader returns an uploader writing to the fake storage.
+func newFakeUploader(c *AzblobConfig, fs *fakeStorage) *AzblobUploader {
+	containerURL, p := fs.ContainerURL()
+	c.ContainerURLs = []azblob.ContainerURL{containerURL}
+	c.Pipelines = []pipeline.Pipeline{p}
+	zero := uint64(0)
+	c.BatchRetryLimit = &zero
+	if c.BatchLimitSize == 0 {
+		c.BatchLimitSize = DefaultBatchLimitSize
+	}
+
+	u := newUploader(c, NewLogger("testing", logrus.TraceLevel))
+	u.clock = newFakeClock()
+
+	return u
+}
+
+func TestBlobTargetSize(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:       AppendBlob,
+		StoreAs:        PlainTextFormat,
+		BlobTargetSize: 10,
+	}, fs)
+	k := BatchKey{TimeSlice: "20200101", ObjectKeyFormat: "logs/%{time_slice}_%{uuid}.log"}
+	u.sendBatch(k, []byte("1234\n"), Source{})
+	u.sendBatch(k, []byte("5678\n"), Source{})
+	u.sendBatch(k, []byte("9\n"), Source{})
+	k.TimeSlice = "20200102"
+	u.sendBatch(k, []byte("a\n"), Source{})
+
+	blobs := map[string]string{}
+	fs.mu.Lock()
+	for name, blob := range fs.blobs {
+		blobs[string(blob.data)] = name
+	}
+	fs.mu.Unlock()
+
+	assert.Len(t, blobs, 3)
+	assert.Regexp(t, "^logs/20200101_", blobs["1234\n5678\n"])
+	assert.Regexp(t, "^logs/20200101_", blobs["9\n"])
+	assert.Regexp(t, "^logs/20200102_", blobs["a\n"])
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Blob_Target_Size":      "64M",
+	}
+	_, err := NewConfig(conf)
+	assert.EqualError(t, err, "Blob_Target_Size requires Blob_Type append")
+
+	conf["Blob_Type"] = "append"
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, uint64(64*1024*1024), cfg.BlobTargetSize)
+}
+
+func TestLateRecordGrace(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:            BlockBlob,
+		StoreAs:             GzipFormat,
+		RecordCountMetadata: true,
+		LateRecordGrace:     time.Minute,
+	}, fs)
+	clock := u.clock.(*fakeClock)
+	advance := func(d time.Duration) {
+		clock.mu.Lock()
+		clock.now = clock.now.Add(d)
+		clock.mu.Unlock()
+	}
+	send := func(timeSlice, b string) {
+		k := BatchKey{TimeSlice: timeSlice, ObjectKeyFormat: "logs/%{time_slice}_%{uuid}.log.gz"}
+		u.sendBatch(k, []byte(b), Source{})
+	}
+
+	send("0300", "a\n")
+	send("0300", "b\n") // not late, a blob of its own
+	send("0301", "c\n")
+	advance(30 * time.Second)
+	send("0300", "d\ne\n") // late, added to the blob of b
+	send("0301", "f\n")
+	advance(time.Minute)
+	send("0300", "g\n") // too late, a new blob
+
+	blobs := map[string]*fakeBlob{}
+	fs.mu.Lock()
+	for name, blob := range fs.blobs {
+		r, err := gzip.NewReader(bytes.NewReader(blob.data))
+		if err != nil {
+			assert.Fail(t, "gzip.NewReader fails: %v", err)
+			continue
+		}
+		b, _ := ioutil.ReadAll(r)
+		blobs[string(b)] = blob
+		assert.Regexp(t, "^logs/030[01]_", name)
+	}
+	fs.mu.Unlock()
+
+	assert.Len(t, blobs, 5)
+	for _, records := range []string{"a\n", "b\nd\ne\n", "c\n", "f\n", "g\n"} {
+		assert.Contains(t, blobs, records)
+	}
+	assert.Equal(t, "3", blobs["b\nd\ne\n"].metadata["record_count"])
+	assert.Equal(t, "6", blobs["b\nd\ne\n"].metadata["uncompressed_size"])
+	assert.Equal(t, 2, blobs["b\nd\ne\n"].blocks)
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Late_Record_Grace":     "2m",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, 2*time.Minute, cfg.LateRecordGrace)
+
+	conf["Blob_Type"] = "unique"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "Late_Record_Grace doesn't work with Blob_Type unique")
+}
+
+func TestNotifyQueue(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	var mu sync.Mutex
+	var messages []Notification
+	status := http.StatusCreated
+	queue := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/account/uploads/messages", r.URL.Path)
+		assert.Equal(t, "sig", r.URL.Query().Get("sv"))
+
+		var msg struct {
+			MessageText string
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.NoError(t, xml.Unmarshal(body, &msg))
+		text, err := base64.StdEncoding.DecodeString(msg.MessageText)
+		assert.NoError(t, err)
+		var n Notification
+		assert.NoError(t, json.Unmarshal(text, &n))
+		messages = append(messages, n)
+		w.WriteHeader(status)
+	}))
+	defer queue.Close()
+
+	queueURL, p, err := newQueueURL(queue.URL+"/account/uploads?sv=sig", "sas", "", azblob.PipelineOptions{})
+	if err != nil {
+		assert.Fail(t, "newQueueURL fails: %v", err)
+	}
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:       AppendBlob,
+		StoreAs:        PlainTextFormat,
+		NotifyQueue:    queueURL,
+		NotifyPipeline: p,
+	}, fs)
+
+	k := BatchKey{ObjectKeyFormat: "logs/app.log"}
+	u.sendBatch(k, []byte("a\nb\n"), Source{})
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	u.sendBatch(k, []byte("c\n"), Source{})
+
+	// a failed notification doesn't fail the upload
+	assert.NoError(t, u.Err())
+	assert.Equal(t, "a\nb\nc\n", string(fs.Blob("logs/app.log").data))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, fs.srv.URL+"/account/container/logs/app.log", messages[0].URL)
+		assert.Equal(t, "container", messages[0].Container)
+		assert.Equal(t, "logs/app.log", messages[0].Blob)
+		assert.Equal(t, 4, messages[0].Size)
+		assert.Equal(t, 2, messages[0].Records)
+		assert.Equal(t, 1, messages[1].Records)
+	}
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sv=account",
+		"Notify_Queue_URL":      "https://testaccount.queue.core.windows.net/uploads",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, "https://testaccount.queue.core.windows.net/uploads/messages?sv=account",
+		cfg.NotifyQueue.String())
+
+	conf["Notify_Queue_URL"] = "https://testaccount.queue.core.windows.net"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Notify_Queue_URL: https://testaccount.queue.core.windows.net")
+}
+
+func TestWebhook(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	var mu sync.Mutex
+	posts := map[string]Notification{}
+	tries := map[string]int{}
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/hooks/uploads", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		// it's no storage service
+		assert.Empty(t, r.Header.Get("x-ms-version"))
+
+		var n Notification
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.NoError(t, json.Unmarshal(body, &n))
+		mu.Lock()
+		tries[n.Blob]++
+		try := tries[n.Blob]
+		mu.Unlock()
+
+		switch {
+		case n.Blob == "logs/slow.log":
+			<-release
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		case n.Blob == "logs/flaky.log" && try == 1, n.Blob == "logs/down.log":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mu.Lock()
+		posts[n.Blob] = n
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sv=account",
+		"Webhook_URL":           webhook.URL + "/hooks/uploads",
+		"Webhook_Retries":       "1",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:       BlockBlob,
+		StoreAs:        PlainTextFormat,
+		WebhookURL:     cfg.WebhookURL,
+		WebhookClient:  cfg.WebhookClient,
+		WebhookTimeout: cfg.WebhookTimeout,
+		WebhookRetries: cfg.WebhookRetries,
+	}, fs)
+
+	first := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	src := Source{}
+	src.include(first.Add(time.Minute))
+	src = src.merge(Source{First: first, Last: first})
+	assert.Equal(t, Source{First: first, Last: first.Add(time.Minute)}, src)
+
+	// a webhook which hangs and then fails neither blocks nor fails the upload
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/slow.log"}, []byte("x\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/app.log"}, []byte("a\nb\n"), src)
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/flaky.log"}, []byte("c\n"), Source{})
+	assert.NoError(t, u.Err())
+	assert.Equal(t, "x\n", string(fs.Blob("logs/slow.log").data))
+	assert.Equal(t, "a\nb\n", string(fs.Blob("logs/app.log").data))
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		_, ok := posts["logs/flaky.log"]
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Stop waits for the posts in flight, but not for their retries
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/down.log"}, []byte("d\n"), Source{})
+	stopped := make(chan struct{})
+	go func() {
+		u.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		assert.Fail(t, "Stop returns before the webhook posts are done")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+
+	// nor are posts started once it's stopped
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/late.log"}, []byte("e\n"), Source{})
+	assert.NotNil(t, fs.Blob("logs/late.log"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, tries["logs/slow.log"], "rejected posts aren't retried")
+	assert.Equal(t, 2, tries["logs/flaky.log"])
+	assert.Equal(t, 1, tries["logs/down.log"])
+	assert.Zero(t, tries["logs/late.log"])
+	n := posts["logs/app.log"]
+	assert.Equal(t, fs.srv.URL+"/account/container/logs/app.log", n.URL)
+	assert.Equal(t, "logs/app.log", n.Blob)
+	assert.Equal(t, 2, n.Records)
+	assert.Equal(t, "2021-03-04T05:06:07Z", n.FirstRecord)
+	assert.Equal(t, "2021-03-04T05:07:07Z", n.LastRecord)
+
+	assert.Equal(t, 3*time.Second, envConfig(t, conf, "AZBLOB_WEBHOOK_TIMEOUT", "3").WebhookTimeout)
+	delete(conf, "Webhook_Retries")
+	assert.Equal(t, 5, envConfig(t, conf, "AZBLOB_WEBHOOK_RETRIES", "5").WebhookRetries)
+	assert.Equal(t, DefaultWebhookRetries, envConfig(t, conf, "AZBLOB_WEBHOOK_RETRIES", "").WebhookRetries)
+
+	conf["Webhook_Timeout"] = "0"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "Webhook_Timeout must be positive")
+
+	conf["Webhook_Timeout"] = "2"
+	conf["Webhook_Retries"] = "-1"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Webhook_Retries: -1")
+
+	conf["Webhook_URL"] = "ftp://example.com/hook"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Webhook_URL: ftp://example.com/hook")
+}
+
+func TestAppInsights(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	var mu sync.Mutex
+	var exports []map[string]uint64
+	status := http.StatusOK
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/v2/track", r.URL.Path)
+
+		var envelopes []struct {
+			IKey string
+			Data struct {
+				BaseData struct {
+					Metrics []struct {
+						Name  string
+						Value uint64
+					}
+				}
+			}
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.NoError(t, json.Unmarshal(body, &envelopes))
+		values := map[string]uint64{}
+		for _, e := range envelopes {
+			assert.Equal(t, "key", e.IKey)
+			for _, m := range e.Data.BaseData.Metrics {
+				values[m.Name] = m.Value
+			}
+		}
+		exports = append(exports, values)
+		w.WriteHeader(status)
+	}))
+	defer endpoint.Close()
+
+	a, err := newAppInsights("InstrumentationKey=key;IngestionEndpoint="+endpoint.URL+"/",
+		time.Minute, azblob.PipelineOptions{})
+	if err != nil {
+		assert.Fail(t, "newAppInsights fails: %v", err)
+	}
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:    AppendBlob,
+		StoreAs:     PlainTextFormat,
+		AppInsights: a,
+	}, fs)
+
+	k := BatchKey{ObjectKeyFormat: "logs/app.log"}
+	u.sendBatch(k, []byte("a\nb\n"), Source{})
+	u.sendBatch(k, []byte("c\n"), Source{})
+	u.exportMetrics()
+
+	// a failed export is made up for by the next one
+	atomic.AddUint64(&u.failures, 1)
+	mu.Lock()
+	status = http.StatusBadRequest
+	mu.Unlock()
+	u.exportMetrics()
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	u.sendBatch(k, []byte("d\n"), Source{})
+	u.exportMetrics()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []map[string]uint64{
+		{"azblob_uploads_total": 2, "azblob_uploaded_bytes_total": 6, "azblob_upload_failures_total": 0},
+		{"azblob_uploads_total": 0, "azblob_uploaded_bytes_total": 0, "azblob_upload_failures_total": 1},
+		{"azblob_uploads_total": 1, "azblob_uploaded_bytes_total": 2, "azblob_upload_failures_total": 1},
+	}, exports)
+
+	var b bytes.Buffer
+	u.writeMetrics(&b)
+	assert.Contains(t, b.String(), "azblob_uploads_total 3\n")
+	assert.Contains(t, b.String(), "azblob_uploaded_bytes_total 8\n")
+	assert.Contains(t, b.String(), "azblob_upload_failures_total 1\n")
+
+	conf := mapConfig{
+		"Azure_Container":               "testcontainer",
+		"Azure_Storage_Account":         "testaccount",
+		"Azure_Storage_SAS":             "sas",
+		"AppInsights_Connection_String": "InstrumentationKey=key",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, "https://dc.services.visualstudio.com/v2/track", cfg.AppInsights.URL.String())
+	assert.Equal(t, DefaultAppInsightsInterval, cfg.AppInsights.Interval)
+
+	for connectionString, expected := range map[string]string{
+		"IngestionEndpoint=https://example.com/": "invalid AppInsights_Connection_String, no InstrumentationKey",
+		"InstrumentationKey":                     "invalid AppInsights_Connection_String, expected key=value: InstrumentationKey",
+		"InstrumentationKey=key;IngestionEndpoint=example.com": "invalid AppInsights_Connection_String, " +
+			"bad IngestionEndpoint: example.com",
+	} {
+		conf["AppInsights_Connection_String"] = connectionString
+		_, err = NewConfig(conf)
+		assert.EqualError(t, err, expected, connectionString)
+	}
+
+	conf["AppInsights_Connection_String"] = "InstrumentationKey=key"
+	conf["AppInsights_Interval"] = "0"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "AppInsights_Interval must be positive")
+}
+
+func TestOnRestart(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	k := BatchKey{ObjectKeyFormat: "logs/app.log"}
+	first := newFakeUploader(&AzblobConfig{BlobType: AppendBlob, StoreAs: PlainTextFormat}, fs)
+	first.sendBatch(k, []byte("a\n"), Source{})
+
+	// append continues the blob of the previous run
+	second := newFakeUploader(&AzblobConfig{BlobType: AppendBlob, StoreAs: PlainTextFormat}, fs)
+	second.sendBatch(k, []byte("b\n"), Source{})
+	assert.Equal(t, "a\nb\n", string(fs.Blob("logs/app.log").data))
+
+	// new starts a blob of its own
+	third := newFakeUploader(&AzblobConfig{
+		BlobType:  AppendBlob,
+		StoreAs:   PlainTextFormat,
+		OnRestart: NewOnRestart,
+	}, fs)
+	assert.Regexp(t, "^[0-9]{8}T[0-9]{6}Z$", third.restartID)
+	third.sendBatch(k, []byte("c\n"), Source{})
+	assert.Equal(t, "a\nb\n", string(fs.Blob("logs/app.log").data))
+	assert.Equal(t, "c\n", string(fs.Blob("logs/app-"+third.restartID+".log").data))
+
+	assert.Equal(t, "logs/app-20200102T030405Z.tar.gz", restartKey("logs/app.tar.gz", "20200102T030405Z"))
+	assert.Equal(t, "app-20200102T030405Z", restartKey("app", "20200102T030405Z"))
+	assert.Equal(t, "logs/app.log", restartKey("logs/app.log", ""))
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"On_Restart":            "overwrite",
+	}
+	_, err := NewConfig(conf)
+	assert.EqualError(t, err, "invalid On_Restart: overwrite")
+}
+
+func TestUploadAppendBlobWithMaxBlobSize(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:    AppendBlob,
+		StoreAs:     PlainTextFormat,
+		MaxBlobSize: 10,
+	}, fs)
+	k := BatchKey{ObjectKeyFormat: "logs/app.log"}
+
+	u.sendBatch(k, []byte("1234\n"), Source{})
+	u.sendBatch(k, []byte("5678\n"), Source{})
+	u.sendBatch(k, []byte("9\n"), Source{})
+
+	assert.Equal(t, "1234\n5678\n", string(fs.Blob("logs/app.log").data))
+	assert.Equal(t, "9\n", string(fs.Blob("logs/app-1.log").data))
+
+	// the parts are picked up again after a restart
+	u = newFakeUploader(&AzblobConfig{
+		BlobType:    AppendBlob,
+		StoreAs:     PlainTextFormat,
+		MaxBlobSize: 10,
+	}, fs)
+	u.sendBatch(k, []byte("abcdefg\n"), Source{})
+	u.sendBatch(k, []byte("h\n"), Source{})
+
+	assert.Equal(t, "9\nabcdefg\n", string(fs.Blob("logs/app-1.log").data))
+	assert.Equal(t, "h\n", string(fs.Blob("logs/app-2.log").data))
+}
+
+func TestUploadAppendBlobWithMaxBlobBlocks(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:      AppendBlob,
+		StoreAs:       PlainTextFormat,
+		MaxBlobBlocks: 2,
+	}, fs)
+	k := BatchKey{ObjectKeyFormat: "logs/app.log"}
+
+	// the second block fills the blob up to the limit, the third one goes
+	// to the next part
+	u.sendBatch(k, []byte("1\n"), Source{})
+	u.sendBatch(k, []byte("2\n"), Source{})
+	assert.Equal(t, "1\n2\n", string(fs.Blob("logs/app.log").data))
+	assert.Nil(t, fs.Blob("logs/app-1.log"))
+
+	u.sendBatch(k, []byte("3\n"), Source{})
+	assert.Equal(t, 2, fs.Blob("logs/app.log").blocks)
+	assert.Equal(t, "3\n", string(fs.Blob("logs/app-1.log").data))
+
+	// the block counts are picked up again after a restart
+	u = newFakeUploader(&AzblobConfig{
+		BlobType:      AppendBlob,
+		StoreAs:       PlainTextFormat,
+		MaxBlobBlocks: 2,
+	}, fs)
+	u.sendBatch(k, []byte("4\n"), Source{})
+	u.sendBatch(k, []byte("5\n"), Source{})
+
+	assert.Equal(t, "3\n4\n", string(fs.Blob("logs/app-1.log").data))
+	assert.Equal(t, "5\n", string(fs.Blob("logs/app-2.log").data))
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Blob_Type":             "append",
+		"Max_Blob_Blocks":       "40000",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, 40000, cfg.MaxBlobBlocks)
+
+	conf["Max_Blob_Blocks"] = "50001"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Max_Blob_Blocks: 50001")
+
+	conf["Max_Blob_Blocks"] = "40000"
+	conf["Blob_Type"] = "block"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "Max_Blob_Blocks requires Blob_Type append")
+}
+
+func TestLastSuccessMetric(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		StoreAs:             PlainTextFormat,
+		LastSuccessPrefixes: []string{"kube/", "audit/", "kube/shop/"},
+	}, fs)
+
+	var b bytes.Buffer
+	u.writeMetrics(&b)
+	assert.NotContains(t, b.String(), "azblob_last_success_timestamp_seconds")
+
+	u.sendBatch(BatchKey{ObjectKeyFormat: "kube/shop/app.log"}, []byte("a\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: "other/app.log"}, []byte("a\n"), Source{})
+
+	// failed uploads leave the gauge alone
+	fs.fail = func(r *http.Request) (int, string) {
+		return http.StatusForbidden, "AuthorizationFailure"
+	}
+	u.sendBatch(BatchKey{ObjectKeyFormat: "audit/app.log"}, []byte("a\n"), Source{})
+
+	b.Reset()
+	u.writeMetrics(&b)
+	assert.Contains(t, b.String(), "# HELP azblob_last_success_timestamp_seconds "+
+		"Time of the last successful upload of a blob under the prefix.\n"+
+		"# TYPE azblob_last_success_timestamp_seconds gauge\n"+
+		"azblob_last_success_timestamp_seconds{prefix=\"kube/\"} 1577934245.000\n"+
+		"azblob_last_success_timestamp_seconds{prefix=\"kube/shop/\"} 1577934245.000\n",
+		b.String())
+
+	_, err := NewConfig(mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Last_Success_Prefixes": "kube/",
+	})
+	assert.EqualError(t, err, "Last_Success_Prefixes requires Admin_Listen")
+}
+
+func TestCompressionMinBytes(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":         "testcontainer",
+		"Azure_Storage_Account":   "testaccount",
+		"Azure_Storage_SAS":       "sas",
+		"Azure_Object_Key_Format": "logs/app.log",
+		"Compression_Min_Bytes":   "1K",
+	}
+	_, err := NewConfig(conf)
+	assert.Error(t, err)
+
+	conf["Azure_Object_Key_Format"] = "logs/app.log.%{file_extension}"
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, uint64(1024), cfg.CompressionMinBytes)
+	assert.Equal(t, "logs/app.log.%{file_extension}", cfg.ObjectKeyFormat)
+
+	conf["StoreAs"] = "text"
+	_, err = NewConfig(conf)
+	assert.Error(t, err)
+
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:            AppendBlob,
+		StoreAs:             GzipFormat,
+		CompressionMinBytes: 1024,
+	}, fs)
+	k := BatchKey{ObjectKeyFormat: cfg.ObjectKeyFormat}
+
+	small := []byte("small\n")
+	large := bytes.Repeat([]byte("large\n"), 200)
+	u.sendBatch(k, small, Source{})
+	u.sendBatch(k, large, Source{})
+	u.sendBatch(k, small, Source{})
+
+	assert.Equal(t, "small\nsmall\n", string(fs.Blob("logs/app.log.txt").data))
+
+	r, err := gzip.NewReader(bytes.NewReader(fs.Blob("logs/app.log.gz").data))
+	if err != nil {
+		assert.Fail(t, "gzip.NewReader fails: %v", err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	assert.Equal(t, large, b)
+}
+
+func TestDeliverPartialAppend(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	// fails every append of block "b" with status until it's allowed
+	var status int
+	failures := 0
+	fs.fail = func(r *http.Request) (int, string) {
+		if r.URL.Query().Get("comp") != "appendblock" {
+			return 0, ""
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if string(b) != "b\n" || failures == 0 {
+			return 0, ""
+		}
+		failures--
+		return status, ""
+	}
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType: AppendBlob,
+		StoreAs:  PlainTextFormat,
+	}, fs)
+
+	attempts := uint64(1)
+	blocks := [][]byte{[]byte("a\n"), []byte("b\n"), []byte("c\n")}
+
+	// the retry continues with the failed block
+	status, failures = http.StatusTooManyRequests, 1
+	err := u.deliver(u.logger, "", "logs/app.log", blocks, &attempts, Source{})
+	assert.Nil(t, err)
+	assert.Equal(t, "a\nb\nc\n", string(fs.Blob("logs/app.log").data))
+
+	// a permanent error isn't hidden by the blocks appended before
+	status, failures = http.StatusForbidden, 1
+	err = u.deliver(u.logger, "", "logs/app.log", blocks, &attempts, Source{})
+	assert.True(t, isPermanent(err))
+	assert.Equal(t, "a\nb\nc\na\n", string(fs.Blob("logs/app.log").data))
+}
+
+func TestDeliverAppendOrder(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:          AppendBlob,
+		StoreAs:           PlainTextFormat,
+		UploadParallelism: 8,
+	}, fs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		var blocks [][]byte
+		for j := 0; j < 3; j++ {
+			blocks = append(blocks, []byte(fmt.Sprintf("%d-%d\n", i, j)))
+		}
+
+		wg.Add(1)
+		go func(objectKey string) {
+			defer wg.Done()
+			assert.Nil(t, u.deliver(u.logger, "", objectKey, blocks, nil, Source{}))
+		}([]string{"a.log", "b.log"}[i%2])
+	}
+	wg.Wait()
+
+	// the blocks of a batch are never interleaved with another batch
+	for _, name := range []string{"a.log", "b.log"} {
+		lines := strings.Split(strings.TrimSuffix(string(fs.Blob(name).data), "\n"), "\n")
+		assert.Len(t, lines, 12)
+		for i := 0; i < len(lines); i += 3 {
+			batch := strings.Split(lines[i], "-")[0]
+			assert.Equal(t, []string{batch + "-0", batch + "-1", batch + "-2"}, lines[i:i+3])
+		}
+	}
+	assert.Empty(t, u.writing)
+}
+
+func TestUploadAppendBlobOverBlockBlob(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{StoreAs: PlainTextFormat}, fs)
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/app.log"}, []byte("block\n"), Source{})
+
+	u = newFakeUploader(&AzblobConfig{
+		BlobType: AppendBlob,
+		StoreAs:  PlainTextFormat,
+	}, fs)
+	k := BatchKey{ObjectKeyFormat: "logs/app.log"}
+	u.sendBatch(k, []byte("a\n"), Source{})
+	u.sendBatch(k, []byte("b\n"), Source{})
+
+	assert.Nil(t, u.Err())
+	assert.Equal(t, "block\n", string(fs.Blob("logs/app.log").data))
+	assert.Equal(t, "a\nb\n", string(fs.Blob("logs/app-1.log").data))
+}
+
+func TestGzipContentEncoding(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Gzip_Content_Encoding": "true",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.True(t, strings.HasSuffix(cfg.ObjectKeyFormat, ".txt"), cfg.ObjectKeyFormat)
+
+	for key, value := range map[string]string{
+		"StoreAs":               "text",
+		"Blob_Type":             "append",
+		"Compression_Min_Bytes": "1K",
+	} {
+		conf[key] = value
+		_, err = NewConfig(conf)
+		assert.Error(t, err, key)
+		delete(conf, key)
+	}
+
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		StoreAs:             GzipFormat,
+		GzipContentEncoding: true,
+	}, fs)
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/app.txt"}, []byte("a\n"), Source{})
+
+	blob := fs.Blob("logs/app.txt")
+	assert.Equal(t, "gzip", blob.headers.Get("x-ms-blob-content-encoding"))
+	r, err := gzip.NewReader(bytes.NewReader(blob.data))
+	if err != nil {
+		assert.Fail(t, "gzip.NewReader fails: %v", err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "a\n", string(b))
+}
+
+func TestUploadGzipBlockBlob(t *testing.T) {
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":         "testcontainer",
+		"Azure_Storage_Account":   "testaccount",
+		"Azure_Storage_SAS":       "sas",
+		"Azure_Object_Key_Format": "logs/%{time_slice}.%{file_extension}",
+	})
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{StoreAs: cfg.StoreAs}, fs)
+	records := bytes.Repeat([]byte(`{"log":"line"}`+"\n"), 100)
+	u.sendBatch(BatchKey{TimeSlice: "2020010203-04", ObjectKeyFormat: cfg.ObjectKeyFormat}, records, Source{})
+
+	blob := fs.Blob("logs/2020010203-04.gz")
+	if !assert.NotNil(t, blob) {
+		return
+	}
+	assert.Equal(t, "application/gzip", blob.headers.Get("x-ms-blob-content-type"))
+	assert.Equal(t, strconv.Itoa(len(records)), blob.metadata["uncompressed_size"])
+
+	r, err := gzip.NewReader(bytes.NewReader(blob.data))
+	if err != nil {
+		assert.Fail(t, "gzip.NewReader fails: %v", err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	assert.Equal(t, records, b)
+
+	// text blobs are left alone
+	u = newFakeUploader(&AzblobConfig{StoreAs: PlainTextFormat}, fs)
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/app.txt"}, records, Source{})
+	assert.Empty(t, fs.Blob("logs/app.txt").headers.Get("x-ms-blob-content-type"))
+	assert.Empty(t, fs.Blob("logs/app.txt").metadata)
+}
+
+func TestRecordCountMetadata(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		StoreAs:             GzipFormat,
+		RecordCountMetadata: true,
+	}, fs)
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/block.gz"}, []byte("a\nb\nc\n"), Source{})
+	assert.Equal(t, "3", fs.Blob("logs/block.gz").metadata["record_count"])
+	assert.Equal(t, "6", fs.Blob("logs/block.gz").metadata["uncompressed_size"])
+
+	u = newFakeUploader(&AzblobConfig{
+		BlobType:            AppendBlob,
+		StoreAs:             PlainTextFormat,
+		RecordCountMetadata: true,
+	}, fs)
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/append.log"}, []byte("a\nb\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/append.log"}, []byte("c\n"), Source{})
+	assert.Equal(t, "3", fs.Blob("logs/append.log").metadata["record_count"])
+
+	gz, _ := makeGzip([]byte("a\nb\n"))
+	assert.Equal(t, 5, countRecords([][]byte{gz, []byte("c\nd\ne\n")}))
+}
+
+func TestWriteBOM(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	bom := string(BOM)
+	u := newFakeUploader(&AzblobConfig{
+		BlobType: AppendBlob,
+		StoreAs:  PlainTextFormat,
+		WriteBOM: true,
+	}, fs)
+	k := BatchKey{ObjectKeyFormat: "logs/app.log"}
+	u.sendBatch(k, []byte("a\n"), Source{})
+	u.sendBatch(k, []byte("b\n"), Source{})
+	assert.Equal(t, bom+"a\nb\n", string(fs.Blob("logs/app.log").data))
+	assert.Equal(t, 3, fs.Blob("logs/app.log").blocks)
+
+	// another writer, or a restart, doesn't add a BOM to a blob with records
+	u = newFakeUploader(&AzblobConfig{
+		BlobType: AppendBlob,
+		StoreAs:  PlainTextFormat,
+		WriteBOM: true,
+	}, fs)
+	u.sendBatch(k, []byte("c\n"), Source{})
+	u.sendBatch(k, []byte("d\n"), Source{})
+	assert.Equal(t, bom+"a\nb\nc\nd\n", string(fs.Blob("logs/app.log").data))
+
+	// gzip blobs don't get one
+	u = newFakeUploader(&AzblobConfig{
+		BlobType: AppendBlob,
+		StoreAs:  GzipFormat,
+		WriteBOM: true,
+	}, fs)
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/app.log.gz"}, []byte("a\n"), Source{})
+	assert.Equal(t, []byte{0x1f, 0x8b}, fs.Blob("logs/app.log.gz").data[:2])
+
+	u = newFakeUploader(&AzblobConfig{
+		BlobType: BlockBlob,
+		StoreAs:  PlainTextFormat,
+		WriteBOM: true,
+	}, fs)
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/block.log"}, []byte("a\n"), Source{})
+	assert.Equal(t, bom+"a\n", string(fs.Blob("logs/block.log").data))
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Blob_Type":             "append",
+		"Write_BOM":             "true",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.True(t, cfg.WriteBOM)
+
+	conf["Sequence_Metadata"] = "true"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "Write_BOM doesn't work with Sequence_Metadata")
+}
+
+func TestSkipEmptyBatches(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	var requests int
+	fs.fail = func(r *http.Request) (int, string) {
+		requests++
+		return 0, ""
+	}
+
+	for _, blobType := range []BlobType{BlockBlob, AppendBlob} {
+		requests = 0
+		u := newFakeUploader(&AzblobConfig{
+			BlobType: blobType,
+			StoreAs:  PlainTextFormat,
+		}, fs)
+		k := BatchKey{ObjectKeyFormat: "logs/" + string(blobType) + ".log"}
+		u.sendBatch(k, nil, Source{})
+		u.sendBatch(k, []byte("\n\n"), Source{})
+		assert.Equal(t, 0, requests)
+		assert.Nil(t, fs.Blob("logs/"+string(blobType)+".log"))
+
+		var b bytes.Buffer
+		u.writeMetrics(&b)
+		assert.Contains(t, b.String(), "azblob_empty_batches_skipped_total 2\n")
+
+		u.sendBatch(k, []byte("a\n"), Source{})
+		assert.Equal(t, "a\n", string(fs.Blob("logs/"+string(blobType)+".log").data))
+	}
+}
+
+func TestCreateFirst(t *testing.T) {
+	_, err := NewConfig(mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Create_First":          "true",
+	})
+	assert.EqualError(t, err, "Create_First requires Blob_Type append")
+
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	var requests []string
+	fs.fail = func(r *http.Request) (int, string) {
+		requests = append(requests, r.Method+" "+r.URL.Query().Get("comp"))
+		return 0, ""
+	}
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:    AppendBlob,
+		StoreAs:     PlainTextFormat,
+		CreateFirst: true,
+	}, fs)
+	k := BatchKey{ObjectKeyFormat: "logs/app.log"}
+	u.sendBatch(k, []byte("a\n"), Source{})
+	u.sendBatch(k, []byte("b\n"), Source{})
+	assert.Equal(t, []string{"PUT ", "PUT appendblock", "PUT appendblock"}, requests)
+	assert.Equal(t, "a\nb\n", string(fs.Blob("logs/app.log").data))
+
+	// after a restart the existing blob is appended to
+	requests = nil
+	u = newFakeUploader(&AzblobConfig{
+		BlobType:    AppendBlob,
+		StoreAs:     PlainTextFormat,
+		CreateFirst: true,
+	}, fs)
+	u.sendBatch(k, []byte("c\n"), Source{})
+	assert.Equal(t, []string{"PUT ", "PUT appendblock"}, requests)
+	assert.Equal(t, "a\nb\nc\n", string(fs.Blob("logs/app.log").data))
+}
+
+func TestSequenceMetadata(t *testing.T) {
+	_, err := NewConfig(mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Sequence_Metadata":     "true",
+	})
+	assert.EqualError(t, err, "Sequence_Metadata requires Blob_Type append")
+
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:         AppendBlob,
+		StoreAs:          PlainTextFormat,
+		SequenceMetadata: true,
+	}, fs)
+	k := BatchKey{ObjectKeyFormat: "logs/append.log"}
+	u.sendBatch(k, []byte("a\n"), Source{})
+	u.sendBatch(k, []byte("b\n"), Source{})
+	blob := fs.Blob("logs/append.log")
+	assert.Equal(t, "a\nb\n", string(blob.data))
+	assert.Equal(t, "2", blob.metadata["sequence"])
+	assert.Equal(t, 2, blob.leases)
+	assert.Empty(t, blob.lease)
+
+	// another writer holds the lease for a while
+	fs.mu.Lock()
+	blob.lease = "other"
+	fs.mu.Unlock()
+	time.AfterFunc(3*LeaseRetryInterval, func() {
+		fs.mu.Lock()
+		blob.lease = ""
+		fs.mu.Unlock()
+	})
+	u.sendBatch(k, []byte("c\n"), Source{})
+	assert.Equal(t, "a\nb\nc\n", string(blob.data))
+	assert.Equal(t, "3", blob.metadata["sequence"])
+}
+
+func TestUploadUniqueBlob(t *testing.T) {
+	_, err := NewConfig(mapConfig{
+		"Azure_Container":         "testcontainer",
+		"Azure_Storage_Account":   "testaccount",
+		"Blob_Type":               "unique",
+		"Azure_Object_Key_Format": "%{time_slice}.gz",
+	})
+	assert.Error(t, err)
+
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType: UniqueBlob,
+		StoreAs:  PlainTextFormat,
+	}, fs)
+	k := BatchKey{ObjectKeyFormat: "logs/%{uuid}.log"}
+
+	u.sendBatch(k, []byte("first\n"), Source{})
+	u.sendBatch(k, []byte("second\n"), Source{})
+	assert.Len(t, fs.blobs, 2)
+
+	// a blob written by an earlier attempt is neither overwritten nor an error
+	err = u.upload(u.logger, u.containers[0], "logs/existing.log", [][]byte{[]byte("a")})
+	assert.Nil(t, err)
+	err = u.upload(u.logger, u.containers[0], "logs/existing.log", [][]byte{[]byte("b")})
+	assert.Nil(t, err)
+	assert.Equal(t, "a", string(fs.Blob("logs/existing.log").data))
+}
+
+func TestUploadWithImmutabilityDays(t *testing.T) {
+	_, err := NewConfig(mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Blob_Type":             "append",
+		"Immutability_Days":     "7",
+	})
+	assert.Error(t, err)
+
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		StoreAs:          PlainTextFormat,
+		ImmutabilityDays: 7,
+	}, fs)
+	clock := newFakeClock()
+	clock.now = time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	u.clock = clock
+
+	err = u.upload(u.logger, u.containers[0], "worm.log", [][]byte{[]byte("a")})
+	assert.Nil(t, err)
+	assert.Equal(t, "Wed, 11 Mar 2020 05:06:07 GMT", fs.Blob("worm.log").immutableUntil)
+
+	// containers of Container_Key get the policy too
+	u.sendBatch(BatchKey{ObjectKeyFormat: "worm.log", Container: "prod-eu"}, []byte("a\n"), Source{})
+	assert.NoError(t, u.Err())
+	if assert.NotNil(t, fs.Blob("account/prod-eu/worm.log")) {
+		assert.Equal(t, "Wed, 11 Mar 2020 05:06:07 GMT",
+			fs.Blob("account/prod-eu/worm.log").immutableUntil)
+	}
+
+	// containers without immutability support reject the policy
+	fs.fail = func(r *http.Request) (int, string) {
+		if r.URL.Query().Get("comp") == "immutabilityPolicies" {
+			return http.StatusConflict, "ContainerImmutabilityNotEnabled"
+		}
+		return 0, ""
+	}
+	err = u.upload(u.logger, u.containers[0], "worm.log", [][]byte{[]byte("b")})
+	assert.Error(t, err)
+	assert.Equal(t, "ContainerImmutabilityNotEnabled", errorCode(err))
+}
+
+func TestLegalHold(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Legal_Hold":            "true",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.True(t, cfg.LegalHold)
+
+	conf["Blob_Type"] = "append"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "Legal_Hold requires block blobs")
+
+	conf["Blob_Type"] = "block"
+	conf["Late_Record_Grace"] = "60"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "Late_Record_Grace doesn't work with Legal_Hold")
+
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		StoreAs:          PlainTextFormat,
+		ImmutabilityDays: 7,
+		LegalHold:        true,
+	}, fs)
+	err = u.upload(u.logger, u.containers[0], "hold.log", [][]byte{[]byte("a")})
+	assert.NoError(t, err)
+	assert.True(t, fs.Blob("hold.log").legalHold)
+	assert.NotEmpty(t, fs.Blob("hold.log").immutableUntil)
+
+	// containers without immutability support reject the hold
+	fs.fail = func(r *http.Request) (int, string) {
+		if r.URL.Query().Get("comp") == "legalhold" {
+			return http.StatusConflict, "ContainerImmutabilityNotEnabled"
+		}
+		return 0, ""
+	}
+	u = newFakeUploader(&AzblobConfig{StoreAs: PlainTextFormat, LegalHold: true}, fs)
+	err = u.upload(u.logger, u.containers[0], "nohold.log", [][]byte{[]byte("b")})
+	assert.Error(t, err)
+	assert.Equal(t, "ContainerImmutabilityNotEnabled", errorCode(err))
+	assert.False(t, fs.Blob("nohold.log").legalHold)
+
+	// a unique blob written by an attempt which failed to hold it is held by
+	// the retry, which finds it exists
+	fs.fail = func(r *http.Request) (int, string) {
+		if r.URL.Query().Get("comp") == "legalhold" {
+			return http.StatusInternalServerError, "InternalError"
+		}
+		return 0, ""
+	}
+	u = newFakeUploader(&AzblobConfig{
+		BlobType:         UniqueBlob,
+		StoreAs:          PlainTextFormat,
+		ImmutabilityDays: 7,
+		LegalHold:        true,
+	}, fs)
+	err = u.upload(u.logger, u.containers[0], "unique.log", [][]byte{[]byte("c")})
+	assert.Error(t, err)
+	assert.False(t, fs.Blob("unique.log").legalHold)
+	fs.mu.Lock()
+	fs.fail = nil
+	fs.mu.Unlock()
+	err = u.upload(u.logger, u.containers[0], "unique.log", [][]byte{[]byte("c")})
+	assert.NoError(t, err)
+	assert.True(t, fs.Blob("unique.log").legalHold)
+
+	// containers of Container_Key are held too
+	u.sendBatch(BatchKey{ObjectKeyFormat: "%{uuid}.log", Container: "prod-eu"}, []byte("d\n"), Source{})
+	assert.NoError(t, u.Err())
+	fs.mu.Lock()
+	held := 0
+	for name, blob := range fs.blobs {
+		if strings.HasPrefix(name, "account/prod-eu/") && blob.legalHold {
+			held++
+		}
+	}
+	fs.mu.Unlock()
+	assert.Equal(t, 1, held)
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+	fs.noContainer = true
+
+	// The container takes two requests and the blob one, of 600ms each,
+	// which don't fit in one budget of 2s. The SDK cuts the time left to
+	// whole seconds per try.
+	fs.fail = func(r *http.Request) (int, string) {
+		time.Sleep(600 * time.Millisecond)
+		return 0, ""
+	}
+
+	u := newFakeUploader(&AzblobConfig{
+		AutoCreateContainer: true,
+		SetupTimeout:        2 * time.Second,
+		UploadTimeout:       2 * time.Second,
+	}, fs)
+	err := u.upload(u.logger, u.containers[0], "app.log", [][]byte{[]byte("a\n")})
+	assert.NoError(t, err)
+	assert.Equal(t, "a\n", string(fs.Blob("app.log").data))
+
+	fs.noContainer = true
+	u = newFakeUploader(&AzblobConfig{
+		AutoCreateContainer: true,
+		SetupTimeout:        time.Second,
+		UploadTimeout:       2 * time.Second,
+	}, fs)
+	once := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		Retry: azblob.RetryOptions{MaxTries: 1},
+	})
+	err = u.upload(u.logger, u.containers[0].WithPipeline(once), "app.log", [][]byte{[]byte("b\n")})
+	assert.Error(t, err)
+	assert.Equal(t, "a\n", string(fs.Blob("app.log").data))
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, 30*time.Second, cfg.UploadTimeout)
+	assert.Equal(t, 10*time.Second, cfg.SetupTimeout)
+
+	conf["Upload_Timeout"] = "1m"
+	cfg, err = NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, 20*time.Second, cfg.SetupTimeout)
+
+	conf["Setup_Timeout"] = "0"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "Upload_Timeout and Setup_Timeout must be positive")
+}
+
+func TestEnsureContainerConcurrently(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+	fs.noContainer = true
+
+	// the first create races with the deletion of the container
+	deleting := true
+	fs.fail = func(r *http.Request) (int, string) {
+		if r.Method == http.MethodPut && deleting {
+			deleting = false
+			return http.StatusConflict, string(azblob.ServiceCodeContainerBeingDeleted)
+		}
+		return 0, ""
+	}
+
+	u := newFakeUploader(&AzblobConfig{}, fs)
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- u.ensureContainer(context.Background(), u.containers[0])
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1, fs.containerCreates)
+
+	// a container created by someone else in the meantime counts as created
+	u = newFakeUploader(&AzblobConfig{}, fs)
+	fs.fail = func(r *http.Request) (int, string) {
+		if r.Method != http.MethodPut {
+			return http.StatusNotFound, string(azblob.ServiceCodeContainerNotFound)
+		}
+		return 0, ""
+	}
+	assert.Nil(t, u.ensureContainer(context.Background(), u.containers[0]))
+	assert.Equal(t, 2, fs.containerCreates)
+}
+
+func TestPrecreateContainers(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	created := map[string]bool{}
+	fs.fail = func(r *http.Request) (int, string) {
+		if r.URL.Query().Get("restype") != "container" || r.URL.Path == "/account/container" {
+			return 0, ""
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/account/")
+		switch {
+		case name == "denied":
+			return http.StatusForbidden, "AuthorizationFailure"
+		case name == "invalid":
+			return http.StatusBadRequest, "InvalidResourceName"
+		case r.Method == http.MethodPut && created[name]:
+			return http.StatusConflict, string(azblob.ServiceCodeContainerAlreadyExists)
+		case r.Method == http.MethodPut:
+			created[name] = true
+			return http.StatusCreated, ""
+		}
+		return http.StatusNotFound, string(azblob.ServiceCodeContainerNotFound)
+	}
+
+	u := newFakeUploader(&AzblobConfig{
+		PrecreateContainers: []string{"prod", "staging", "invalid"},
+	}, fs)
+	created["staging"] = true
+	assert.Nil(t, u.precreateContainers())
+	assert.Equal(t, map[string]bool{"prod": true, "staging": true}, created)
+
+	u = newFakeUploader(&AzblobConfig{
+		PrecreateContainers: []string{"prod", "denied"},
+	}, fs)
+	err := u.precreateContainers()
+	assert.Error(t, err)
+	assert.Equal(t, "AuthorizationFailure", errorCode(err))
+
+	for name, valid := range map[string]bool{
+		"prod-2":      true,
+		"ab":          false,
+		"Prod":        false,
+		"-prod":       false,
+		"prod--2":     false,
+		"prod_2":      false,
+		"logs-abc123": true,
+	} {
+		assert.Equal(t, valid, validContainerName(name), name)
+	}
+
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Precreate_Containers":  "prod, Staging",
+	})
+	assert.EqualError(t, err, "invalid container name in Precreate_Containers: Staging")
+}
+
+func TestDedupWindow(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:    AppendBlob,
+		StoreAs:     PlainTextFormat,
+		DedupWindow: 2,
+	}, fs)
+	k := BatchKey{ObjectKeyFormat: "logs/app.log"}
+	for _, b := range []string{"a\n", "a\n", "b\n", "a\n", "c\n", "a\n"} {
+		u.sendBatch(k, []byte(b), Source{})
+	}
+	// a is forgotten once two other batches follow it
+	assert.Equal(t, "a\nb\nc\na\n", string(fs.Blob("logs/app.log").data))
+
+	// other batch keys have hashes of their own
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/other.log"}, []byte("a\n"), Source{})
+	assert.Equal(t, "a\n", string(fs.Blob("logs/other.log").data))
+
+	var b bytes.Buffer
+	u.writeMetrics(&b)
+	assert.Contains(t, b.String(), "azblob_duplicate_batches_skipped_total 2\n")
+
+	// batches which weren't delivered, on their own or in an append buffer,
+	// don't make the same batch sent again a duplicate
+	deny := func(r *http.Request) (int, string) {
+		return http.StatusForbidden, "AuthorizationFailure"
+	}
+	fs.fail = deny
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/lost.log"}, []byte("a\n"), Source{})
+	fs.mu.Lock()
+	fs.fail = nil
+	fs.mu.Unlock()
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/lost.log"}, []byte("a\n"), Source{})
+	assert.Equal(t, "a\n", string(fs.Blob("logs/lost.log").data))
+
+	u.config.AppendBufferSize = 4
+	u.config.AppendBufferMaxAge = time.Minute
+	k = BatchKey{ObjectKeyFormat: "logs/buffered.log"}
+	u.sendBatch(k, []byte("x\n"), Source{})
+	fs.mu.Lock()
+	fs.fail = deny
+	fs.mu.Unlock()
+	u.sendBatch(k, []byte("y\n"), Source{})
+	fs.mu.Lock()
+	fs.fail = nil
+	fs.mu.Unlock()
+	u.sendBatch(k, []byte("x\n"), Source{})
+	u.sendBatch(k, []byte("y\n"), Source{})
+	assert.Equal(t, "x\ny\n", string(fs.Blob("logs/buffered.log").data))
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Dedup_Window":          "4",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, 4, cfg.DedupWindow)
+
+	conf["Dedup_Window"] = "-1"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Dedup_Window: -1")
+}
+
+func TestAppendBuffer(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:           AppendBlob,
+		StoreAs:            GzipFormat,
+		AppendBufferSize:   16,
+		AppendBufferMaxAge: time.Minute,
+	}, fs)
+	clock := newFakeClock()
+	u.clock = clock
+	k := BatchKey{ObjectKeyFormat: "app.log.gz"}
+
+	u.sendBatch(k, []byte("first\n"), Source{})
+	u.sendBatch(k, []byte("second\n"), Source{})
+	assert.Nil(t, fs.Blob("app.log.gz"))
+
+	// the buffer is appended as a single gzip member once it's full
+	u.sendBatch(k, []byte("third\n"), Source{})
+	blob := fs.Blob("app.log.gz")
+	assert.Equal(t, 1, blob.blocks)
+	r, _ := gzip.NewReader(bytes.NewReader(blob.data))
+	r.Multistream(false)
+	b, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "first\nsecond\nthird\n", string(b))
+
+	// and after the maximum age when the buffer doesn't fill up
+	u.sendBatch(k, []byte("fourth\n"), Source{})
+	u.flushAppendBuffers(false)
+	assert.Equal(t, 1, fs.Blob("app.log.gz").blocks)
+
+	clock.now = clock.now.Add(time.Minute)
+	u.flushAppendBuffers(false)
+	assert.Eventually(t, func() bool {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		return fs.blobs["app.log.gz"].blocks == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPreserveOrder(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	for _, storeAs := range []FileFormat{PlainTextFormat, GzipFormat} {
+		clock := newFakeClock()
+		u := newFakeUploader(&AzblobConfig{
+			BlobType:           AppendBlob,
+			StoreAs:            storeAs,
+			PreserveOrder:      true,
+			BatchWait:          time.Hour,
+			BatchLimitSize:     5 * 1024 * 1024,
+			AppendBufferSize:   64 * 1024,
+			AppendBufferMaxAge: time.Second,
+		}, fs)
+		u.clock = clock
+		u.wg.Add(1)
+		go u.start()
+
+		// Padded records make batches of several append blocks, the others
+		// small batches which wait in the append buffer until it ages.
+		objectKey := "logs/app." + string(storeAs)
+		k := BatchKey{ObjectKeyFormat: objectKey}
+		for i := 0; i < 3000; i++ {
+			record := fmt.Sprintf(`{"n":%d}`, i)
+			if i%100 == 99 {
+				record = fmt.Sprintf(`{"n":%d,"pad":"%s"}`, i, strings.Repeat("x", 256*1024))
+			}
+			u.Entries <- Entry{Key: k, Time: clock.Now(), Raw: []byte(record)}
+			if i%250 == 249 {
+				clock.Tick(time.Second)
+			}
+		}
+		u.Stop()
+
+		blob := fs.Blob(objectKey)
+		assert.Greater(t, blob.blocks, 2, storeAs)
+		var r io.Reader = bytes.NewReader(blob.data)
+		if storeAs == GzipFormat {
+			r, _ = gzip.NewReader(r)
+		}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, AppendBlockSize)
+		n := 0
+		for ; scanner.Scan(); n++ {
+			var record struct{ N int }
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+			if record.N != n {
+				t.Fatalf("%s: record %d found at %d", storeAs, record.N, n)
+			}
+		}
+		assert.Equal(t, 3000, n, storeAs)
+	}
+}
+
+func TestClockSkewLimit(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		StoreAs:          PlainTextFormat,
+		UploadDateFormat: DefaultUploadDateFormat,
+		ClockSkewLimit:   time.Hour,
+	}, fs)
+	// the local clock is a year behind the storage service
+	clock := newFakeClock()
+	clock.now = time.Now().AddDate(-1, 0, 0)
+	u.clock = clock
+
+	record := clock.now.Add(-3 * time.Hour)
+	assert.Equal(t, clock.now.Add(-time.Hour), u.clampTime(record))
+
+	assert.Nil(t, u.upload(u.logger, u.containers[0], "skew.log", [][]byte{[]byte("a")}))
+	assert.WithinDuration(t, time.Now(), u.now(), 2*time.Second)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), u.clampTime(record), 2*time.Second)
+	assert.Equal(t, time.Now().UTC().Format(DefaultUploadDateFormat), u.uploadDate())
+
+	u.config.ClockSkewLimit = 0
+	assert.Equal(t, record, u.clampTime(record))
+}
+
+func TestFinalizeOnRollover(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:         AppendBlob,
+		StoreAs:          PlainTextFormat,
+		FinalizeMarker:   `{"eof":true}`,
+		FinalizeMetadata: true,
+	}, fs)
+
+	u.sendBatch(BatchKey{TimeSlice: "20200101", ObjectKeyFormat: "%{time_slice}.log"}, []byte("a\n"), Source{})
+	u.sendBatch(BatchKey{TimeSlice: "20200101", ObjectKeyFormat: "%{time_slice}.log"}, []byte("b\n"), Source{})
+	assert.Empty(t, fs.Blob("20200101.log").metadata)
+
+	u.sendBatch(BatchKey{TimeSlice: "20200102", ObjectKeyFormat: "%{time_slice}.log"}, []byte("c\n"), Source{})
+	assert.Equal(t, "a\nb\n{\"eof\":true}\n", string(fs.Blob("20200101.log").data))
+	assert.Equal(t, map[string]string{"finalized": "true"}, fs.Blob("20200101.log").metadata)
+	assert.Equal(t, "c\n", string(fs.Blob("20200102.log").data))
+	assert.Empty(t, fs.Blob("20200102.log").metadata)
+}
+
+func TestBlobCache(t *testing.T) {
+	c := newBlobCache(2)
+	c.Add("a", &blobState{part: 1})
+	c.Add("b", &blobState{part: 2})
+	c.Get("a")
+	c.Add("c", &blobState{part: 3})
+
+	_, ok := c.Get("b")
+	assert.False(t, ok)
+	state, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, state.part)
+	assert.Equal(t, 2, c.Len())
+
+	c.Remove("a")
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+}
+
+func TestUploadAppendBlobWithOpenBlobsLimit(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType:       AppendBlob,
+		StoreAs:        PlainTextFormat,
+		MaxBlobSize:    4,
+		OpenBlobsLimit: 1,
+	}, fs)
+
+	// an evicted blob continues with its last part
+	u.sendBatch(BatchKey{ObjectKeyFormat: "a.log"}, []byte("a1\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: "a.log"}, []byte("a2\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: "b.log"}, []byte("b1\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: "a.log"}, []byte("a3\n"), Source{})
+	assert.Equal(t, 1, u.blobs.Len())
+
+	assert.Equal(t, "a1\n", string(fs.Blob("a.log").data))
+	assert.Equal(t, "a2\n", string(fs.Blob("a-1.log").data))
+	assert.Equal(t, "a3\n", string(fs.Blob("a-2.log").data))
+	assert.Equal(t, "b1\n", string(fs.Blob("b.log").data))
+}
+
+func TestErrorContainer(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		StoreAs:        PlainTextFormat,
+		LevelKey:       "level",
+		LevelDefault:   "unknown",
+		ErrorContainer: "errors",
+		ErrorLevel:     "error",
+	}, fs)
+
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/info.log"},
+		[]byte(`{"level":"info"}`+"\n"+`{"level":"WARNING"}`+"\n"+`{"message":"level"}`+"\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/error.log"},
+		[]byte(`{"level":"info"}`+"\n"+`{"level":"ERR"}`+"\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/syslog.log"},
+		[]byte(`{"level":2}`+"\n"), Source{})
+
+	// every batch goes to the primary container, only the ones with errors
+	// to the error container too
+	assert.NotNil(t, fs.Blob("logs/info.log"))
+	assert.NotNil(t, fs.Blob("logs/error.log"))
+	assert.NotNil(t, fs.Blob("logs/syslog.log"))
+	assert.Nil(t, fs.Blob("account/errors/logs/info.log"))
+	assert.Equal(t, `{"level":"info"}`+"\n"+`{"level":"ERR"}`+"\n",
+		string(fs.Blob("account/errors/logs/error.log").data))
+	assert.NotNil(t, fs.Blob("account/errors/logs/syslog.log"))
+
+	// records without a level count as Level_Default
+	u.config.ErrorLevel = "warn"
+	u.config.LevelDefault = "warn"
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/plain.log"}, []byte("plain\n"), Source{})
+	assert.NotNil(t, fs.Blob("account/errors/logs/plain.log"))
+
+	// a failed mirror doesn't keep the batch from the primary container
+	fs.fail = func(r *http.Request) (int, string) {
+		if strings.HasPrefix(r.URL.Path, "/account/errors/") {
+			return http.StatusForbidden, "AuthorizationPermissionMismatch"
+		}
+		return 0, ""
+	}
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/denied.log"}, []byte(`{"level":"fatal"}`+"\n"), Source{})
+	assert.NotNil(t, fs.Blob("logs/denied.log"))
+
+	// nor does an error container which keeps failing, even with unlimited
+	// batch retries
+	u.config.BatchRetryLimit = nil
+	fs.fail = func(r *http.Request) (int, string) {
+		if strings.HasPrefix(r.URL.Path, "/account/errors/") {
+			return http.StatusTooManyRequests, "ServerBusy"
+		}
+		return 0, ""
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		u.sendBatch(BatchKey{ObjectKeyFormat: "logs/busy.log"}, []byte(`{"level":"fatal"}`+"\n"), Source{})
+	}()
+	assert.Eventually(t, func() bool { return fs.Blob("logs/busy.log") != nil }, time.Second, 10*time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("mirror retried past ErrorMirrorRetries")
+	}
+	assert.Nil(t, fs.Blob("account/errors/logs/busy.log"))
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Error_Container":       "errors",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, "errors", cfg.ErrorContainer)
+	assert.Equal(t, "error", cfg.ErrorLevel)
+
+	conf["Error_Level"] = "severe"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Error_Level: severe")
+
+	conf["Error_Level"] = "Warn"
+	conf["Error_Container"] = "Errors"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Error_Container: Errors")
+}
+
+func TestIndexTags(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	src := Source{Labels: map[string]string{"app": "shop", "tier": "<web>"}}
+	tags := `<?xml version="1.0" encoding="utf-8"?><Tags><TagSet>` +
+		`<Tag><Key>app</Key><Value>shop</Value></Tag>` +
+		`<Tag><Key>tier</Key><Value>&lt;web&gt;</Value></Tag></TagSet></Tags>`
+
+	u := newFakeUploader(&AzblobConfig{StoreAs: PlainTextFormat}, fs)
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/block.log"}, []byte("a\n"), src)
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/untagged.log"}, []byte("a\n"), Source{})
+	assert.Equal(t, tags, fs.Blob("logs/block.log").tags)
+	assert.Equal(t, 0, fs.Blob("logs/untagged.log").tagSets)
+
+	// append blobs are tagged again only when the tags change
+	u = newFakeUploader(&AzblobConfig{
+		BlobType:      AppendBlob,
+		StoreAs:       PlainTextFormat,
+		MaxBlobBlocks: 3,
+	}, fs)
+	k := BatchKey{ObjectKeyFormat: "logs/append.log"}
+	u.sendBatch(k, []byte("a\n"), src)
+	u.sendBatch(k, []byte("b\n"), src)
+	assert.Equal(t, 1, fs.Blob("logs/append.log").tagSets)
+	u.sendBatch(k, []byte("c\n"), Source{Labels: map[string]string{"app": "shop"}})
+	assert.Equal(t, 2, fs.Blob("logs/append.log").tagSets)
+	assert.Equal(t, `<?xml version="1.0" encoding="utf-8"?><Tags><TagSet>`+
+		`<Tag><Key>app</Key><Value>shop</Value></Tag></TagSet></Tags>`, fs.Blob("logs/append.log").tags)
+
+	// the next part is tagged of its own
+	u.sendBatch(k, []byte("d\n"), Source{Labels: map[string]string{"app": "shop"}})
+	assert.Equal(t, 1, fs.Blob("logs/append-1.log").tagSets)
+
+	// batches are tagged with the labels all their records have
+	assert.Equal(t, map[string]string{"app": "shop"},
+		src.merge(Source{Labels: map[string]string{"app": "shop", "tier": "db"}}).Labels)
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Index_Tag_Labels":      "app,app.kubernetes.io/instance,missing",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	o := &AzblobOperator{config: cfg}
+	s := o.source(map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{
+			"pod_name": []byte("shop-0"),
+			"labels": map[interface{}]interface{}{
+				"app":                        []byte("shop"),
+				"app.kubernetes.io/instance": []byte("shop#1" + strings.Repeat("x", 300)),
+				"type":                       []byte("ignored"),
+			},
+		},
+	}, "")
+	assert.Equal(t, "shop", s.Labels["app"])
+	assert.Equal(t, "shop_1"+strings.Repeat("x", 250), s.Labels["app.kubernetes.io/instance"])
+	assert.Len(t, s.Labels, 2)
+
+	conf["Index_Tag_Labels"] = "a,b,c,d,e,f,g,h,i,j,k"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "Index_Tag_Labels can have at most 10 labels")
+
+	conf["Index_Tag_Labels"] = "app,team!"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid label in Index_Tag_Labels: team!")
+}
+
+func TestIndexTagPlaceholders(t *testing.T) {
+	hostname := Hostname
+	defer func() { Hostname = hostname }()
+	Hostname = "node-1"
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Index_Tag_Labels":      "app",
+		"Index_Tags":            "origin:%{hostname}/%{tag}, workload:%{namespace}/%{deployment}, env:prod",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	logger, hook := logtest.NewNullLogger()
+	o := &AzblobOperator{config: cfg, logger: logger.WithField("test", true)}
+
+	r := map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{
+			"namespace_name": []byte("shop"),
+			"pod_name":       []byte("cart-7d9c8b6f5-x2k4p"),
+			"labels":         map[interface{}]interface{}{"app": []byte("cart")},
+		},
+	}
+	assert.Equal(t, map[string]string{
+		"app":      "cart",
+		"origin":   "node-1/kube.cart",
+		"workload": "shop/cart",
+		"env":      "prod",
+	}, o.source(r, "kube.cart").Labels)
+
+	// invalid characters are dropped, with one warning per value
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, "node-1/kube.cart_1", o.source(r, "kube.cart_#1").Labels["origin"])
+	}
+	assert.Len(t, hook.AllEntries(), 1)
+
+	// flat mode has no workload but the tag and hostname
+	o.config.Mode = FlatMode
+	assert.Equal(t, map[string]string{
+		"origin":   "node-1/app.log",
+		"workload": "/",
+		"env":      "prod",
+	}, o.source(r, "app.log").Labels)
+
+	for v, msg := range map[string]string{
+		"origin":              "invalid Index_Tags, expected name:value: origin",
+		"origin:%{pod}":       "invalid Index_Tags, unknown placeholder %{pod} in origin",
+		"a!:b":                "invalid Index_Tags, bad tag name: a!",
+		"a:b,a:c":             "invalid Index_Tags, a set twice",
+		"app:x":               "invalid Index_Tags, app is in Index_Tag_Labels too",
+		"a:1,b:2,c:3,d:4,e:5": "",
+	} {
+		conf["Index_Tags"] = v
+		_, err = NewConfig(conf)
+		if msg == "" {
+			assert.NoError(t, err, v)
+		} else {
+			assert.EqualError(t, err, msg, v)
+		}
+	}
+	conf["Index_Tags"] = "a:1,b:2,c:3,d:4,e:5,f:6,g:7,h:8,i:9,j:10"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "Index_Tag_Labels and Index_Tags can have at most 10 tags")
+}
+
+func TestDeadLetter(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+	fs.fail = func(r *http.Request) (int, string) {
+		switch r.URL.Path {
+		case "/account/container/logs/denied.log":
+			return http.StatusForbidden, "AuthorizationPermissionMismatch"
+		case "/account/container/logs/busy.log":
+			return http.StatusConflict, string(azblob.ServiceCodeContainerBeingDeleted)
+		}
+		return 0, ""
+	}
+
+	u := newFakeUploader(&AzblobConfig{
+		StoreAs:             PlainTextFormat,
+		DeadLetterContainer: "container",
+		DeadLetterPrefix:    "deadletter/",
+	}, fs)
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/denied.log"}, []byte("a\nb\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/busy.log"}, []byte("c\n"), Source{})
+
+	var names []string
+	fs.mu.Lock()
+	for name := range fs.blobs {
+		names = append(names, name)
+	}
+	fs.mu.Unlock()
+
+	// only the permanent failure is dead-lettered
+	assert.Len(t, names, 1)
+	assert.Regexp(t, "^deadletter/logs/denied\\.log\\.20200102T030405Z-[0-9a-f-]{36}$", names[0])
+	blob := fs.Blob(names[0])
+	assert.Equal(t, "a\nb\n", string(blob.data))
+	assert.Equal(t, "logs/denied.log", blob.metadata["object_key"])
+	assert.Equal(t, "AuthorizationPermissionMismatch", blob.metadata["error_code"])
+	assert.Equal(t, "2020-01-02T03:04:05Z", blob.metadata["failed_at"])
+	assert.Contains(t, blob.metadata["error"], "403")
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&u.dropped))
+
+	assert.Equal(t, "line one line two", metadataValue("line one\nline two\x00\xff"))
+	assert.Len(t, metadataValue(strings.Repeat("x", 2000)), 1024)
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Dead_Letter_Prefix":    "failed/",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, "testcontainer", cfg.DeadLetterContainer)
+	assert.Equal(t, "failed/", cfg.DeadLetterPrefix)
+
+	delete(conf, "Dead_Letter_Prefix")
+	conf["Dead_Letter_Container"] = "deadletters"
+	cfg, _ = NewConfig(conf)
+	assert.Equal(t, "deadletters", cfg.DeadLetterContainer)
+	assert.Equal(t, DefaultDeadLetterPrefix, cfg.DeadLetterPrefix)
+
+	conf["Dead_Letter_Container"] = "Dead_Letters"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Dead_Letter_Container: Dead_Letters")
+}
+
+func TestFlushCode(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+	fs.fail = func(r *http.Request) (int, string) {
+		return http.StatusForbidden, "AuthenticationFailed"
+	}
+
+	u := newFakeUploader(&AzblobConfig{
+		StoreAs:   PlainTextFormat,
+		BatchWait: time.Minute,
+	}, fs)
+	clock := newFakeClock()
+	u.clock = clock
+
+	// permanent errors aren't retried
+	attempts := uint64(3)
+	count := 0
+	err := retry(&attempts, func() error {
+		count++
+		return u.upload(u.logger, u.containers[0], "denied.log", [][]byte{[]byte("a")})
+	})
+	assert.Equal(t, 1, count)
+	assert.True(t, isPermanent(err))
+
+	assert.Equal(t, output.FLB_OK, flushCode(nil))
+	assert.Equal(t, output.FLB_ERROR, flushCode(err))
+	assert.Equal(t, output.FLB_ERROR, flushCode(permanentError{errors.New("encode")}))
+	assert.Equal(t, output.FLB_RETRY, flushCode(&RESTError{StatusCode: http.StatusServiceUnavailable}))
+	assert.Equal(t, output.FLB_RETRY, flushCode(&RESTError{StatusCode: http.StatusTooManyRequests}))
+	assert.Equal(t, output.FLB_RETRY, flushCode(errors.New("connection reset")))
+
+	// a lost batch is reported until the next batch is delivered, and
+	// rejects flushes except for one probe per BatchWait; a rejected chunk
+	// is always retried, as it wasn't tried itself
+	o := &AzblobOperator{uploader: u, logger: u.logger}
+	assert.Nil(t, u.Err())
+	assert.Equal(t, output.FLB_OK, o.admitFlush())
+	u.sendBatch(BatchKey{ObjectKeyFormat: "denied.log"}, []byte("a\n"), Source{})
+	assert.Equal(t, "AuthenticationFailed", errorCode(u.Err()))
+	assert.Equal(t, output.FLB_RETRY, o.admitFlush())
+
+	clock.now = clock.now.Add(time.Minute)
+	assert.Error(t, u.Err())
+	assert.Equal(t, output.FLB_OK, o.admitFlush())
+	assert.Equal(t, output.FLB_RETRY, o.admitFlush())
+	assert.Error(t, u.Err())
+
+	fs.fail = nil
+	u.sendBatch(BatchKey{ObjectKeyFormat: "allowed.log"}, []byte("a\n"), Source{})
+	assert.Nil(t, u.Err())
+	assert.Equal(t, output.FLB_OK, o.admitFlush())
+}
+
+func TestSource(t *testing.T) {
+	o := &AzblobOperator{config: &AzblobConfig{Mode: KubernetesMode}}
+	r := map[interface{}]interface{}{
+		"log": "hello",
+		"kubernetes": map[interface{}]interface{}{
+			"namespace_name": []byte("shop"),
+			"pod_name":       []byte("web-5d9c8b7f94-x2lpq"),
+			"container_name": []byte("nginx"),
+		},
+	}
+	assert.Equal(t, Source{
+		Namespace:  "shop",
+		Pod:        "web-5d9c8b7f94-x2lpq",
+		Container:  "nginx",
+		Deployment: "web",
+	}, o.source(r, ""))
+	assert.Equal(t, Source{}, o.source(map[interface{}]interface{}{"log": "hello"}, ""))
+
+	o.config.Mode = FlatMode
+	assert.Equal(t, Source{}, o.source(r, ""))
+
+	for pod, deployment := range map[string]string{
+		"api-server-7f9c6d5b8-k2x9z": "api-server",
+		"db-0":                       "",
+		"fluent-bit-x2lpq":           "",
+		"web-5D9C8B7F94-x2lpq":       "",
+		"-5d9c8b7f94-x2lpq":          "",
+	} {
+		assert.Equal(t, deployment, deploymentName(pod), pod)
+	}
+
+	a := Source{Namespace: "shop", Pod: "web-1", Container: "nginx", Deployment: "web"}
+	b := Source{Namespace: "shop", Pod: "web-2", Container: "nginx", Deployment: "web"}
+	assert.Equal(t, Source{Namespace: "shop", Container: "nginx", Deployment: "web"}, a.merge(b))
+}
+
+func TestKubernetesFlatPrefix(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":                  "testcontainer",
+		"Azure_Storage_Account":            "testaccount",
+		"Azure_Storage_SAS":                "sas",
+		"Azure_Object_Key_Format":          "%{namespace}/%{deployment}/%{image}/%{time_slice}.log",
+		"Azure_Fallback_Object_Key_Format": "host/%{time_slice}.log",
+		"Batch_Key_Fields":                 "time_slice,image",
+		"Kubernetes_Flat_Prefix":           "kubernetes_",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, "kubernetes_", cfg.KubernetesPrefix)
+	o := &AzblobOperator{config: cfg}
+
+	r := map[interface{}]interface{}{
+		"log":                        "hello",
+		"kubernetes_namespace_name":  []byte("shop"),
+		"kubernetes_pod_name":        []byte("web-5d9c8b7f94-x2lpq"),
+		"kubernetes_container_name":  []byte("nginx"),
+		"kubernetes_container_image": []byte("nginx:1.25"),
+		"kubernetes_labels":          map[interface{}]interface{}{"app": "web"},
+	}
+	assert.Equal(t, Source{
+		Namespace:  "shop",
+		Pod:        "web-5d9c8b7f94-x2lpq",
+		Container:  "nginx",
+		Deployment: "web",
+	}, o.source(r, ""))
+
+	k := o.batchKey(r, "slice", "tag")
+	assert.Equal(t, "shop/web/%{image}/%{time_slice}.log", k.ObjectKeyFormat)
+	assert.Equal(t, "nginx_1.25", k.Image)
+
+	// the nested metadata isn't looked at anymore
+	nested := map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{"pod_name": []byte("web-1")},
+	}
+	assert.Equal(t, Source{}, o.source(nested, ""))
+	assert.Equal(t, "host/%{time_slice}.log", o.batchKey(nested, "slice", "tag").ObjectKeyFormat)
+
+	o.config.Format = LogAnalyticsFormat
+	b, err := o.encodeRecord(r, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		assert.Fail(t, "encodeRecord fails: %v", err)
+	}
+	result := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(b, &result))
+	assert.Equal(t, "web-5d9c8b7f94-x2lpq", result["PodName"])
+	assert.Equal(t, "shop", result["PodNamespace"])
+	assert.Equal(t, map[string]interface{}{
+		"namespace_name":  "shop",
+		"pod_name":        "web-5d9c8b7f94-x2lpq",
+		"container_name":  "nginx",
+		"container_image": "nginx:1.25",
+		"labels":          map[string]interface{}{"app": "web"},
+	}, result["KubernetesMetadata"])
+	assert.NotContains(t, result, "kubernetes_pod_name")
+
+	conf["Mode"] = "flat"
+	delete(conf, "Azure_Object_Key_Format")
+	delete(conf, "Azure_Fallback_Object_Key_Format")
+	delete(conf, "Batch_Key_Fields")
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "cannot specify Kubernetes_Flat_Prefix with Mode flat")
+}
+
+func TestUploadErrorContext(t *testing.T) {
+	fs := newFakeStorage()
+	defer fs.Close()
+	fs.fail = func(r *http.Request) (int, string) {
+		return http.StatusForbidden, "AuthenticationFailed"
+	}
+
+	for _, blobType := range []BlobType{AppendBlob, BlockBlob} {
+		u := newFakeUploader(&AzblobConfig{
+			BlobType: blobType,
+			StoreAs:  PlainTextFormat,
+		}, fs)
+		hook := logtest.NewLocal(u.logger.Logger)
+
+		src := Source{Namespace: "shop", Pod: "web-5d9c8b7f94-x2lpq", Deployment: "web"}
+		u.sendBatch(BatchKey{ObjectKeyFormat: "logs/app.log"}, []byte("a\n"), src)
+
+		errs := 0
+		for _, e := range hook.AllEntries() {
+			if e.Level != logrus.ErrorLevel {
+				continue
+			}
+			errs++
+			assert.Equal(t, "shop", e.Data["namespace"], e.Message)
+			assert.Equal(t, "web-5d9c8b7f94-x2lpq", e.Data["pod"], e.Message)
+			assert.Equal(t, "web", e.Data["deployment"], e.Message)
+			assert.Equal(t, "logs/app.log", e.Data["object_key"], e.Message)
+			assert.NotContains(t, e.Data, "container", e.Message)
+		}
+		// the failed request and the dropped batch
+		assert.True(t, errs >= 2, string(blobType))
+	}
+}
+
+func TestMaxDeliveryAttempts(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Max_Delivery_Attempts": "2",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, uint64(1), *cfg.BatchRetryLimit)
+
+	conf["Batch_Retry_Limit"] = "3"
+	_, err = NewConfig(conf)
+	assert.Error(t, err)
+
+	delete(conf, "Batch_Retry_Limit")
+	conf["Max_Delivery_Attempts"] = "0"
+	_, err = NewConfig(conf)
+	assert.Error(t, err)
+
+	fs := newFakeStorage()
+	defer fs.Close()
+	attempts := 0
+	fs.fail = func(r *http.Request) (int, string) {
+		attempts++
+		return http.StatusTooManyRequests, ""
+	}
+
+	u := newFakeUploader(&AzblobConfig{
+		StoreAs:   PlainTextFormat,
+		BatchWait: time.Minute,
+	}, fs)
+	u.config.BatchRetryLimit = cfg.BatchRetryLimit
+	u.sendBatch(BatchKey{ObjectKeyFormat: "busy.log"}, []byte("a\n"), Source{})
+
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&u.dropped))
+	assert.Error(t, u.Err())
+}
+
+func TestHeartbeat(t *testing.T) {
+	hostname := Hostname
+	defer func() { Hostname = hostname }()
+	Hostname = "node-1"
+
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BatchWait:          time.Hour,
+		HeartbeatInterval:  time.Minute,
+		HeartbeatKeyFormat: DefaultHeartbeatKey,
+	}, fs)
+	clock := u.clock.(*fakeClock)
+	u.wg.Add(1)
+	go u.start()
+	defer u.Stop()
+
+	clock.Tick(time.Minute)
+	assert.Eventually(t, func() bool {
+		return fs.Blob("heartbeat/node-1.json") != nil
+	}, time.Second, 10*time.Millisecond)
+
+	result := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(fs.Blob("heartbeat/node-1.json").data, &result))
+	assert.Equal(t, "node-1", result["hostname"])
+	assert.Equal(t, clock.Now().Format(time.RFC3339), result["time"])
+}
+
+func TestUploadedNewlines(t *testing.T) {
+	for _, blobType := range []BlobType{BlockBlob, AppendBlob} {
+		fs := newFakeStorage()
+
+		u := newFakeUploader(&AzblobConfig{
+			BlobType:       blobType,
+			StoreAs:        PlainTextFormat,
+			BatchWait:      time.Hour,
+			BatchLimitSize: DefaultBatchLimitSize,
+		}, fs)
+		clock := u.clock.(*fakeClock)
+		u.wg.Add(1)
+		go u.start()
+
+		key := BatchKey{ObjectKeyFormat: "app.log"}
+		u.Entries <- Entry{Key: key, Raw: []byte(`{"log":"a"}`)}
+		u.Entries <- Entry{Key: key, Raw: []byte(`{"log":"b"}`)}
+		if blobType == AppendBlob {
+			// a second batch appended to the same blob
+			clock.Tick(time.Hour)
+			assert.Eventually(t, func() bool {
+				return fs.Blob("app.log") != nil
+			}, time.Second, 10*time.Millisecond)
+		}
+		u.Entries <- Entry{Key: key, Raw: []byte(`{"log":"c"}`)}
+		u.Stop()
+
+		assert.Equal(t, "{\"log\":\"a\"}\n{\"log\":\"b\"}\n{\"log\":\"c\"}\n",
+			string(fs.Blob("app.log").data), "blob type %s", blobType)
+		fs.Close()
+	}
+}
+
+func TestFLBPluginExit(t *testing.T) {
+	c, _ := NewConfig(&mockConfig{})
+	o, _ := NewOperator(0, c)
+	operators = append(operators, o)
+
+	ret := FLBPluginExit()
+	assert.Equal(t, 1, ret)
+}
+
+func TestRetry(t *testing.T) {
+	attempts := uint64(3)
+	count := uint64(0)
+
+	err := retry(&attempts, func() error {
+		count = count + 1
+		return errors.New("test")
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, attempts+1, count)
+
+}
+
+func TestSendRecord(t *testing.T) {
+	c, _ := NewConfig(&mockConfig{})
+	o, _ := NewOperator(0, c)
+
+	record := make(map[interface{}]interface{})
+	record["key"] = "value"
+	err := o.SendRecord(record, time.Now(), "test")
+	assert.Nil(t, err)
+
+	o = nil
+}
+
+func TestEnsureContainer(t *testing.T) {
+	l := NewLogger("testing", logrus.TraceLevel)
+	c, _ := NewConfig(&mockConfig{})
+	u, _ := NewUploader(c, l)
+	err := u.ensureContainer(context.Background(), u.containers[0])
+	assert.Nil(t, err)
+}
+
+func TestUpload(t *testing.T) {
+	l := NewLogger("testing", logrus.TraceLevel)
+	c, _ := NewConfig(&mockConfig{})
+	u, _ := NewUploader(c, l)
+
+	err := u.upload(u.logger, u.containers[0], "testing", [][]byte{[]byte(`{"key":"value"}`)})
+	assert.Nil(t, err)
+}
+
+// envConfig returns the config of conf with the environment variable env set
+// to v.
+func envConfig(t *testing.T, conf mapConfig, env, v string) *AzblobConfig {
+	defer os.Unsetenv(env)
+
+	os.Setenv(env, v)
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		t.Fatalf("NewConfig with %s=%s fails: %v", env, v, err)
+	}
+
+	return cfg
+}
+
+func TestConfigEnvDefaults(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sv=account",
+	}
+
+	assert.True(t, envConfig(t, conf, "AZBLOB_PRESERVE_ORDER", "true").PreserveOrder)
+
+	cfg := envConfig(t, mapConfig{
+		"Azure_Container":   "testcontainer",
+		"Azure_Storage_SAS": "sv=account",
+	}, "AZBLOB_STORAGE_ACCOUNTS", "primary,secondary")
+	if assert.Len(t, cfg.ContainerURLs, 2) {
+		assert.Equal(t, "secondary.blob.core.windows.net", cfg.ContainerURLs[1].URL().Host)
+	}
+	// the config wins over the environment
+	cfg = envConfig(t, conf, "AZBLOB_STORAGE_ACCOUNTS", "primary,secondary")
+	assert.Len(t, cfg.ContainerURLs, 1)
+
+	cfg = envConfig(t, conf, "AZBLOB_FALLBACK_KEY_FORMAT", "host/%{time_slice}.log")
+	assert.Equal(t, "host/%{time_slice}.log", cfg.FallbackObjectKeyFormat)
+
+	cfg = envConfig(t, mapConfig{
+		"Azure_Container":   "testcontainer",
+		"Azure_Storage_SAS": "sv=account",
+	}, "AZBLOB_SERVICE_URL", "https://logs.example.com")
+	if assert.Len(t, cfg.ContainerURLs, 1) {
+		assert.Equal(t, "logs.example.com", cfg.ContainerURLs[0].URL().Host)
+	}
+
+	cfg = envConfig(t, conf, "AZBLOB_MAX_BATCH_AGE", "90")
+	assert.Equal(t, 90*time.Second, cfg.BatchMaxAge)
+
+	assert.True(t, envConfig(t, conf, "AZBLOB_PRESERVE_RAW", "true").PreserveRaw)
+
+	cfg = envConfig(t, conf, "AZBLOB_SPOOL_DIR", "/var/spool/azblob")
+	assert.Equal(t, "/var/spool/azblob", cfg.SpoolDir)
+
+	conf["Blob_Type"] = "append"
+	cfg = envConfig(t, conf, "AZBLOB_MAX_BLOB_BYTES", "1MB")
+	assert.Equal(t, uint64(1024*1024), cfg.MaxBlobSize)
+
+	assert.True(t, envConfig(t, conf, "AZBLOB_MISSING_MESSAGE", "skip").SkipMissingMessage)
+}
+
+func TestResolveHostname(t *testing.T) {
+	defer os.Unsetenv("AZBLOB_HOSTNAME")
+	defer os.Unsetenv("NODE_NAME")
+
+	os.Setenv("AZBLOB_HOSTNAME", "override")
+	os.Setenv("NODE_NAME", "node")
+	h, source := resolveHostname()
+	assert.Equal(t, "override", h)
+	assert.Equal(t, "AZBLOB_HOSTNAME", source)
+
+	os.Unsetenv("AZBLOB_HOSTNAME")
+	h, source = resolveHostname()
+	assert.Equal(t, "node", h)
+	assert.Equal(t, "NODE_NAME", source)
+
+	os.Unsetenv("NODE_NAME")
+	h, source = resolveHostname()
+	expected, _ := os.Hostname()
+	assert.Equal(t, expected, h)
+	assert.Equal(t, "os.Hostname", source)
+}
+
+func TestInstanceID(t *testing.T) {
+	defer os.Unsetenv("AZBLOB_INSTANCE_ID")
+	defer os.Unsetenv("POD_NAME")
+
+	os.Setenv("AZBLOB_INSTANCE_ID", "replica-a")
+	os.Setenv("POD_NAME", "fluent-bit-x2lpq")
+	id, source := resolveInstanceID()
+	assert.Equal(t, "replica-a", id)
+	assert.Equal(t, "AZBLOB_INSTANCE_ID", source)
+
+	os.Unsetenv("AZBLOB_INSTANCE_ID")
+	id, source = resolveInstanceID()
+	assert.Equal(t, "fluent-bit-x2lpq", id)
+	assert.Equal(t, "POD_NAME", source)
+
+	os.Unsetenv("POD_NAME")
+	id, source = resolveInstanceID()
+	assert.Regexp(t, "^[0-9a-f-]{36}$", id)
+	assert.Equal(t, "uuid", source)
+
+	instanceID := InstanceID
+	defer func() { InstanceID = instanceID }()
+	InstanceID = "fluent-bit-x2lpq"
+
+	format, err := normalizeKeyFormat("%{instance_id}/%{time_slice}.log")
+	assert.NoError(t, err)
+	u := &AzblobUploader{config: &AzblobConfig{}, clock: newFakeClock()}
+	assert.Equal(t, "fluent-bit-x2lpq/2020010203.log",
+		u.objectKey(BatchKey{ObjectKeyFormat: format, TimeSlice: "2020010203"}))
+}
+
+func TestNormalizeKeyFormat(t *testing.T) {
+	for format, want := range map[string]string{
+		"%{path}%{time_slice}_%{uuid}.%{file_extension}": "%{path}%{time_slice}_%{uuid}.%{file_extension}",
+		"%{ Tag }/%{TIME_SLICE}.log":                     "%{tag}/%{time_slice}.log",
+		"%{Record.kubernetes.Pod_Name}.log":              "%{record.kubernetes.Pod_Name}.log",
+		"logs/100%/app.log":                              "logs/100%/app.log",
+		"logs/app-%{part}.log":                           "logs/app-%{part}.log",
+	} {
+		got, err := normalizeKeyFormat(format)
+		assert.Nil(t, err, format)
+		assert.Equal(t, want, got)
+	}
+
+	_, err := normalizeKeyFormat("%{path}%{time_slce}.log")
+	assert.EqualError(t, err, "unknown placeholder %{time_slce} in object key format: %{path}%{time_slce}.log, "+
+		"valid are %{path}, %{time_slice}, %{upload_date}, %{uuid}, %{hostname}, %{instance_id}, %{file_extension}, "+
+		"%{route}, %{tag}, %{level}, %{hash}, %{part}, %{namespace}, %{pod}, %{container}, %{deployment}, %{image} "+
+		"and %{record.<key>}")
+
+	for _, format := range []string{"%{record.}.log", "%{}.log"} {
+		_, err = normalizeKeyFormat(format)
+		assert.Error(t, err, format)
+	}
+	_, err = normalizeKeyFormat("%{tag}/%{time_slice.log")
+	assert.EqualError(t, err, "unclosed placeholder in object key format: %{tag}/%{time_slice.log")
+
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":                  "testcontainer",
+		"Azure_Storage_Account":            "testaccount",
+		"Azure_Storage_SAS":                "sas",
+		"Azure_Fallback_Object_Key_Format": "host/%{hostnme}.log",
+	})
+	assert.Error(t, err)
+}
+
+func TestWorkloadPlaceholders(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":         "testcontainer",
+		"Azure_Storage_Account":   "testaccount",
+		"Azure_Storage_SAS":       "sas",
+		"Azure_Object_Key_Format": "%{deployment}/%{Namespace}/%{pod}_%{container}/%{time_slice}.log",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	o := &AzblobOperator{config: cfg}
+
+	r := map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{
+			"namespace_name": []byte("shop"),
+			"pod_name":       []byte("web-5d9c8b7f94-x2lpq"),
+			"container_name": []byte("nginx"),
+		},
+	}
+	k := o.batchKey(r, "2020010203-04", "kube.app")
+	assert.Equal(t, "web/shop/web-5d9c8b7f94-x2lpq_nginx/%{time_slice}.log", k.ObjectKeyFormat)
+
+	// the namespace is only in the path when the format has it
+	r = map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{
+			"pod_name": []byte("db-0"),
+		},
+	}
+	k = o.batchKey(r, "2020010203-04", "kube.app")
+	assert.Equal(t, "unknown/unknown/db-0_unknown/%{time_slice}.log", k.ObjectKeyFormat)
+
+	conf["Mode"] = "flat"
+	conf["StoreAs"] = "text"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "Mode flat doesn't support Kubernetes placeholders in object key format: "+
+		"%{deployment}/%{namespace}/%{pod}_%{container}/%{time_slice}.log")
+}
+
+func TestSchema(t *testing.T) {
+	compile := func(schema string) (*Schema, error) {
+		var v interface{}
+		if err := json.Unmarshal([]byte(schema), &v); err != nil {
+			assert.Fail(t, "unmarshal schema fails: %v", err)
+		}
+		return compileSchema(v, "#")
+	}
+
+	for _, schema := range []string{
+		`[]`,
+		`{"type": "text"}`,
+		`{"type": 1}`,
+		`{"required": "message"}`,
+		`{"properties": {"level": {"pattern": "("}}}`,
+		`{"properties": {"message": {"minLength": -1}}}`,
+	} {
+		_, err := compile(schema)
+		assert.Error(t, err, schema)
+	}
+
+	s, err := compile(`{
+		"type": "object",
+		"required": ["message", "level"],
+		"additionalProperties": false,
+		"properties": {
+			"message": {"type": "string", "minLength": 1},
+			"level": {"enum": ["debug", "info", "error"]},
+			"code": {"type": "integer", "minimum": 100, "maximum": 599},
+			"trace": {"type": "string", "pattern": "^[0-9a-f]{8}$"},
+			"kubernetes": {
+				"type": "object",
+				"additionalProperties": {"type": "string"}
+			},
+			"tags": {"type": "array", "items": {"type": "string"}}
+		}
+	}`)
+	if err != nil {
+		assert.Fail(t, "compileSchema fails: %v", err)
+	}
+
+	for _, tc := range []struct {
+		r   map[interface{}]interface{}
+		err string
+	}{
+		{map[interface{}]interface{}{
+			"message":    []byte("hello"),
+			"level":      []byte("info"),
+			"code":       int64(200),
+			"trace":      "0123abcd",
+			"kubernetes": map[interface{}]interface{}{"pod_name": []byte("web-0")},
+			"tags":       []interface{}{[]byte("a"), "b"},
+		}, ""},
+		{map[interface{}]interface{}{"message": "hello"}, "level: is required"},
+		{map[interface{}]interface{}{"message": "", "level": "info"}, "message: shorter than 1"},
+		{map[interface{}]interface{}{"message": 1, "level": "info"}, "message: must be string"},
+		{map[interface{}]interface{}{"message": "hello", "level": "warn"}, "level: not an allowed value"},
+		{map[interface{}]interface{}{"message": "hello", "level": "info", "code": 99}, "code: less than 100"},
+		{map[interface{}]interface{}{"message": "hello", "level": "info", "code": 200.5}, "code: must be integer"},
+		{map[interface{}]interface{}{"message": "hello", "level": "info", "trace": "xyz"},
+			"trace: doesn't match ^[0-9a-f]{8}$"},
+		{map[interface{}]interface{}{"message": "hello", "level": "info", "host": "a"}, "host: is not allowed"},
+		{map[interface{}]interface{}{
+			"message":    "hello",
+			"level":      "info",
+			"kubernetes": map[interface{}]interface{}{"labels": map[interface{}]interface{}{}},
+		}, "kubernetes.labels: must be string"},
+		{map[interface{}]interface{}{
+			"message": "hello",
+			"level":   "info",
+			"tags":    []interface{}{"a", 1},
+		}, "tags[1]: must be string"},
+	} {
+		err := s.Validate(tc.r)
+		if tc.err == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, tc.err)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "azblob-schema")
+	if err != nil {
+		assert.Fail(t, "create schema file fails: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"required": ["message"]}`)
+	f.Close()
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"JSON_Schema_File":      f.Name(),
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, "invalid/", cfg.InvalidRecordPrefix)
+
+	entries := make(chan Entry, 2)
+	o := &AzblobOperator{
+		config:   cfg,
+		logger:   NewLogger("testing", logrus.TraceLevel),
+		uploader: &AzblobUploader{config: cfg, Entries: entries},
+	}
+	o.SendRecord(map[interface{}]interface{}{"message": "hello"}, time.Now(), "test")
+	o.SendRecord(map[interface{}]interface{}{"log": "hello"}, time.Now(), "test")
+	assert.Equal(t, cfg.ObjectKeyFormat, (<-entries).Key.ObjectKeyFormat)
+	assert.Equal(t, "invalid/"+cfg.ObjectKeyFormat, (<-entries).Key.ObjectKeyFormat)
+	assert.Equal(t, uint64(1), o.invalid)
+
+	conf["JSON_Schema_File"] = f.Name() + ".missing"
+	_, err = NewConfig(conf)
+	assert.Error(t, err)
+}
+
+func TestImagePlaceholder(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":         "testcontainer",
+		"Azure_Storage_Account":   "testaccount",
+		"Azure_Storage_SAS":       "sas",
+		"Azure_Object_Key_Format": "%{image}/%{time_slice}.log",
+	}
+	_, err := NewConfig(conf)
+	assert.EqualError(t, err,
+		"object key format %{image}/%{time_slice}.log uses %{image}, which is not in Batch_Key_Fields")
+
+	conf["Batch_Key_Fields"] = "time_slice,image"
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	o := &AzblobOperator{config: cfg}
+
+	for image, expected := range map[string]string{
+		"docker.io/library/nginx:1.19":            "docker.io_library_nginx_1.19",
+		"gcr.io/app@sha256:0123abcd":              "gcr.io_app_sha256_0123abcd",
+		"registry.example.com:5000/team/app:v1.2": "registry.example.com_5000_team_app_v1.2",
+	} {
+		r := map[interface{}]interface{}{
+			"kubernetes": map[interface{}]interface{}{
+				"container_image": []byte(image),
+			},
+		}
+		k := o.batchKey(r, "2020010203", "kube.app")
+		assert.Equal(t, expected, k.Image)
+	}
+
+	// records without the image are batched together
+	k := o.batchKey(map[interface{}]interface{}{}, "2020010203", "kube.app")
+	assert.Equal(t, "unknown", k.Image)
+
+	u := &AzblobUploader{config: cfg}
+	k = BatchKey{TimeSlice: "2020010203", ObjectKeyFormat: cfg.ObjectKeyFormat, Image: "nginx_1.19"}
+	assert.Equal(t, "nginx_1.19/2020010203.log", u.objectKey(k))
+
+	conf["Mode"] = "flat"
+	conf["StoreAs"] = "text"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "Mode flat doesn't support the batch key field image")
+}
+
+func TestContainerKey(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "shared",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Container_Key":         "kubernetes.cluster",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	o := &AzblobOperator{config: cfg, logger: NewLogger("testing", logrus.TraceLevel)}
+
+	for cluster, expected := range map[string]string{
+		"prod-eu":    "prod-eu",
+		"Prod_US":    "prod-us",
+		"shared":     "",
+		"$logs":      "",
+		"__":         "",
+		"":           "",
+		"prod-eu-1":  "prod-eu-1",
+		"Staging.AP": "staging-ap",
+	} {
+		r := map[interface{}]interface{}{
+			"kubernetes": map[interface{}]interface{}{"cluster": []byte(cluster)},
+		}
+		assert.Equal(t, expected, o.batchKey(r, "2020010203", "kube.app").Container, cluster)
+	}
+	assert.Empty(t, o.batchKey(map[interface{}]interface{}{}, "2020010203", "kube.app").Container)
+
+	conf["Container_Name_Policy"] = "strict"
+	cfg, _ = NewConfig(conf)
+	o = &AzblobOperator{config: cfg, logger: NewLogger("testing", logrus.TraceLevel)}
+	r := map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{"cluster": "Prod_US"},
+	}
+	assert.Empty(t, o.batchKey(r, "2020010203", "kube.app").Container)
+
+	conf["Mode"] = "flat"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "cannot specify Container_Key with Mode flat")
+
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u := newFakeUploader(&AzblobConfig{
+		BlobType: AppendBlob,
+		StoreAs:  PlainTextFormat,
+	}, fs)
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/app.log", Container: "prod-eu"}, []byte("a\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/app.log", Container: "prod-us"}, []byte("b\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/app.log"}, []byte("c\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: "logs/app.log", Container: "prod-eu"}, []byte("d\n"), Source{})
+	assert.Equal(t, "a\nd\n", string(fs.Blob("account/prod-eu/logs/app.log").data))
+	assert.Equal(t, "b\n", string(fs.Blob("account/prod-us/logs/app.log").data))
+	assert.Equal(t, "c\n", string(fs.Blob("logs/app.log").data))
+}
+
+func TestRoutes(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":         "shared",
+		"Azure_Storage_Account":   "testaccount",
+		"Azure_Storage_SAS":       "sas",
+		"Azure_Object_Key_Format": "%{namespace}/%{time_slice}.log",
+		"Routes": "namespace=prod-* label.tier=db -> prod-db:prod/%{namespace}/%{time_slice}.log," +
+			"namespace=prod-* -> prod:, tag=audit.* -> :audit/%{namespace}.log, record.team=ops -> shared:ops.log",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	o := &AzblobOperator{config: cfg, logger: NewLogger("testing", logrus.TraceLevel)}
+
+	record := func(namespace string, labels map[interface{}]interface{}) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			"kubernetes": map[interface{}]interface{}{
+				"namespace_name": namespace,
+				"labels":         labels,
+			},
+		}
+	}
+
+	// the first matching route wins
+	k := o.batchKey(record("prod-eu", map[interface{}]interface{}{"tier": "db"}), "2020010203", "kube.app")
+	assert.Equal(t, "prod-db", k.Container)
+	assert.Equal(t, "prod/prod-eu/%{time_slice}.log", k.ObjectKeyFormat)
+
+	k = o.batchKey(record("prod-eu", map[interface{}]interface{}{"tier": "web"}), "2020010203", "kube.app")
+	assert.Equal(t, "prod", k.Container)
+	assert.Equal(t, "prod-eu/%{time_slice}.log", k.ObjectKeyFormat)
+
+	// a record without the field doesn't match
+	k = o.batchKey(record("prod-eu", nil), "2020010203", "kube.app")
+	assert.Equal(t, "prod", k.Container)
+
+	k = o.batchKey(record("dev", nil), "2020010203", "audit.api")
+	assert.Empty(t, k.Container)
+	assert.Equal(t, "audit/dev.log", k.ObjectKeyFormat)
+
+	k = o.batchKey(map[interface{}]interface{}{"team": "ops"}, "2020010203", "kube.app")
+	assert.Empty(t, k.Container)
+	assert.Equal(t, "ops.log", k.ObjectKeyFormat)
+
+	k = o.batchKey(record("dev", nil), "2020010203", "kube.app")
+	assert.Empty(t, k.Container)
+	assert.Equal(t, "dev/%{time_slice}.log", k.ObjectKeyFormat)
+
+	// the route container takes precedence over Container_Key
+	conf["Container_Key"] = "kubernetes.cluster"
+	cfg, _ = NewConfig(conf)
+	o = &AzblobOperator{config: cfg, logger: NewLogger("testing", logrus.TraceLevel)}
+	r := record("prod-eu", nil)
+	r["kubernetes"].(map[interface{}]interface{})["cluster"] = "europe"
+	assert.Equal(t, "prod", o.batchKey(r, "2020010203", "kube.app").Container)
+	r["kubernetes"].(map[interface{}]interface{})["namespace_name"] = "dev"
+	assert.Equal(t, "europe", o.batchKey(r, "2020010203", "kube.app").Container)
+	delete(conf, "Container_Key")
+
+	for routes, expected := range map[string]string{
+		"namespace=prod prod:":       "invalid Routes, expected conditions -> container:format: namespace=prod prod:",
+		"namespace=prod -> prod":     "invalid Routes, expected conditions -> container:format: namespace=prod -> prod",
+		"prod -> prod:":              "invalid Routes, expected field=pattern: prod",
+		"pod=app -> prod:":           "invalid Routes, unknown field: pod",
+		"namespace=[ -> prod:":       "invalid Routes, bad pattern: [",
+		"namespace=prod -> Prod_EU:": "invalid Routes, bad container name: Prod_EU",
+		"namespace=prod -> :":        "invalid Routes, expected a container or a format: namespace=prod -> :",
+		"namespace=prod -> :%{nope}.log": "unknown placeholder %{nope} in object key format: %{nope}.log, valid are %{" +
+			strings.Join(KeyPlaceholders, "}, %{") + "} and %{record.<key>}",
+	} {
+		conf["Routes"] = routes
+		_, err = NewConfig(conf)
+		assert.EqualError(t, err, expected, routes)
+	}
+
+	conf["Routes"] = "-> :%{namespace}.log"
+	conf["Blob_Type"] = "unique"
+	conf["Azure_Object_Key_Format"] = "%{uuid}.log"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "Blob_Type unique requires %{uuid} in object key format: %{namespace}.log")
+	delete(conf, "Blob_Type")
+
+	conf["Mode"] = "flat"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "cannot specify Routes with Mode flat")
+}
+
+func TestShortenKey(t *testing.T) {
+	u := &AzblobUploader{logger: NewLogger("testing", logrus.TraceLevel)}
+
+	assert.Equal(t, "logs/app/2020010203.log", u.shortenKey("logs/app/2020010203.log"))
+
+	pod := strings.Repeat("p", 1200)
+	key := "logs/" + pod + "/2020010203.log.gz"
+	short := u.shortenKey(key)
+	assert.Len(t, short, MaxKeyLength-KeySuffixRoom)
+	assert.True(t, strings.HasPrefix(short, "logs/ppp"), short)
+	assert.True(t, strings.HasSuffix(short, "/2020010203.log.gz"), short)
+	assert.Equal(t, short, u.shortenKey(key))
+	assert.NotEqual(t, short, u.shortenKey("logs/"+pod+"q/2020010203.log.gz"))
+
+	// several long components are cut, the longest first, on rune boundaries
+	key = strings.Repeat("n", 600) + "/" + strings.Repeat("é", 400) + "/" + strings.Repeat("f", 500) + ".log"
+	short = u.shortenKey(key)
+	assert.LessOrEqual(t, len(short), MaxKeyLength-KeySuffixRoom)
+	assert.True(t, utf8.ValidString(short), short)
+	assert.True(t, strings.HasSuffix(short, ".log"), short)
+	assert.Len(t, strings.Split(short, "/"), 3)
+
+	fs := newFakeStorage()
+	defer fs.Close()
+
+	u = newFakeUploader(&AzblobConfig{BlobType: AppendBlob, StoreAs: PlainTextFormat}, fs)
+	key = "logs/" + pod + "/app.log"
+	u.sendBatch(BatchKey{ObjectKeyFormat: key}, []byte("a\n"), Source{})
+	u.sendBatch(BatchKey{ObjectKeyFormat: key}, []byte("b\n"), Source{})
+	assert.Equal(t, "a\nb\n", string(fs.Blob(u.shortenKey(key)).data))
+}
+
+func TestObjectKeyFormatByTag(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":                  "testcontainer",
+		"Azure_Storage_Account":            "testaccount",
+		"Azure_Storage_SAS":                "sas",
+		"Azure_Object_Key_Format":          "logs/%{namespace}/%{time_slice}.log",
+		"Azure_Fallback_Object_Key_Format": "host/%{time_slice}.log",
+		"Object_Key_Format_By_Tag":         "audit.*:audit/%{time_slice}.%{file_extension}, metrics.*:metrics/%{ Time_Slice }.log",
+		"Routes":                           "namespace=payments -> :payments/%{time_slice}.log",
+		"StoreAs":                          "gzip",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	o := &AzblobOperator{config: cfg, logger: NewLogger("testing", logrus.TraceLevel)}
+
+	record := func(namespace string) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			"kubernetes": map[interface{}]interface{}{"namespace_name": namespace},
+		}
+	}
+	for _, c := range []struct {
+		record   map[interface{}]interface{}
+		tag      string
+		expected string
+	}{
+		{record("app"), "audit.api", "audit/%{time_slice}.gz"},
+		{map[interface{}]interface{}{}, "audit.api", "audit/%{time_slice}.gz"},
+		{record("app"), "metrics.node", "metrics/%{time_slice}.log"},
+		{record("app"), "kube.app", "logs/app/%{time_slice}.log"},
+		{map[interface{}]interface{}{}, "kube.app", "host/%{time_slice}.log"},
+		// a route's format takes precedence
+		{record("payments"), "audit.api", "payments/%{time_slice}.log"},
+	} {
+		assert.Equal(t, c.expected, o.batchKey(c.record, "2020010203", c.tag).ObjectKeyFormat, c.tag)
+	}
+
+	// flat mode selects the format by tag too
+	conf = mapConfig{
+		"Azure_Container":          "testcontainer",
+		"Azure_Storage_Account":    "testaccount",
+		"Azure_Storage_SAS":        "sas",
+		"Mode":                     "flat",
+		"Object_Key_Format_By_Tag": "audit.*:audit/%{tag}/%{time_slice}.log",
+	}
+	cfg, err = NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	o = &AzblobOperator{config: cfg, logger: NewLogger("testing", logrus.TraceLevel)}
+	assert.Equal(t, "audit/%{tag}/%{time_slice}.log",
+		o.batchKey(map[interface{}]interface{}{}, "2020010203", "audit.api").ObjectKeyFormat)
+	assert.Equal(t, cfg.ObjectKeyFormat,
+		o.batchKey(map[interface{}]interface{}{}, "2020010203", "syslog").ObjectKeyFormat)
+
+	for formats, expected := range map[string]string{
+		"audit.*":                  "invalid Object_Key_Format_By_Tag, expected pattern:format: audit.*",
+		"audit.*:":                 "invalid Object_Key_Format_By_Tag, expected pattern:format: audit.*:",
+		":audit.log":               "invalid Object_Key_Format_By_Tag, expected pattern:format: :audit.log",
+		"[:audit.log":              "invalid Object_Key_Format_By_Tag, bad pattern: [",
+		"audit.*:%{namespace}.log": "Mode flat doesn't support Kubernetes placeholders in object key format: %{namespace}.log",
+	} {
+		conf["Object_Key_Format_By_Tag"] = formats
+		_, err = NewConfig(conf)
+		assert.EqualError(t, err, expected, formats)
+	}
+}
+
+func TestObjectKeyWithEmptyHostname(t *testing.T) {
+	hostname := Hostname
+	defer func() { Hostname = hostname }()
+
+	Hostname = ""
+	u := &AzblobUploader{config: &AzblobConfig{}, clock: newFakeClock()}
+	k := BatchKey{
+		TimeSlice:       "2020010203-04",
+		ObjectKeyFormat: "%{hostname}/%{time_slice}.gz",
+	}
+	assert.Equal(t, "2020010203-04.gz", u.objectKey(k))
+}
+
+func TestObjectKeyWithHash(t *testing.T) {
+	u := &AzblobUploader{config: &AzblobConfig{}, clock: newFakeClock()}
+
+	k := BatchKey{TimeSlice: "2020010203-04", ObjectKeyFormat: "%{hash}/%{time_slice}/app.log"}
+	key := u.objectKey(k)
+	assert.Regexp(t, "^[0-9a-f]{4}/2020010203-04/app.log$", key)
+	assert.Equal(t, keyHash("/2020010203-04/app.log")+"/2020010203-04/app.log", key)
+	assert.Equal(t, key, u.objectKey(k))
+
+	k.TimeSlice = "2020010203-05"
+	assert.NotEqual(t, key[:4], u.objectKey(k)[:4])
+}
+
+func TestObjectKeyWithUploadDate(t *testing.T) {
+	clock := newFakeClock()
+	clock.now = time.Date(2020, 3, 4, 23, 30, 0, 0, time.UTC)
+	u := &AzblobUploader{
+		config: &AzblobConfig{
+			UploadDateFormat: DefaultUploadDateFormat,
+			Location:         time.FixedZone("UTC+1", 60*60),
+		},
+		clock: clock,
+	}
+	k := BatchKey{
+		TimeSlice:       "2020010203-04",
+		ObjectKeyFormat: "ingest_date=%{upload_date}/event_slice=%{time_slice}.gz",
+	}
+	assert.Equal(t,
+		"ingest_date=20200305/event_slice=2020010203-04.gz", u.objectKey(k))
+}
+
+func TestRollover(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Rollover":              "hourly",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, "2006010215", cfg.TimeSliceFormat)
+	assert.Equal(t, "2006010215", cfg.UploadDateFormat)
+
+	clock := newFakeClock()
+	clock.now = time.Date(2020, 3, 4, 23, 59, 0, 0, time.UTC)
+	cfg.Location = time.UTC
+	u := &AzblobUploader{config: cfg, clock: clock}
+	k := BatchKey{ObjectKeyFormat: "%{upload_date}.log"}
+	assert.Equal(t, "2020030423.log", u.objectKey(k))
+	clock.now = clock.now.Add(time.Minute)
+	assert.Equal(t, "2020030500.log", u.objectKey(k))
+
+	conf["Time_Slice_Format"] = "20060102"
+	cfg, err = NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, "20060102", cfg.TimeSliceFormat)
+	assert.Equal(t, "2006010215", cfg.UploadDateFormat)
+
+	conf["Rollover"] = "weekly"
+	_, err = NewConfig(conf)
+	assert.Error(t, err)
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azblob-spool")
+	if err != nil {
+		assert.Fail(t, "create spool directory fails: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	delivered := map[string]string{}
+	fail := true
+	s, err := NewSpool(dir, time.Hour, NewLogger("testing", logrus.TraceLevel),
+		func(container, objectKey string, b []byte) error {
+			if fail {
+				return errors.New("unreachable")
+			}
+			delivered[blobName(container, objectKey)] = string(b)
+			return nil
+		})
+	if err != nil {
+		assert.Fail(t, "NewSpool fails: %v", err)
+	}
+	defer s.Stop()
+
+	assert.Nil(t, s.Write("", "a/first.gz", []byte("first\nbody")))
+	assert.Nil(t, s.Write("", "a/second.gz", []byte("second")))
+	assert.Nil(t, s.Write("prod-eu", "a/third.gz", []byte("third")))
+
+	assert.False(t, s.flush())
+	files, _ := s.files()
+	assert.Len(t, files, 3)
+
+	fail = false
+	assert.True(t, s.flush())
+	files, _ = s.files()
+	assert.Len(t, files, 0)
+	assert.Equal(t, map[string]string{
+		"a/first.gz":         "first\nbody",
+		"a/second.gz":        "second",
+		"prod-eu/a/third.gz": "third",
+	}, delivered)
+}
+
+// fakeClock only moves when it's told to.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	ticker *fakeTicker
+}
+
+type fakeTicker struct {
+	c chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		ticker: &fakeTicker{c: make(chan time.Time)},
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return c.ticker
+}
+
+// Advance moves the time forward once the uploader has handled everything
+// it received so far.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.sync()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// Tick advances the time and blocks until the uploader has handled the tick.
+func (c *fakeClock) Tick(d time.Duration) {
+	c.Advance(d)
+	c.ticker.c <- c.Now()
+	c.sync()
+}
+
+// sync returns once the uploader is idle: a tick is only received after the
+// previous entry or tick has been handled.
+func (c *fakeClock) sync() {
+	c.ticker.c <- c.Now()
+}
+
+type sentBatch struct {
+	key  BatchKey
+	body string
+}
+
+func TestStopFlushesOldestFirst(t *testing.T) {
+	clock := newFakeClock()
+	u, sent := startTestUploader(&AzblobConfig{
+		BatchWait:      time.Hour,
+		BatchLimitSize: 1024,
+	}, clock)
+
+	for _, slice := range []string{"c", "a", "d", "b"} {
+		u.Entries <- Entry{Key: BatchKey{TimeSlice: slice, ObjectKeyFormat: "%{time_slice}.log"}, Raw: []byte(slice)}
+		clock.Advance(time.Second)
+	}
+	// a later record doesn't make its batch younger
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "c", ObjectKeyFormat: "%{time_slice}.log"}, Raw: []byte("c")}
+	u.Stop()
+
+	for _, slice := range []string{"c", "a", "d", "b"} {
+		assert.Equal(t, slice, receiveBatch(t, sent).key.TimeSlice)
+	}
+}
+
+func TestStopWithShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	u, _ := startTestUploader(&AzblobConfig{
+		BatchWait:       time.Hour,
+		BatchLimitSize:  1024,
+		ShutdownTimeout: 100 * time.Millisecond,
+	}, newFakeClock())
+	u.send = func(k BatchKey, b []byte, src Source) {
+		if k.TimeSlice == "slow" {
+			<-release
+		}
+	}
+	defer close(release)
+
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "slow", ObjectKeyFormat: "%{time_slice}.log"}, Raw: []byte("a")}
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "fast", ObjectKeyFormat: "%{time_slice}.log"}, Raw: []byte("b")}
+
+	start := time.Now()
+	u.Stop()
+	assert.True(t, time.Since(start) < time.Second)
+
+	u.pendingMu.Lock()
+	defer u.pendingMu.Unlock()
+	// the fast batch may be sent before the slow one or queued behind it
+	assert.Equal(t, 2, u.pending["slow.log"])
+}
+
+// startTestUploader starts an uploader which reports its batches on the
+// returned channel instead of uploading them.
+func startTestUploader(c *AzblobConfig, clock Clock) (*AzblobUploader, chan sentBatch) {
+	sent := make(chan sentBatch, 100)
+
+	u := newUploader(c, NewLogger("testing", logrus.TraceLevel))
+	u.clock = clock
+	u.send = func(k BatchKey, b []byte, src Source) {
+		sent <- sentBatch{key: k, body: string(b)}
+	}
+
+	u.wg.Add(1)
+	go u.start()
+
+	return u, sent
+}
+
+func receiveBatch(t *testing.T, sent chan sentBatch) sentBatch {
+	select {
+	case b := <-sent:
+		return b
+	case <-time.After(time.Second):
+		assert.Fail(t, "batch isn't sent")
+		return sentBatch{}
+	}
+}
+
+func TestBatchFlushOnBatchWait(t *testing.T) {
+	clock := newFakeClock()
+	u, sent := startTestUploader(&AzblobConfig{
+		BatchWait:      5 * time.Second,
+		BatchLimitSize: DefaultBatchLimitSize,
+	}, clock)
+	defer u.Stop()
+
+	key := BatchKey{TimeSlice: "slice"}
+	u.Entries <- Entry{Key: key, Raw: []byte("first")}
+	clock.Tick(2 * time.Second)
+	u.Entries <- Entry{Key: key, Raw: []byte("second")}
+	clock.Tick(2*time.Second + 999*time.Millisecond)
+	assert.Len(t, sent, 0)
+
+	clock.Tick(time.Millisecond)
+	b := receiveBatch(t, sent)
+	assert.Equal(t, key, b.key)
+	assert.Equal(t, "first\nsecond\n", b.body)
+}
+
+func TestBatchFlushOnBatchLimitSize(t *testing.T) {
+	clock := newFakeClock()
+	u, sent := startTestUploader(&AzblobConfig{
+		BatchWait:      time.Hour,
+		BatchLimitSize: 11,
+	}, clock)
+	defer u.Stop()
+
+	key := BatchKey{TimeSlice: "slice"}
+	u.Entries <- Entry{Key: key, Raw: []byte("0123456789")}
+	u.Entries <- Entry{Key: key, Raw: []byte("a")}
+	assert.Len(t, sent, 0)
+
+	u.Entries <- Entry{Key: key, Raw: []byte("b")}
+	assert.Equal(t, "0123456789\na\n", receiveBatch(t, sent).body)
+}
+
+func TestBatchFlushOnStop(t *testing.T) {
+	clock := newFakeClock()
+	u, sent := startTestUploader(&AzblobConfig{
+		BatchWait:      time.Hour,
+		BatchLimitSize: DefaultBatchLimitSize,
+	}, clock)
+
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "a"}, Raw: []byte("a")}
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "b"}, Raw: []byte("b")}
+	u.Stop()
+
+	assert.Len(t, sent, 2)
+}
+
+func TestBatchRules(t *testing.T) {
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Batch_Rules":           "logs/noisy/*:1s:, logs/quiet-*/*:1m:1MB, logs/x:y/*::4KB",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, []BatchRule{
+		{Pattern: "logs/noisy/*", Wait: time.Second},
+		{Pattern: "logs/quiet-*/*", Wait: time.Minute, LimitSize: 1024 * 1024},
+		{Pattern: "logs/x:y/*", LimitSize: 4096},
+	}, cfg.BatchRules)
+
+	for _, rules := range []string{"logs/*", "logs/*:1s", "[:1s:", "logs/*:soon:", "logs/*::big"} {
+		conf["Batch_Rules"] = rules
+		_, err = NewConfig(conf)
+		assert.Error(t, err, rules)
+	}
+
+	clock := newFakeClock()
+	u, sent := startTestUploader(&AzblobConfig{
+		BatchWait:      10 * time.Second,
+		BatchLimitSize: DefaultBatchLimitSize,
+		BatchRules: []BatchRule{
+			{Pattern: "logs/noisy/*", Wait: time.Second},
+			{Pattern: "logs/big/*", LimitSize: 4},
+		},
+	}, clock)
+	defer u.Stop()
+	assert.Equal(t, 100*time.Millisecond, u.checkInterval())
+
+	u.Entries <- Entry{Key: BatchKey{ObjectKeyFormat: "logs/noisy/app.log"}, Raw: []byte("a")}
+	u.Entries <- Entry{Key: BatchKey{ObjectKeyFormat: "logs/quiet/app.log"}, Raw: []byte("b")}
+	clock.Tick(time.Second)
+	assert.Equal(t, "logs/noisy/app.log", receiveBatch(t, sent).key.ObjectKeyFormat)
+
+	// the big batch goes once over its own limit
+	u.Entries <- Entry{Key: BatchKey{ObjectKeyFormat: "logs/big/app.log"}, Raw: []byte("12345")}
+	u.Entries <- Entry{Key: BatchKey{ObjectKeyFormat: "logs/big/app.log"}, Raw: []byte("6")}
+	b := receiveBatch(t, sent)
+	assert.Equal(t, "logs/big/app.log", b.key.ObjectKeyFormat)
+	assert.Equal(t, "12345\n", b.body)
+
+	clock.Tick(10 * time.Second)
+	bodies := []string{receiveBatch(t, sent).body, receiveBatch(t, sent).body}
+	assert.ElementsMatch(t, []string{"b\n", "6\n"}, bodies)
+}
+
+func TestBatchSourceShare(t *testing.T) {
+	clock := newFakeClock()
+	u, sent := startTestUploader(&AzblobConfig{
+		BatchWait:      time.Hour,
+		BatchLimitSize: 100,
+		SourceShare:    0.25,
+	}, clock)
+	defer u.Stop()
+
+	k := BatchKey{TimeSlice: "20200102"}
+	noisy := Source{Namespace: "app", Pod: "noisy"}
+	quiet := Source{Namespace: "app", Pod: "quiet"}
+	u.Entries <- Entry{Key: k, Raw: []byte("quiet-0001"), Source: quiet}
+	for i := 1; i <= 4; i++ {
+		u.Entries <- Entry{Key: k, Raw: []byte(fmt.Sprintf("noisy-%04d", i)), Source: noisy}
+	}
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "20200103"}, Raw: []byte("other"), Source: noisy}
+
+	// the fourth record of the noisy pod is over a quarter of the limit
+	b := receiveBatch(t, sent)
+	assert.Equal(t, "quiet-0001\nnoisy-0001\nnoisy-0002\nnoisy-0003\n", b.body)
+	clock.sync()
+	assert.Len(t, u.batches, 2)
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+	}
+	for _, v := range []string{"0", "1.5", "-0.1", "quarter"} {
+		conf["Batch_Source_Share"] = v
+		_, err := NewConfig(conf)
+		assert.Error(t, err, v)
+	}
+	conf["Batch_Source_Share"] = "0.25"
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, 0.25, cfg.SourceShare)
+}
+
+func TestMemFlushThreshold(t *testing.T) {
+	sent := make(chan sentBatch, 10)
+	u := newUploader(&AzblobConfig{
+		BatchWait:         time.Hour,
+		BatchLimitSize:    DefaultBatchLimitSize,
+		MemFlushThreshold: 100,
+	}, NewLogger("testing", logrus.TraceLevel))
+	u.clock = newFakeClock()
+	u.send = func(k BatchKey, b []byte, src Source) {
+		sent <- sentBatch{key: k, body: string(b)}
+	}
+	heap := uint64(50)
+	u.heapAlloc = func() uint64 { return heap }
+
+	for slice, n := range map[string]int{"small": 10, "large": 40, "medium": 20} {
+		u.add(Entry{Key: BatchKey{TimeSlice: slice}, Raw: bytes.Repeat([]byte("x"), n)})
+	}
+
+	u.relieveMemory()
+	assert.Len(t, u.batches, 3)
+
+	// the largest batches go until they cover the excess
+	heap = 150
+	u.relieveMemory()
+	slices := []string{receiveBatch(t, sent).key.TimeSlice, receiveBatch(t, sent).key.TimeSlice}
+	assert.ElementsMatch(t, []string{"large", "medium"}, slices)
+	assert.Len(t, u.batches, 1)
+	assert.Contains(t, u.batches, BatchKey{TimeSlice: "small"})
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Mem_Flush_Threshold":   "256MB",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, uint64(256*1024*1024), cfg.MemFlushThreshold)
+
+	conf["Mem_Flush_Threshold"] = "lots"
+	_, err = NewConfig(conf)
+	assert.Error(t, err)
+}
+
+func TestEntriesBuffer(t *testing.T) {
+	c := &AzblobConfig{
+		BatchWait:      time.Hour,
+		BatchLimitSize: DefaultBatchLimitSize,
+		EntriesBuffer:  4,
+	}
+	u := newUploader(c, NewLogger("testing", logrus.TraceLevel))
+	u.clock = newFakeClock()
+
+	// the entries are buffered while the batches aren't handled
+	for _, slice := range []string{"a", "b", "c"} {
+		u.Entries <- Entry{Key: BatchKey{TimeSlice: slice}, Raw: []byte(slice)}
+	}
+
+	var b bytes.Buffer
+	u.writeMetrics(&b)
+	assert.Contains(t, b.String(), "azblob_entries_buffer_capacity 4\n")
+	assert.Contains(t, b.String(), "azblob_entries_buffer_depth 3\n")
+	assert.Contains(t, b.String(), "azblob_entries_buffer_high_watermark 0\n")
+
+	u.wg.Add(1)
+	go u.start()
+	defer u.Stop()
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint64(&u.entriesHigh) == 3 && len(u.Entries) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	b.Reset()
+	u.writeMetrics(&b)
+	assert.Contains(t, b.String(), "azblob_entries_buffer_depth 0\n")
+	assert.Contains(t, b.String(), "azblob_entries_buffer_high_watermark 3\n")
+
+	conf := mapConfig{
+		"Azure_Container":       "testcontainer",
+		"Azure_Storage_Account": "testaccount",
+		"Azure_Storage_SAS":     "sas",
+		"Entries_Buffer":        "1024",
+	}
+	cfg, err := NewConfig(conf)
+	if err != nil {
+		assert.Fail(t, "NewConfig fails: %v", err)
+	}
+	assert.Equal(t, 1024, cfg.EntriesBuffer)
+
+	conf["Entries_Buffer"] = "-1"
+	_, err = NewConfig(conf)
+	assert.EqualError(t, err, "invalid Entries_Buffer: -1")
+}
+
+func TestEntriesBufferFlushOnStop(t *testing.T) {
+	sent := make(chan sentBatch, 10)
+	u := newUploader(&AzblobConfig{
+		BatchWait:      time.Hour,
+		BatchLimitSize: DefaultBatchLimitSize,
+		EntriesBuffer:  4,
+	}, NewLogger("testing", logrus.TraceLevel))
+	u.clock = newFakeClock()
+	u.send = func(k BatchKey, b []byte, src Source) {
+		sent <- sentBatch{key: k, body: string(b)}
+	}
+
+	// entries still in the buffer on exit are sent too
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "a"}, Raw: []byte("a")}
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "a"}, Raw: []byte("b")}
+	close(u.quit)
+	u.wg.Add(1)
+	u.start()
+
+	assert.Equal(t, "a\nb\n", receiveBatch(t, sent).body)
+}
+
+func TestFlush(t *testing.T) {
+	clock := newFakeClock()
+	u, sent := startTestUploader(&AzblobConfig{
+		BatchWait:      time.Hour,
+		BatchLimitSize: DefaultBatchLimitSize,
+	}, clock)
+
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "a"}, Raw: []byte("a")}
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "b"}, Raw: []byte("b")}
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "c"}, Raw: []byte("c")}
+
+	a, err := NewAdmin("127.0.0.1:0", u.logger, u.Flush, u.writeMetrics)
+	if err != nil {
+		assert.Fail(t, "NewAdmin fails: %v", err)
+	}
+	defer a.Stop()
+	endpoint := fmt.Sprintf("http://%s/flush", a.listener.Addr())
+
+	resp, err := http.Get(endpoint)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		resp.Body.Close()
+	}
+	assert.Len(t, sent, 0)
+
+	resp, err = http.Post(endpoint+"?time_slice=b", "", nil)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "1 batches flushed\n", string(body))
+	}
+	b := receiveBatch(t, sent)
+	assert.Equal(t, BatchKey{TimeSlice: "b"}, b.key)
+	assert.Equal(t, "b\n", b.body)
+
+	n, err := u.Flush("b")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = u.Flush("")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	receiveBatch(t, sent)
+	receiveBatch(t, sent)
+
+	u.Stop()
+	_, err = u.Flush("")
+	assert.Error(t, err)
+	assert.Len(t, sent, 0)
+}
+
+func TestCoalesceTimeSlices(t *testing.T) {
+	clock := newFakeClock()
+	u, sent := startTestUploader(&AzblobConfig{
+		BatchWait:          time.Hour,
+		BatchLimitSize:     DefaultBatchLimitSize,
+		CoalesceTimeSlices: 3,
+	}, clock)
+
+	base := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	entry := func(slice int, route string) Entry {
+		return Entry{
+			Key: BatchKey{
+				TimeSlice: fmt.Sprintf("s%d", slice),
+				Route:     route,
+			},
+			Time: base.Add(time.Duration(slice) * time.Minute),
+			Raw:  []byte(fmt.Sprintf("%s%d", route, slice)),
+		}
+	}
+
+	u.Entries <- entry(2, "a")
+	u.Entries <- entry(3, "a")
+	u.Entries <- entry(2, "a")
+	// an older record moves the batch to its time slice
+	u.Entries <- entry(1, "a")
+	// the group is full, so a fourth time slice starts a new batch
+	u.Entries <- entry(4, "a")
+	// other routes are never coalesced with it
+	u.Entries <- entry(3, "b")
+	u.Stop()
+
+	batches := map[BatchKey]string{}
+	for len(sent) > 0 {
+		b := <-sent
+		batches[b.key] = b.body
+	}
+	assert.Equal(t, map[BatchKey]string{
+		{TimeSlice: "s1", Route: "a"}: "a2\na3\na2\na1\n",
+		{TimeSlice: "s4", Route: "a"}: "a4\n",
+		{TimeSlice: "s3", Route: "b"}: "b3\n",
+	}, batches)
+}
+
+func TestFlushOnTagChange(t *testing.T) {
+	clock := newFakeClock()
+	u, sent := startTestUploader(&AzblobConfig{
+		BatchWait:        time.Hour,
+		BatchLimitSize:   DefaultBatchLimitSize,
+		FlushOnTagChange: true,
+	}, clock)
+	defer u.Stop()
+
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "a"}, Tag: "kube.a", Raw: []byte("a1")}
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "a"}, Tag: "kube.a", Raw: []byte("a2")}
+	u.Entries <- Entry{Key: BatchKey{TimeSlice: "b"}, Tag: "kube.b", Raw: []byte("b1")}
+
+	b := receiveBatch(t, sent)
+	assert.Equal(t, BatchKey{TimeSlice: "a"}, b.key)
+	assert.Equal(t, "a1\na2\n", b.body)
+
+	clock.Tick(time.Minute)
+	assert.Len(t, sent, 0)
+}
+
+func TestBatchMaxAgeWithTrickle(t *testing.T) {
+	clock := newFakeClock()
+	u, sent := startTestUploader(&AzblobConfig{
+		BatchWait:      time.Hour,
+		BatchMaxAge:    200 * time.Millisecond,
+		BatchLimitSize: DefaultBatchLimitSize,
+	}, clock)
+	defer u.Stop()
+
+	key := BatchKey{TimeSlice: "slice"}
+	for i := 0; i < 4; i++ {
+		u.Entries <- Entry{Key: key, Raw: []byte("trickle")}
+		clock.Tick(50 * time.Millisecond)
+	}
+	b := receiveBatch(t, sent)
+	assert.Equal(t, key, b.key)
+	assert.Equal(t, strings.Repeat("trickle\n", 4), b.body)
+
+	// a record arriving after the max age flushes the batch right away
+	u.Entries <- Entry{Key: key, Raw: []byte("late")}
+	clock.Advance(200 * time.Millisecond)
+	u.Entries <- Entry{Key: key, Raw: []byte("next")}
+	assert.Equal(t, "late\n", receiveBatch(t, sent).body)
+}
+
+func TestBatchMaxAgeDisabled(t *testing.T) {
+	clock := newFakeClock()
+	u, sent := startTestUploader(&AzblobConfig{
+		BatchWait:      time.Hour,
+		BatchLimitSize: DefaultBatchLimitSize,
+	}, clock)
+
+	for i := 0; i < 5; i++ {
+		u.Entries <- Entry{Key: BatchKey{TimeSlice: "slice"}, Raw: []byte("trickle")}
+		clock.Tick(time.Minute)
+	}
+	assert.Len(t, sent, 0)
+
+	u.Stop()
+	b := <-sent
+	assert.Equal(t, strings.Repeat("trickle\n", 5), b.body)
 }
 
 func init() {
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+// RESTVersion is the storage service version of the requests which the azblob
+// SDK in use doesn't provide.
+const RESTVersion = "2020-10-02"
+
+// RESTError is a failed storage request sent without the SDK.
+type RESTError struct {
+	StatusCode int
+	Code       string
+}
+
+func (e *RESTError) Error() string {
+	return fmt.Sprintf("storage request failed: %d %s", e.StatusCode, e.Code)
+}
+
+// doRequest sends a storage request through a pipeline of the SDK, so it is
+// signed, retried and logged like the requests of the SDK. It returns the
+// response body, which is already closed.
+func doRequest(ctx context.Context, p pipeline.Pipeline, method string,
+	u url.URL, header http.Header, body []byte) (*http.Response, []byte, error) {
+	var r io.ReadSeeker
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := pipeline.NewRequest(method, u, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-version", RESTVersion)
+
+	resp, err := p.Do(ctx, nil, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := resp.Response()
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res, nil, err
+	}
+
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return res, b, &RESTError{
+			StatusCode: res.StatusCode,
+			Code:       res.Header.Get("x-ms-error-code"),
+		}
+	}
+
+	return res, b, nil
+}
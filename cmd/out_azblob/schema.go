@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a compiled JSON schema which records are validated against. It
+// supports the subset of JSON Schema which describes log records: type,
+// enum, const, required, properties, additionalProperties, items,
+// minLength, maxLength, pattern, minimum and maximum. Other keywords are
+// ignored.
+type Schema struct {
+	types                []string
+	enum                 []interface{}
+	required             []string
+	properties           map[string]*Schema
+	additionalProperties *Schema
+	closed               bool
+	items                *Schema
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+	minimum, maximum     *float64
+}
+
+// LoadSchema reads and compiles the JSON schema in file.
+func LoadSchema(file string) (*Schema, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	return compileSchema(v, "#")
+}
+
+func compileSchema(v interface{}, at string) (*Schema, error) {
+	// true allows anything, false nothing
+	if b, ok := v.(bool); ok {
+		if b {
+			return &Schema{}, nil
+		}
+		return &Schema{enum: []interface{}{}}, nil
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object", at)
+	}
+	s := &Schema{}
+
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, typ := range t {
+			name, ok := typ.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/type: must be a string or strings", at)
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("%s/type: must be a string or strings", at)
+	}
+	for _, typ := range s.types {
+		switch typ {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return nil, fmt.Errorf("%s/type: unknown type %s", at, typ)
+		}
+	}
+
+	if e, ok := m["enum"]; ok {
+		values, ok := e.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/enum: must be an array", at)
+		}
+		s.enum = values
+	}
+	if c, ok := m["const"]; ok {
+		s.enum = []interface{}{c}
+	}
+
+	if r, ok := m["required"]; ok {
+		names, ok := r.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/required: must be an array", at)
+		}
+		for _, name := range names {
+			n, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/required: must be strings", at)
+			}
+			s.required = append(s.required, n)
+		}
+	}
+
+	if p, ok := m["properties"]; ok {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/properties: must be an object", at)
+		}
+		s.properties = map[string]*Schema{}
+		for name, prop := range props {
+			ps, err := compileSchema(prop, at+"/properties/"+name)
+			if err != nil {
+				return nil, err
+			}
+			s.properties[name] = ps
+		}
+	}
+
+	switch t := m["additionalProperties"].(type) {
+	case nil:
+	case bool:
+		s.closed = !t
+	default:
+		as, err := compileSchema(t, at+"/additionalProperties")
+		if err != nil {
+			return nil, err
+		}
+		s.additionalProperties = as
+	}
+
+	if i, ok := m["items"]; ok {
+		is, err := compileSchema(i, at+"/items")
+		if err != nil {
+			return nil, err
+		}
+		s.items = is
+	}
+
+	var err error
+	if s.minLength, err = schemaInt(m, "minLength", at); err != nil {
+		return nil, err
+	}
+	if s.maxLength, err = schemaInt(m, "maxLength", at); err != nil {
+		return nil, err
+	}
+	if s.minimum, err = schemaNumber(m, "minimum", at); err != nil {
+		return nil, err
+	}
+	if s.maximum, err = schemaNumber(m, "maximum", at); err != nil {
+		return nil, err
+	}
+
+	if p, ok := m["pattern"]; ok {
+		expr, ok := p.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s/pattern: must be a string", at)
+		}
+		s.pattern, err = regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s/pattern: %v", at, err)
+		}
+	}
+
+	return s, nil
+}
+
+func schemaNumber(m map[string]interface{}, key, at string) (*float64, error) {
+	v, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+	n, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s/%s: must be a number", at, key)
+	}
+
+	return &n, nil
+}
+
+func schemaInt(m map[string]interface{}, key, at string) (*int, error) {
+	n, err := schemaNumber(m, key, at)
+	if n == nil || err != nil {
+		return nil, err
+	}
+	if *n < 0 || *n != float64(int(*n)) {
+		return nil, fmt.Errorf("%s/%s: must be a non-negative integer", at, key)
+	}
+	i := int(*n)
+
+	return &i, nil
+}
+
+// Validate checks a record, as decoded from msgpack, against the schema. The
+// error names the first value which doesn't match.
+func (s *Schema) Validate(r map[interface{}]interface{}) error {
+	return s.validate(r, "")
+}
+
+func (s *Schema) validate(v interface{}, at string) error {
+	v = schemaValue(v)
+	name := at
+	if name == "" {
+		name = "record"
+	}
+
+	if len(s.types) > 0 && !s.hasType(v) {
+		return fmt.Errorf("%s: must be %s", name, strings.Join(s.types, " or "))
+	}
+
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if schemaEqual(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: not an allowed value", name)
+		}
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return s.validateObject(t, at)
+	case []interface{}:
+		if s.items == nil {
+			return nil
+		}
+		for i, item := range t {
+			if err := s.items.validate(item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(t)
+		if s.minLength != nil && n < *s.minLength {
+			return fmt.Errorf("%s: shorter than %d", name, *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return fmt.Errorf("%s: longer than %d", name, *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(t) {
+			return fmt.Errorf("%s: doesn't match %s", name, s.pattern)
+		}
+	case float64:
+		if s.minimum != nil && t < *s.minimum {
+			return fmt.Errorf("%s: less than %v", name, *s.minimum)
+		}
+		if s.maximum != nil && t > *s.maximum {
+			return fmt.Errorf("%s: greater than %v", name, *s.maximum)
+		}
+	}
+
+	return nil
+}
+
+func (s *Schema) validateObject(m map[string]interface{}, at string) error {
+	prefix := at
+	if prefix != "" {
+		prefix += "."
+	}
+
+	for _, key := range s.required {
+		if _, ok := m[key]; !ok {
+			return fmt.Errorf("%s%s: is required", prefix, key)
+		}
+	}
+
+	// sorted, so the same record always reports the same error
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ps, ok := s.properties[key]
+		switch {
+		case ok:
+		case s.closed:
+			return fmt.Errorf("%s%s: is not allowed", prefix, key)
+		case s.additionalProperties != nil:
+			ps = s.additionalProperties
+		default:
+			continue
+		}
+		if err := ps.validate(m[key], prefix+key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Schema) hasType(v interface{}) bool {
+	for _, typ := range s.types {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			if typ == "object" {
+				return true
+			}
+		case []interface{}:
+			if typ == "array" {
+				return true
+			}
+		case string:
+			if typ == "string" {
+				return true
+			}
+		case float64:
+			if typ == "number" || (typ == "integer" && t == float64(int64(t))) {
+				return true
+			}
+		case bool:
+			if typ == "boolean" {
+				return true
+			}
+		case nil:
+			if typ == "null" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// schemaValue converts a value decoded from msgpack to its JSON counterpart:
+// strings may come as bytes, maps with interface keys and numbers of any
+// size.
+func schemaValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case []byte:
+		return string(t)
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprint(k)] = v
+		}
+		return m
+	case int:
+		return float64(t)
+	case int8:
+		return float64(t)
+	case int16:
+		return float64(t)
+	case int32:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case uint:
+		return float64(t)
+	case uint8:
+		return float64(t)
+	case uint16:
+		return float64(t)
+	case uint32:
+		return float64(t)
+	case uint64:
+		return float64(t)
+	case float32:
+		return float64(t)
+	}
+
+	return v
+}
+
+// schemaEqual compares two values as JSON values.
+func schemaEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(jsonValue(a), jsonValue(b))
+}
+
+// jsonValue converts a value and all the values in it with schemaValue.
+func jsonValue(v interface{}) interface{} {
+	switch t := schemaValue(v).(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[k] = jsonValue(v)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, v := range t {
+			a[i] = jsonValue(v)
+		}
+		return a
+	default:
+		return t
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SpoolFileExt     = ".spool"
+	MaxSpoolInterval = 10 * time.Minute
+)
+
+type DeliverFunc func(container, objectKey string, b []byte) error
+
+// Spool keeps the batches which couldn't be uploaded in a local directory and
+// retries them in the background, so an outage of Azure delays the delivery
+// instead of losing the logs. Each file holds the object key on its first
+// line followed by the blob content as it would have been uploaded. Blobs of
+// another container than Azure_Container have the first line prefixed with
+// the container and a tab.
+type Spool struct {
+	dir      string
+	interval time.Duration
+	deliver  DeliverFunc
+	logger   *logrus.Entry
+	quit     chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewSpool(dir string, interval time.Duration, l *logrus.Entry,
+	deliver DeliverFunc) (*Spool, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Spool_Dir: %v", err)
+	}
+
+	s := &Spool{
+		dir:      dir,
+		interval: interval,
+		deliver:  deliver,
+		logger:   l,
+		quit:     make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.start()
+
+	return s, nil
+}
+
+// Write stores a blob in the spool directory. The file is written under a
+// temporary name first, so the retrier never picks up a partial file.
+func (s *Spool) Write(container, objectKey string, b []byte) error {
+	// Names start with the time, so files are retried in the order they
+	// were spooled.
+	name := fmt.Sprintf("%020d-%s", time.Now().UnixNano(), uuid.NewV4().String())
+	tmp := filepath.Join(s.dir, name+".tmp")
+
+	var buf bytes.Buffer
+	if container != "" {
+		buf.WriteString(container)
+		buf.WriteByte('\t')
+	}
+	buf.WriteString(objectKey)
+	buf.WriteByte('\n')
+	buf.Write(b)
+
+	err := ioutil.WriteFile(tmp, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Warnf("spool blob=%s file=%s", objectKey, name+SpoolFileExt)
+
+	return os.Rename(tmp, filepath.Join(s.dir, name+SpoolFileExt))
+}
+
+func (s *Spool) start() {
+	defer s.wg.Done()
+
+	interval := s.interval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-timer.C:
+			// Back off while the uploads keep failing and go back to the
+			// regular interval as soon as one succeeds.
+			if s.flush() {
+				interval = s.interval
+			} else {
+				interval *= 2
+				if interval > MaxSpoolInterval {
+					interval = MaxSpoolInterval
+				}
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+// flush uploads the spooled files and removes them once uploaded. It stops at
+// the first failure and reports whether all files were delivered.
+func (s *Spool) flush() bool {
+	files, err := s.files()
+	if err != nil {
+		s.logger.Errorf("read spool directory error: %v", err)
+		return false
+	}
+
+	for _, file := range files {
+		select {
+		case <-s.quit:
+			return true
+		default:
+		}
+
+		container, objectKey, b, err := readSpoolFile(file)
+		if err != nil {
+			s.logger.Errorf("read spool file error, file=%s: %v", file, err)
+			continue
+		}
+
+		err = s.deliver(container, objectKey, b)
+		if err != nil {
+			s.logger.Warnf("spooled blob isn't delivered yet, blob=%s", objectKey)
+			return false
+		}
+
+		s.logger.Infof("spooled blob is delivered, blob=%s", objectKey)
+		err = os.Remove(file)
+		if err != nil {
+			s.logger.Errorf("remove spool file error, file=%s: %v", file, err)
+		}
+	}
+
+	return true
+}
+
+func (s *Spool) files() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), SpoolFileExt) {
+			continue
+		}
+		files = append(files, filepath.Join(s.dir, info.Name()))
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func (s *Spool) Stop() {
+	s.once.Do(func() { close(s.quit) })
+	s.wg.Wait()
+}
+
+func readSpoolFile(file string) (string, string, []byte, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return "", "", nil, fmt.Errorf("missing object key")
+	}
+
+	container, objectKey := "", string(b[:i])
+	if j := strings.IndexByte(objectKey, '\t'); j >= 0 && validContainerName(objectKey[:j]) {
+		container, objectKey = objectKey[:j], objectKey[j+1:]
+	}
+
+	return container, objectKey, b[i+1:], nil
+}
@@ -4,75 +4,505 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
+	jsoniter "github.com/json-iterator/go"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	BlockSize        = 4 * 1024 * 1024 // 4m
+	AppendBlockSize  = azblob.AppendBlobMaxAppendBlockBytes
+	MaxAppendBlocks  = azblob.AppendBlobMaxBlocks
+	GzipHeadroom     = 64 * 1024
 	Parallelism      = 4
 	Timeout          = 30
 	PublicAccessType = azblob.PublicAccessNone
 	MinCheckInterval = 50 * time.Millisecond
+	// ContainerCreateInterval is the first wait before creating a container
+	// again which is still being deleted.
+	ContainerCreateInterval = time.Second
+	// SequenceLeaseDuration is the lease in seconds taken on an append blob
+	// to append to it and count the append, the shortest the service takes.
+	// LeaseRetryInterval is the wait before trying again to take a lease
+	// held by another writer.
+	SequenceLeaseDuration = 15
+	LeaseRetryInterval    = 100 * time.Millisecond
+	// MemCheckInterval is how often the heap is checked against
+	// MemFlushThreshold; reading it stops the world briefly.
+	MemCheckInterval = time.Second
+	// AccountRetries is how often a batch is retried on one of several
+	// storage accounts before it fails over to the next one.
+	AccountRetries = 2
+	// ErrorMirrorRetries is how often a batch is retried on ErrorContainer.
+	ErrorMirrorRetries = 2
+	// MaxKeyLength is the longest blob name the service takes. Longer object
+	// keys are shortened to leave KeySuffixRoom for the part number.
+	MaxKeyLength  = 1024
+	KeySuffixRoom = 16
 )
 
 type Batch struct {
 	Buffer    []byte
 	CreatedAt time.Time
+	// Slices are the time slices of the records in the batch and Oldest the
+	// time of the oldest record, used to coalesce time slices.
+	Slices []string
+	Oldest time.Time
+	// Tag is the tag of the last record added to the batch.
+	Tag string
+	// Source is the workload the records of the batch come from.
+	Source Source
+	// Rule is the first of BatchRules matching the batch, if any.
+	Rule *BatchRule
+	// Sources are the bytes of the batch per pod and Noisiest the most of
+	// them, kept with SourceShare only.
+	Sources  map[string]int
+	Noisiest int
+}
+
+// Source is the Kubernetes workload a record comes from. It's logged with the
+// errors of a batch, so a failure can be traced back to the workloads whose
+// records are lost. A field is empty when it's unknown or the records of a
+// batch disagree on it.
+type Source struct {
+	Namespace  string
+	Pod        string
+	Container  string
+	Deployment string
+	// Labels are the IndexTagLabels of the workload, which become the index
+	// tags of its blobs.
+	Labels map[string]string
+	// First and Last are the times of the earliest and the latest record.
+	First time.Time
+	Last  time.Time
+}
+
+// include widens the time range of s to t.
+func (s *Source) include(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	if s.First.IsZero() || t.Before(s.First) {
+		s.First = t
+	}
+	if t.After(s.Last) {
+		s.Last = t
+	}
+}
+
+// merge returns the fields which s and o have in common, over the time range
+// of both.
+func (s Source) merge(o Source) Source {
+	if s.Namespace != o.Namespace {
+		s.Namespace = ""
+	}
+	if s.Pod != o.Pod {
+		s.Pod = ""
+	}
+	if s.Container != o.Container {
+		s.Container = ""
+	}
+	if s.Deployment != o.Deployment {
+		s.Deployment = ""
+	}
+	if len(s.Labels) > 0 {
+		labels := map[string]string{}
+		for k, v := range s.Labels {
+			if o.Labels[k] == v {
+				labels[k] = v
+			}
+		}
+		s.Labels = labels
+	}
+	s.include(o.First)
+	s.include(o.Last)
+
+	return s
+}
+
+// fields returns the known fields of s as log fields.
+func (s Source) fields() logrus.Fields {
+	f := logrus.Fields{}
+	for k, v := range map[string]string{
+		"namespace":  s.Namespace,
+		"pod":        s.Pod,
+		"container":  s.Container,
+		"deployment": s.Deployment,
+	} {
+		if v != "" {
+			f[k] = v
+		}
+	}
+
+	return f
+}
+
+// BatchKey identifies the batch an entry belongs to. Entries with the same
+// key are uploaded together.
+type BatchKey struct {
+	TimeSlice       string
+	ObjectKeyFormat string
+	Route           string
+	Level           string
+	Tag             string
+	Image           string
+	// Container is the container of the records, from ContainerKey, or
+	// empty for Azure_Container.
+	Container string
 }
 
 type Entry struct {
-	TimeSlice string
-	Raw       []byte
+	Key    BatchKey
+	Time   time.Time
+	Tag    string
+	Raw    []byte
+	Source Source
 }
 
 type Func func() error
 
+// BOM is the UTF-8 byte order mark, which some Windows tools expect at the
+// start of a text file.
+var BOM = []byte{0xef, 0xbb, 0xbf}
+
+// blobState is what the uploader knows about an append blob, including the
+// client of the part written to.
+type blobState struct {
+	part   int
+	size   int64
+	blocks int
+	url    *azblob.AppendBlobURL
+	// tags are the index tags last set on the part, as sent
+	tags string
+	// created is set once the part is known to exist.
+	created bool
+	// bom is set once the part is known to start with a BOM, or not to be
+	// empty.
+	bom bool
+}
+
+type SendFunc func(k BatchKey, b []byte, src Source)
+
+// flushRequest asks the batch loop to send the batches of a time slice, or
+// all of them when it's empty. done receives the number of batches sent.
+type flushRequest struct {
+	timeSlice string
+	done      chan int
+}
+
+// appendBuffer holds the batches of an append blob which are not appended
+// yet.
+type appendBuffer struct {
+	// key is the batch key of the last batch buffered, whose sends the
+	// buffer is flushed in order with.
+	key       BatchKey
+	container string
+	objectKey string
+	buf       []byte
+	format    FileFormat
+	source    Source
+	createdAt time.Time
+	queued    bool
+	// sums are the hashes of the batches buffered, for DedupWindow.
+	sums []batchSum
+}
+
+// batchSum is the hash of a batch, which DedupWindow compares batches of the
+// same batch key by.
+type batchSum struct {
+	key BatchKey
+	sum [sha256.Size]byte
+}
+
+// blobTarget is the blob the batches of a batch key are appended to until
+// they reach BlobTargetSize.
+type blobTarget struct {
+	objectKey string
+	timeSlice string
+	size      uint64
+}
+
+// lateSlices are the blobs the recent batches of a batch key were written
+// to, per time slice, and the time slice which started last.
+type lateSlices struct {
+	current string
+	blobs   map[string]*lateBlob
+}
+
+// lateBlob is the blob a time slice was last written to, and when.
+type lateBlob struct {
+	objectKey string
+	sentAt    time.Time
+}
+
+// blockList is what a block blob written with LateRecordGrace is made of, so
+// late records can be committed after its blocks instead of replacing them.
+type blockList struct {
+	ids       []string
+	size      uint64
+	records   int
+	writtenAt time.Time
+}
+
+// blobLock serializes the writes to a blob. refs counts the writers holding
+// or waiting for it, so it's dropped once the last one is done.
+type blobLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// containerState is whether a container is known to exist. Its lock is held
+// while the container is created, so concurrent uploads make one request.
+type containerState struct {
+	mu      sync.Mutex
+	created bool
+}
+
 type AzblobUploader struct {
+	// clockOffset is the difference of the storage service clock to the
+	// local clock in nanoseconds, accessed atomically.
+	clockOffset int64
+	// dropped counts the batches which were given up, accessed atomically.
+	dropped uint64
+	// skipped counts the batches which held no records, and duplicates the
+	// ones which repeated a recent batch, accessed atomically.
+	skipped    uint64
+	duplicates uint64
+	// entriesHigh is the most entries seen waiting in Entries, accessed
+	// atomically.
+	entriesHigh uint64
+	// uploads and sentBytes count the blob writes and their bytes, failures
+	// the batches which no account took, all accessed atomically.
+	uploads   uint64
+	sentBytes uint64
+	failures  uint64
+
 	Entries    chan Entry
-	batches    map[string]*Batch
-	container  azblob.ContainerURL
-	timeTicker *time.Ticker
+	flushes    chan flushRequest
+	batches    map[BatchKey]*Batch
+	groups     map[BatchKey]BatchKey
+	inflight   map[BatchKey]chan struct{}
+	lastTag    string
+	containers []azblob.ContainerURL
+	pipelines  []pipeline.Pipeline
+	clock      Clock
 	quit       chan struct{}
 	once       sync.Once
 	wg         sync.WaitGroup
 	config     *AzblobConfig
 	logger     *logrus.Entry
+	send       SendFunc
+	spool      *Spool
+	admin      *Admin
+	blobs      *blobCache
+	blobsMu    sync.Mutex
+	created    map[string]*containerState
+	createdMu  sync.Mutex
+	appends    map[string]*appendBuffer
+	appendsMu  sync.Mutex
+	streams    map[BatchKey]string
+	streamsMu  sync.Mutex
+	targets    map[BatchKey]*blobTarget
+	late       map[BatchKey]*lateSlices
+	lateMu     sync.Mutex
+	lists      map[string]*blockList
+	listsMu    sync.Mutex
+	restartID  string
+	targetsMu  sync.Mutex
+	writing    map[string]*blobLock
+	writingMu  sync.Mutex
+	slots      chan struct{}
+	heartbeat  time.Time
+	exportedAt time.Time
+	exported   counters
+	exportMu   sync.Mutex
+	memCheck   time.Time
+	heapAlloc  func() uint64
+	pending    map[string]int
+	pendingMu  sync.Mutex
+	failure    error
+	failedAt   time.Time
+	failureMu  sync.Mutex
+	// successes is the time of the last upload under each of
+	// LastSuccessPrefixes.
+	successes map[string]time.Time
+	successMu sync.Mutex
+	// dedup are the hashes of the last DedupWindow batches of every batch
+	// key.
+	dedup   map[BatchKey][][sha256.Size]byte
+	dedupMu sync.Mutex
+	// shortened are the object keys whose shortened names were logged,
+	// forgotten every DefaultOpenBlobsLimit keys.
+	shortened map[string]bool
+	shortMu   sync.Mutex
+	// webhooks are the posts to WebhookURL in flight, which Stop waits for.
+	// Once webhooksClosed is set no more are started.
+	webhooks       sync.WaitGroup
+	webhooksMu     sync.Mutex
+	webhooksClosed bool
 }
 
 func NewUploader(c *AzblobConfig, l *logrus.Entry) (*AzblobUploader, error) {
-	checkInterval := c.BatchWait / 10
-	if checkInterval < MinCheckInterval {
-		checkInterval = MinCheckInterval
+	var err error
+
+	u := newUploader(c, l)
+
+	if len(c.PrecreateContainers) > 0 {
+		if err := u.precreateContainers(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.SpoolDir != "" {
+		noRetry := uint64(0)
+		u.spool, err = NewSpool(c.SpoolDir, c.SpoolRetryInterval, l,
+			func(container, objectKey string, b []byte) error {
+				return u.deliver(u.logger, container, objectKey, u.blocks(b), &noRetry, Source{})
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	u.wg.Add(1)
+	go u.start()
+
+	if c.AdminListen != "" {
+		u.admin, err = NewAdmin(c.AdminListen, l, u.Flush, u.writeMetrics)
+		if err != nil {
+			u.Stop()
+			return nil, err
+		}
 	}
 
+	return u, nil
+}
+
+func newUploader(c *AzblobConfig, l *logrus.Entry) *AzblobUploader {
 	u := &AzblobUploader{
-		Entries:    make(chan Entry),
-		batches:    map[string]*Batch{},
-		container:  c.ContainerURL,
-		timeTicker: time.NewTicker(checkInterval),
+		Entries:    make(chan Entry, c.EntriesBuffer),
+		flushes:    make(chan flushRequest),
+		batches:    map[BatchKey]*Batch{},
+		groups:     map[BatchKey]BatchKey{},
+		inflight:   map[BatchKey]chan struct{}{},
+		containers: c.ContainerURLs,
+		pipelines:  c.Pipelines,
+		clock:      realClock{},
+		blobs:      newBlobCache(c.OpenBlobsLimit),
+		created:    map[string]*containerState{},
+		appends:    map[string]*appendBuffer{},
+		streams:    map[BatchKey]string{},
+		targets:    map[BatchKey]*blobTarget{},
+		late:       map[BatchKey]*lateSlices{},
+		lists:      map[string]*blockList{},
+		writing:    map[string]*blobLock{},
+		pending:    map[string]int{},
+		successes:  map[string]time.Time{},
+		heapAlloc:  readHeapAlloc,
+		slots:      make(chan struct{}, uploadParallelism(c)),
 		quit:       make(chan struct{}),
 		config:     c,
 		logger:     l,
 	}
+	u.send = u.sendBatch
+	if c.OnRestart == NewOnRestart {
+		u.restartID = time.Now().UTC().Format("20060102T150405Z")
+	}
 
-	u.wg.Add(1)
-	go u.start()
+	return u
+}
 
-	return u, nil
+// checkInterval is how often the batches are checked for expiry.
+func (u *AzblobUploader) checkInterval() time.Duration {
+	wait := u.config.BatchWait
+	if u.config.BatchMaxAge > 0 && u.config.BatchMaxAge < wait {
+		wait = u.config.BatchMaxAge
+	}
+	for _, rule := range u.config.BatchRules {
+		if rule.Wait > 0 && rule.Wait < wait {
+			wait = rule.Wait
+		}
+	}
+
+	checkInterval := wait / 10
+	if checkInterval < MinCheckInterval {
+		checkInterval = MinCheckInterval
+	}
+
+	return checkInterval
 }
 
 func (u *AzblobUploader) start() {
+	ticker := u.clock.NewTicker(u.checkInterval())
+
 	defer func() {
-		for ts, b := range u.batches {
-			u.sendBatch(ts, b.Buffer)
+		ticker.Stop()
+
+		// With EntriesBuffer, records may still wait in the buffer.
+		for n := len(u.Entries); n > 0; n-- {
+			u.add(<-u.Entries)
+		}
+
+		u.pendingMu.Lock()
+		for k, b := range u.batches {
+			u.pending[batchName(k)] += len(b.Buffer)
+		}
+		u.appendsMu.Lock()
+		for name, ab := range u.appends {
+			u.pending[name] += len(ab.buf)
+		}
+		u.appendsMu.Unlock()
+		u.pendingMu.Unlock()
+
+		// The oldest batches go first, so if ShutdownTimeout cuts the flush
+		// short, it's the newest records which are left.
+		keys := make([]BatchKey, 0, len(u.batches))
+		for k := range u.batches {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := u.batches[keys[i]], u.batches[keys[j]]
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.Before(b.CreatedAt)
+			}
+			return batchName(keys[i]) < batchName(keys[j])
+		})
+		for _, k := range keys {
+			b := u.batches[k]
+			if prev, ok := u.inflight[k]; ok {
+				<-prev
+			}
+			u.send(k, b.Buffer, b.Source)
+			u.flushed(batchName(k))
 		}
+		// the buffers are flushed after the sends which may add to them
+		for _, done := range u.inflight {
+			<-done
+		}
+		u.flushAppendBuffers(true)
 
 		u.wg.Done()
 	}()
@@ -81,163 +511,2652 @@ func (u *AzblobUploader) start() {
 		select {
 		case <-u.quit:
 			return
-		case <-u.timeTicker.C:
-			for ts, b := range u.batches {
-				if time.Since(b.CreatedAt) < u.config.BatchWait {
-					continue
-				}
+		case <-ticker.C():
+			u.releaseInflight()
+			u.flushAppendBuffers(false)
 
-				u.logger.Debug("max wait time reached, sending batch...")
-				go u.sendBatch(ts, b.Buffer)
-				delete(u.batches, ts)
+			if u.config.MemFlushThreshold > 0 &&
+				u.clock.Now().Sub(u.memCheck) >= MemCheckInterval {
+				u.memCheck = u.clock.Now()
+				u.relieveMemory()
 			}
-		case e := <-u.Entries:
-			batch, ok := u.batches[e.TimeSlice]
 
-			if !ok {
-				u.batches[e.TimeSlice] = &Batch{
-					Buffer:    e.Raw,
-					CreatedAt: time.Now(),
-				}
-				break
+			if u.config.HeartbeatInterval > 0 &&
+				u.clock.Now().Sub(u.heartbeat) >= u.config.HeartbeatInterval {
+				u.heartbeat = u.clock.Now()
+				go u.sendHeartbeat()
 			}
 
-			if uint64(len(batch.Buffer)) > u.config.BatchLimitSize {
-				u.logger.Debug("max size reached, sending batch...")
-				go u.sendBatch(e.TimeSlice, batch.Buffer)
+			if u.config.AppInsights != nil &&
+				u.clock.Now().Sub(u.exportedAt) >= u.config.AppInsights.Interval {
+				u.exportedAt = u.clock.Now()
+				go u.exportMetrics()
+			}
 
-				u.batches[e.TimeSlice] = &Batch{
-					Buffer:    e.Raw,
-					CreatedAt: time.Now(),
+			for g, k := range u.groups {
+				if _, ok := u.batches[k]; !ok {
+					delete(u.groups, g)
 				}
-				break
 			}
 
-			batch.Buffer = append(batch.Buffer, "\n"...)
-			batch.Buffer = append(batch.Buffer, e.Raw...)
+			for k, b := range u.batches {
+				if !u.expired(b) {
+					continue
+				}
+
+				u.logger.Debug("max wait time reached, sending batch...")
+				u.dispatch(k, b.Buffer, b.Source)
+				delete(u.batches, k)
+			}
+		case e := <-u.Entries:
+			// the entry received was waiting too
+			if depth := uint64(len(u.Entries) + 1); depth > atomic.LoadUint64(&u.entriesHigh) {
+				atomic.StoreUint64(&u.entriesHigh, depth)
+			}
+			u.flushOnTagChange(e.Tag)
+			u.add(e)
+		case f := <-u.flushes:
+			f.done <- u.flush(f.timeSlice)
 		}
 	}
 }
 
-func (u *AzblobUploader) Stop() {
-	u.once.Do(func() { close(u.quit) })
-	u.wg.Wait()
+// Flush sends the batches holding records of timeSlice, or all batches when
+// it's empty, without waiting for BatchWait. It returns the number of batches
+// sent, which are uploaded in the background.
+func (u *AzblobUploader) Flush(timeSlice string) (int, error) {
+	f := flushRequest{timeSlice: timeSlice, done: make(chan int, 1)}
+	select {
+	case u.flushes <- f:
+	case <-u.quit:
+		return 0, fmt.Errorf("uploader is stopped")
+	}
+
+	return <-f.done, nil
 }
 
-func (u *AzblobUploader) sendBatch(timeSlice string, b []byte) {
-	// Generate ObjectKey
-	objectKey := u.config.ObjectKeyFormat
-	objectKey = strings.ReplaceAll(objectKey, "%{hostname}", Hostname)
-	objectKey = strings.ReplaceAll(objectKey, "%{uuid}", uuid.NewV4().String())
-	objectKey = strings.ReplaceAll(objectKey, "%{time_slice}", timeSlice)
+func (u *AzblobUploader) flush(timeSlice string) int {
+	n := 0
+	for k, b := range u.batches {
+		if timeSlice != "" && !hasTimeSlice(b, timeSlice) {
+			continue
+		}
 
-	u.logger.Debugf("upload blob=%s size: %d bytes", objectKey, len(b))
+		u.logger.Debugf("flush requested, sending batch...")
+		u.dispatch(k, b.Buffer, b.Source)
+		delete(u.batches, k)
+		n++
+	}
 
-	var buf []byte
-	var err error
-	err = retry(u.config.BatchRetryLimit, func() error {
-		switch u.config.StoreAs {
-		case GzipFormat:
-			buf, err = makeGzip(b)
-			if err != nil {
-				u.logger.Error(err.Error())
-				return err
-			}
-		}
+	return n
+}
+
+// relieveMemory sends the largest batches right away while the heap is above
+// MemFlushThreshold, until they add up to the excess, so records pile up in
+// fewer open batches during an Azure slowdown. The records stay in memory
+// until their upload is done, so it slows the growth of the heap rather than
+// shrinking it right away.
+func (u *AzblobUploader) relieveMemory() {
+	heap := u.heapAlloc()
+	if heap <= u.config.MemFlushThreshold || len(u.batches) == 0 {
+		return
+	}
 
-		return u.upload(objectKey, buf)
+	keys := make([]BatchKey, 0, len(u.batches))
+	for k := range u.batches {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return len(u.batches[keys[i]].Buffer) > len(u.batches[keys[j]].Buffer)
 	})
 
-	if err != nil {
-		u.logger.Errorf("retry limit reached, blob=%s", objectKey)
+	excess := heap - u.config.MemFlushThreshold
+	var size uint64
+	n := 0
+	for _, k := range keys {
+		if size >= excess {
+			break
+		}
+		b := u.batches[k]
+		size += uint64(len(b.Buffer))
+		u.dispatch(k, b.Buffer, b.Source)
+		delete(u.batches, k)
+		n++
 	}
+
+	u.logger.Warnf("memory pressure, heap=%s threshold=%s: sending the %d largest batches, %s",
+		bytefmt.ByteSize(heap), bytefmt.ByteSize(u.config.MemFlushThreshold), n,
+		bytefmt.ByteSize(size))
 }
 
-func retry(attempts *uint64, f Func) error {
-	counter := uint64(0)
-	interval := time.Second
+func readHeapAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
 
-	for {
-		err := f()
+	return m.HeapAlloc
+}
 
-		if err == nil {
-			return nil
+// hasTimeSlice tells whether a batch holds records of a time slice, which
+// with CoalesceTimeSlices isn't only the one of its key.
+func hasTimeSlice(b *Batch, timeSlice string) bool {
+	for _, slice := range b.Slices {
+		if slice == timeSlice {
+			return true
 		}
+	}
 
-		if attempts == nil || counter < *attempts {
-			counter++
+	return false
+}
 
-			// Add some randomness to prevent creating a Thundering Herd
-			jitter := time.Duration(rand.Int63n(int64(interval)))
-			interval = interval + jitter/2
-			time.Sleep(interval)
+// flushOnTagChange sends the batches of the previous tag as soon as records
+// of another tag arrive, so a burst of one tag isn't held back for BatchWait
+// while the input has moved on.
+func (u *AzblobUploader) flushOnTagChange(tag string) {
+	prev := u.lastTag
+	u.lastTag = tag
+	if !u.config.FlushOnTagChange || prev == "" || prev == tag {
+		return
+	}
+
+	for k, b := range u.batches {
+		if b.Tag != prev {
 			continue
 		}
 
-		return err
+		u.logger.Debugf("tag changed from %s to %s, sending batch...", prev, tag)
+		u.dispatch(k, b.Buffer, b.Source)
+		delete(u.batches, k)
 	}
 }
 
-// based on https://text.baldanders.info/golang/gzip-operation/
-func makeGzip(buf []byte) ([]byte, error) {
-	var b bytes.Buffer
+// add appends an entry to its batch, sending the batch first when it's full
+// or too old.
+func (u *AzblobUploader) add(e Entry) {
+	k := u.coalesce(e)
+	batch, ok := u.batches[k]
+	if !ok {
+		batch = u.newBatch(e)
+		u.countSource(batch, e)
+		u.batches[k] = batch
+		return
+	}
 
-	err := func() error {
-		gw := gzip.NewWriter(&b)
-		gw.Name = "fluent-bit-go-azblob"
-		gw.ModTime = time.Now()
+	// Don't let a batch which keeps receiving records outlive the maximum
+	// age until the next tick.
+	if u.expired(batch) {
+		u.logger.Debug("max batch age reached, sending batch...")
+		u.dispatch(k, batch.Buffer, batch.Source)
+		delete(u.batches, k)
+		u.add(e)
+		return
+	}
 
-		defer gw.Close()
+	limit := u.config.BatchLimitSize
+	if batch.Rule != nil && batch.Rule.LimitSize > 0 {
+		limit = batch.Rule.LimitSize
+	}
+	if uint64(len(batch.Buffer)) > limit {
+		u.logger.Debug("max size reached, sending batch...")
+		u.dispatch(k, batch.Buffer, batch.Source)
+		delete(u.batches, k)
+		u.add(e)
+		return
+	}
 
-		if _, err := gw.Write(buf); err != nil {
-			return err
+	if u.config.SourceShare > 0 && float64(batch.Noisiest) > u.config.SourceShare*float64(limit) {
+		u.logger.Debug("max source share reached, sending batch...")
+		u.dispatch(k, batch.Buffer, batch.Source)
+		delete(u.batches, k)
+		u.add(e)
+		return
+	}
+
+	batch.Buffer = appendRecord(batch.Buffer, e.Raw)
+	u.countSource(batch, e)
+	batch.Tag = e.Tag
+	batch.Source = batch.Source.merge(e.Source)
+	batch.Source.include(e.Time)
+}
+
+// countSource adds a record to the bytes of its pod in a batch. With
+// SourceShare, a batch is sent early once a single pod holds more than that
+// share of its limit, so one chatty pod can't fill the batches of a time
+// slice up to the limit and hold back the records of the others with it.
+// Records of unknown pods aren't counted.
+func (u *AzblobUploader) countSource(batch *Batch, e Entry) {
+	if u.config.SourceShare == 0 || e.Source.Pod == "" {
+		return
+	}
+
+	if batch.Sources == nil {
+		batch.Sources = map[string]int{}
+	}
+	name := e.Source.Namespace + "/" + e.Source.Pod
+	batch.Sources[name] += len(e.Raw) + 1
+	if batch.Sources[name] > batch.Noisiest {
+		batch.Noisiest = batch.Sources[name]
+	}
+}
+
+// appendRecord adds a record to a buffer. Every record is terminated by a
+// newline here and nowhere else, so however batches are combined, blobs hold
+// one record per line without blank lines in between or at the end.
+func appendRecord(buf, raw []byte) []byte {
+	buf = append(buf, raw...)
+	return append(buf, '\n')
+}
+
+func (u *AzblobUploader) newBatch(e Entry) *Batch {
+	src := e.Source
+	src.include(e.Time)
+	return &Batch{
+		Buffer:    appendRecord(nil, e.Raw),
+		CreatedAt: u.clock.Now(),
+		Slices:    []string{e.Key.TimeSlice},
+		Oldest:    e.Time,
+		Tag:       e.Tag,
+		Source:    src,
+		Rule:      u.batchRule(e.Key),
+	}
+}
+
+// batchRule returns the first of BatchRules whose pattern matches the object
+// key of a batch, with the time slice filled in, or nil. Patterns are matched
+// like file paths, so * doesn't match a slash.
+func (u *AzblobUploader) batchRule(k BatchKey) *BatchRule {
+	name := batchName(k)
+	for i, rule := range u.config.BatchRules {
+		if ok, _ := path.Match(rule.Pattern, name); ok {
+			return &u.config.BatchRules[i]
 		}
-		return nil
+	}
+
+	return nil
+}
+
+// coalesce returns the key of the batch an entry is added to. With
+// CoalesceTimeSlices, records of up to that many time slices which would go
+// to the same blob otherwise share one batch, so low-volume sources don't
+// produce a tiny blob per time slice. The batch takes the time slice of its
+// oldest record.
+func (u *AzblobUploader) coalesce(e Entry) BatchKey {
+	if u.config.CoalesceTimeSlices <= 1 {
+		return e.Key
+	}
+
+	g := e.Key
+	g.TimeSlice = ""
+
+	k, ok := u.groups[g]
+	batch := u.batches[k]
+	if !ok || batch == nil {
+		u.groups[g] = e.Key
+		return e.Key
+	}
+
+	for _, slice := range batch.Slices {
+		if slice == e.Key.TimeSlice {
+			return k
+		}
+	}
+
+	if len(batch.Slices) >= u.config.CoalesceTimeSlices {
+		u.groups[g] = e.Key
+		return e.Key
+	}
+	batch.Slices = append(batch.Slices, e.Key.TimeSlice)
+
+	if !e.Time.Before(batch.Oldest) {
+		return k
+	}
+	batch.Oldest = e.Time
+
+	// An older record moves the batch to its time slice, unless a batch of
+	// that slice is open already.
+	if _, ok := u.batches[e.Key]; ok {
+		return k
+	}
+	delete(u.batches, k)
+	u.batches[e.Key] = batch
+	u.groups[g] = e.Key
+
+	return e.Key
+}
+
+// expired reports whether a batch is due. Both limits count from the time the
+// batch was opened, not from its last record, so a steady trickle of records
+// can't hold a batch back. BatchWait is the regular flush interval, which
+// also decides how large blobs get; BatchMaxAge is an independent upper bound
+// on latency that applies even when BatchWait is configured longer. The rule
+// of a batch may have a BatchWait of its own.
+func (u *AzblobUploader) expired(b *Batch) bool {
+	age := u.clock.Now().Sub(b.CreatedAt)
+	wait := u.config.BatchWait
+	if b.Rule != nil && b.Rule.Wait > 0 {
+		wait = b.Rule.Wait
+	}
+	if age >= wait {
+		return true
+	}
+
+	return u.config.BatchMaxAge > 0 && age >= u.config.BatchMaxAge
+}
+
+// dispatch sends a batch in the background. By default batches are sent in
+// parallel, so two batches with the same key may be written in any order.
+// With PreserveOrder a send waits for the previous send of the same key to
+// finish, which keeps blobs in enqueue order but limits throughput to one
+// in-flight upload per batch key.
+func (u *AzblobUploader) dispatch(k BatchKey, b []byte, src Source) {
+	if !u.config.PreserveOrder {
+		u.wg.Add(1)
+		go func() {
+			defer u.wg.Done()
+			u.send(k, b, src)
+		}()
+		return
+	}
+
+	u.after(k, func() { u.send(k, b, src) })
+}
+
+// after runs f in the background once the previous send of k is done, and
+// makes it the one the next send of k waits for.
+func (u *AzblobUploader) after(k BatchKey, f func()) {
+	prev := u.inflight[k]
+	done := make(chan struct{})
+	u.inflight[k] = done
+
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		defer close(done)
+
+		if prev != nil {
+			<-prev
+		}
+		f()
 	}()
+}
 
-	return b.Bytes(), err
+// batchName names a batch in the logs before it has an object key.
+func batchName(k BatchKey) string {
+	return strings.ReplaceAll(k.ObjectKeyFormat, "%{time_slice}", k.TimeSlice)
 }
 
-func (u *AzblobUploader) upload(objectKey string, b []byte) error {
-	ctx, cancel := context.WithTimeout(
-		context.Background(), Timeout*time.Second)
-	defer cancel()
+// flushed removes a batch sent during shutdown from the pending ones.
+func (u *AzblobUploader) flushed(name string) {
+	u.pendingMu.Lock()
+	defer u.pendingMu.Unlock()
 
-	if u.config.AutoCreateContainer {
-		err := u.ensureContainer(ctx)
-		if err != nil {
-			return err
+	delete(u.pending, name)
+}
+
+// releaseInflight forgets the sends which are already finished.
+func (u *AzblobUploader) releaseInflight() {
+	for k, done := range u.inflight {
+		select {
+		case <-done:
+			delete(u.inflight, k)
+		default:
 		}
 	}
+}
 
-	blobURL := u.container.NewBlockBlobURL(objectKey)
-	options := azblob.UploadToBlockBlobOptions{
-		BlockSize:   BlockSize,
-		Parallelism: Parallelism,
+// Stop sends the batches which are left and waits at most ShutdownTimeout
+// for them and the uploads in flight, so a hanging upload doesn't hold up
+// fluent-bit until it kills the process. Batches which aren't delivered by
+// then are logged.
+func (u *AzblobUploader) Stop() {
+	if u.admin != nil {
+		u.admin.Stop()
 	}
-	_, err := azblob.UploadBufferToBlockBlob(ctx, b, blobURL, options)
-	if err != nil {
-		u.logger.Errorf("upload to blob error: %s", err.Error())
-		return err
+	u.once.Do(func() { close(u.quit) })
+
+	done := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if u.config.ShutdownTimeout > 0 {
+		timeout = time.After(u.config.ShutdownTimeout)
 	}
 
-	return nil
+	delivered := false
+	select {
+	case <-done:
+		delivered = true
+	case <-timeout:
+		u.pendingMu.Lock()
+		for name, size := range u.pending {
+			u.logger.Errorf("shutdown timeout reached, batch not delivered, blob=%s size: %d bytes",
+				name, size)
+		}
+		u.pendingMu.Unlock()
+	}
+
+	// The spool retries no more batches and no more webhook posts are
+	// started, so the ones in flight are the last.
+	if u.spool != nil {
+		u.spool.Stop()
+	}
+	u.webhooksMu.Lock()
+	u.webhooksClosed = true
+	u.webhooksMu.Unlock()
+
+	if !delivered {
+		return
+	}
+
+	// The receipts of the last batches are posted in what's left of
+	// ShutdownTimeout.
+	posted := make(chan struct{})
+	go func() {
+		u.webhooks.Wait()
+		close(posted)
+	}()
+	select {
+	case <-posted:
+	case <-timeout:
+		u.logger.Warn("shutdown timeout reached, webhook posts not sent")
+	}
 }
 
-func (u *AzblobUploader) ensureContainer(ctx context.Context) error {
-	var err error
+func (u *AzblobUploader) sendBatch(k BatchKey, b []byte, src Source) {
+	// Records the filters emptied leave only their newlines; a batch of
+	// nothing else would write a blob without records, or none at all.
+	if len(bytes.Trim(b, "\n")) == 0 {
+		skipped := atomic.AddUint64(&u.skipped, 1)
+		u.logger.Debugf("empty batch skipped, key=%s skipped=%d", k.ObjectKeyFormat, skipped)
+		return
+	}
 
-	_, err = u.container.GetProperties(ctx, azblob.LeaseAccessConditions{})
-	if err == nil {
-		return nil
+	var sums []batchSum
+	if u.config.DedupWindow > 0 {
+		s := batchSum{key: k, sum: sha256.Sum256(b)}
+		if u.duplicate(s) {
+			duplicates := atomic.AddUint64(&u.duplicates, 1)
+			u.logger.Debugf("duplicate batch skipped, key=%s duplicates=%d", batchName(k), duplicates)
+			return
+		}
+		sums = []batchSum{s}
 	}
 
-	_, err = u.container.Create(ctx, azblob.Metadata{}, PublicAccessType)
-	if err != nil {
-		return err
+	// the key the batch was dispatched with
+	order := k
+	format := u.format(b)
+	k.ObjectKeyFormat = strings.ReplaceAll(
+		k.ObjectKeyFormat, "%{file_extension}", string(format))
+	objectKey := u.shortenKey(restartKey(u.lateKey(k, len(b)), u.restartID))
+
+	if prev := u.rollover(k, objectKey); prev != "" {
+		u.finalize(k.Container, prev, format)
 	}
 
-	return nil
+	// mirrored once the primary blob has the batch, or it's buffered
+	if u.config.ErrorContainer != "" && u.hasErrors(b) {
+		defer u.mirrorErrors(objectKey, b, format, src)
+	}
+
+	b, src, sums, ok := u.bufferAppend(order, objectKey, b, format, src, sums)
+	if !ok {
+		return
+	}
+
+	if err := u.sendBlob(k.Container, objectKey, b, format, src); err != nil {
+		u.forgetSums(sums)
+	}
+}
+
+// duplicate tells whether a batch is the same as one of the last DedupWindow
+// batches of its batch key, and remembers its hash otherwise. The hashes are
+// forgotten every DefaultOpenBlobsLimit batch keys, and those of batches
+// which weren't delivered as soon as that's known.
+func (u *AzblobUploader) duplicate(b batchSum) bool {
+	k, sum := b.key, b.sum
+
+	u.dedupMu.Lock()
+	defer u.dedupMu.Unlock()
+
+	seen := u.dedup[k]
+	for _, s := range seen {
+		if s == sum {
+			return true
+		}
+	}
+
+	if u.dedup == nil || (seen == nil && len(u.dedup) >= DefaultOpenBlobsLimit) {
+		u.dedup = map[BatchKey][][sha256.Size]byte{}
+	}
+	if len(seen) == u.config.DedupWindow {
+		seen = append(seen[:0], seen[1:]...)
+	}
+	u.dedup[k] = append(seen, sum)
+
+	return false
+}
+
+// forgetSums drops the hashes of batches which weren't delivered, so the same
+// records sent again aren't skipped as duplicates of them.
+func (u *AzblobUploader) forgetSums(sums []batchSum) {
+	if len(sums) == 0 {
+		return
+	}
+
+	u.dedupMu.Lock()
+	defer u.dedupMu.Unlock()
+
+	for _, b := range sums {
+		seen := u.dedup[b.key]
+		for i, s := range seen {
+			if s == b.sum {
+				u.dedup[b.key] = append(seen[:i:i], seen[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// hasErrors tells whether a batch holds a record of ErrorLevel or above. The
+// severity is read from the LevelKey field of the records as they're stored;
+// records without one count as LevelDefault.
+func (u *AzblobUploader) hasErrors(b []byte) bool {
+	min := severities[u.config.ErrorLevel]
+	key := []byte(strconv.Quote(u.config.LevelKey))
+
+	for _, line := range bytes.Split(b, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+
+		level := u.config.LevelDefault
+		// only records which have the key at all are decoded
+		var r map[string]interface{}
+		if bytes.Contains(line, key) && jsoniter.Unmarshal(line, &r) == nil {
+			level = parseLevel(r[u.config.LevelKey], u.config.LevelDefault)
+		}
+		if n, ok := severities[level]; ok && n >= min {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mirrorErrors writes a batch with errors to the blob of the same name in
+// ErrorContainer as well, which makes a small archive of the batches worth
+// keeping longer. It's written after the primary blob, and retried only
+// ErrorMirrorRetries times; a failed mirror is only logged.
+func (u *AzblobUploader) mirrorErrors(objectKey string, b []byte, format FileFormat, src Source) {
+	l := u.logger.WithFields(src.fields()).WithField("object_key", objectKey)
+
+	blocks, err := u.encodeBatch(b, format)
+	if err != nil {
+		l.Error(err.Error())
+		return
+	}
+
+	i := accountIndex(objectKey, len(u.containers))
+	container := u.containerURL(i, u.config.ErrorContainer)
+	if u.config.BlobType == AppendBlob {
+		defer u.lockBlob(blobName(u.config.ErrorContainer, objectKey))()
+	}
+
+	retries := uint64(ErrorMirrorRetries)
+	err = retry(&retries, func() error {
+		u.slots <- struct{}{}
+		err := u.upload(l, container, objectKey, blocks)
+		<-u.slots
+		if perr, ok := err.(partialAppendError); ok {
+			blocks = blocks[perr.appended:]
+		}
+		return err
+	})
+	if err != nil {
+		l.WithField("error_code", errorCode(err)).Errorf(
+			"mirror batch error, container=%s blob=%s: %v", u.config.ErrorContainer, objectKey, err)
+	}
+}
+
+// targetKey returns the object key a batch is written to. With
+// BlobTargetSize, the batches of a key are appended to the same blob until
+// they add up to that size, even when the key changes per batch, e.g. with
+// %{uuid}, so a steady flow of full batches doesn't produce a blob per batch.
+// A new time slice starts a new blob.
+func (u *AzblobUploader) targetKey(k BatchKey, size int) string {
+	if u.config.BlobTargetSize == 0 {
+		return u.objectKey(k)
+	}
+
+	id := k
+	id.TimeSlice = ""
+
+	u.targetsMu.Lock()
+	defer u.targetsMu.Unlock()
+
+	t, ok := u.targets[id]
+	if !ok || t.timeSlice != k.TimeSlice || t.size >= u.config.BlobTargetSize {
+		t = &blobTarget{objectKey: u.objectKey(k), timeSlice: k.TimeSlice}
+		u.targets[id] = t
+	}
+	t.size += uint64(size)
+
+	return t.objectKey
+}
+
+// lateKey returns the object key a batch is written to. With
+// LateRecordGrace, a batch of a time slice which is late, because a batch of
+// a new time slice was sent since, goes to the blob the time slice was
+// last written to if that was less than LateRecordGrace ago, rather than
+// starting a blob of its own. Later, the late records start a new blob.
+func (u *AzblobUploader) lateKey(k BatchKey, size int) string {
+	if u.config.LateRecordGrace == 0 {
+		return u.targetKey(k, size)
+	}
+
+	id := k
+	id.TimeSlice = ""
+	now := u.clock.Now()
+
+	u.lateMu.Lock()
+	defer u.lateMu.Unlock()
+
+	for key, slices := range u.late {
+		for slice, b := range slices.blobs {
+			if now.Sub(b.sentAt) >= u.config.LateRecordGrace {
+				delete(slices.blobs, slice)
+			}
+		}
+		if len(slices.blobs) == 0 && key != id {
+			delete(u.late, key)
+		}
+	}
+
+	slices, ok := u.late[id]
+	if !ok {
+		slices = &lateSlices{blobs: map[string]*lateBlob{}}
+		u.late[id] = slices
+	}
+
+	b, ok := slices.blobs[k.TimeSlice]
+	if !ok {
+		slices.current = k.TimeSlice
+	}
+	if slices.current == k.TimeSlice {
+		b = &lateBlob{objectKey: u.targetKey(k, size)}
+		slices.blobs[k.TimeSlice] = b
+	} else {
+		u.logger.Debugf("late records of time_slice=%s go to blob=%s",
+			k.TimeSlice, b.objectKey)
+	}
+	b.sentAt = now
+
+	return b.objectKey
+}
+
+// format returns how a batch is stored. With CompressionMinBytes, batches
+// below it aren't worth compressing and are stored as text.
+func (u *AzblobUploader) format(b []byte) FileFormat {
+	if u.config.StoreAs == GzipFormat && uint64(len(b)) < u.config.CompressionMinBytes {
+		return PlainTextFormat
+	}
+
+	return u.config.StoreAs
+}
+
+// rollover returns the blob which was written for the same object key format
+// before, when the object key changed since, e.g. because the day in the key
+// changed. It's empty unless blobs are finalized.
+func (u *AzblobUploader) rollover(k BatchKey, objectKey string) string {
+	if u.config.BlobType != AppendBlob ||
+		(u.config.FinalizeMarker == "" && !u.config.FinalizeMetadata) {
+		return ""
+	}
+
+	k.TimeSlice = ""
+
+	u.streamsMu.Lock()
+	defer u.streamsMu.Unlock()
+
+	prev := u.streams[k]
+	u.streams[k] = objectKey
+	if prev == objectKey {
+		return ""
+	}
+
+	return prev
+}
+
+// finalize marks an append blob as complete, so readers tailing it know no
+// more records follow: FinalizeMarker is appended as the last line and the
+// metadata key "finalized" is set to "true". Records which arrive late for
+// the blob are still appended after the marker.
+func (u *AzblobUploader) finalize(containerName, objectKey string, format FileFormat) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), Timeout*time.Second)
+	defer cancel()
+
+	// Buffered batches go before the marker.
+	name := blobName(containerName, objectKey)
+	u.appendsMu.Lock()
+	ab, ok := u.appends[name]
+	delete(u.appends, name)
+	u.appendsMu.Unlock()
+	if ok {
+		u.sendBuffer(ab)
+	}
+
+	container := u.target(accountIndex(objectKey, len(u.containers)), containerName)
+
+	blobURL := container.NewAppendBlobURL(objectKey)
+	u.blobsMu.Lock()
+	if state, ok := u.blobs.Get(blobID(container, objectKey)); ok && state.url != nil {
+		blobURL = *state.url
+	}
+	u.blobsMu.Unlock()
+
+	l := u.logger.WithField("blob", redactURL(blobURL.URL()))
+
+	if u.config.FinalizeMarker != "" {
+		unlock := u.lockBlob(name)
+		blocks, err := u.encodeBatch(
+			appendRecord(nil, []byte(u.config.FinalizeMarker)), format)
+		if err == nil {
+			err = u.appendBlocks(l, blobURL, blocks)
+		}
+		unlock()
+		if err != nil {
+			l.Errorf("append finalize marker error: %s", err.Error())
+			return
+		}
+	}
+
+	if u.config.FinalizeMetadata {
+		props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+		if err == nil {
+			metadata := props.NewMetadata()
+			metadata["finalized"] = "true"
+			_, err = blobURL.SetMetadata(ctx, metadata, azblob.BlobAccessConditions{})
+		}
+		if err != nil {
+			l.WithField("error_code", errorCode(err)).Errorf(
+				"set finalized metadata error: %s", err.Error())
+			return
+		}
+	}
+
+	l.Info("blob finalized")
+}
+
+// bufferAppend collects the batches of an append blob until AppendBufferSize
+// is reached and returns them together, or false while they are held back.
+//
+// Every append is a gzip member of its own, so appending small batches
+// compresses poorly and adds a block per batch to the blob. Buffering trades
+// latency for ratio: records wait until the buffer is full, or at most
+// AppendBufferMaxAge (plus the check interval) when few records arrive, and
+// buffered records are lost if the process dies before they are appended.
+func (u *AzblobUploader) bufferAppend(k BatchKey, objectKey string, b []byte,
+	format FileFormat, src Source, sums []batchSum) ([]byte, Source, []batchSum, bool) {
+	if u.config.AppendBufferSize == 0 {
+		return b, src, sums, true
+	}
+
+	u.appendsMu.Lock()
+	defer u.appendsMu.Unlock()
+
+	name := blobName(k.Container, objectKey)
+	ab, ok := u.appends[name]
+	if ok {
+		ab.buf = append(ab.buf, b...)
+		ab.source = ab.source.merge(src)
+		ab.key = k
+		ab.sums = append(ab.sums, sums...)
+	} else {
+		ab = &appendBuffer{key: k, container: k.Container, objectKey: objectKey, buf: b,
+			format: format, source: src, createdAt: u.clock.Now(), sums: sums}
+		u.appends[name] = ab
+	}
+
+	if uint64(len(ab.buf)) < u.config.AppendBufferSize &&
+		u.clock.Now().Sub(ab.createdAt) < u.config.AppendBufferMaxAge {
+		return nil, Source{}, nil, false
+	}
+	delete(u.appends, name)
+
+	return ab.buf, ab.source, ab.sums, true
+}
+
+// sendBuffer writes an append buffer to its blob.
+func (u *AzblobUploader) sendBuffer(ab *appendBuffer) {
+	if err := u.sendBlob(ab.container, ab.objectKey, ab.buf, ab.format, ab.source); err != nil {
+		u.forgetSums(ab.sums)
+	}
+}
+
+// flushAppendBuffers appends the buffers which reached AppendBufferMaxAge, or
+// all of them with force.
+//
+// With PreserveOrder a buffer is flushed after the sends of its batch key
+// already dispatched, which may still add to it, and before the later ones.
+func (u *AzblobUploader) flushAppendBuffers(force bool) {
+	due := map[string]*appendBuffer{}
+
+	u.appendsMu.Lock()
+	for name, ab := range u.appends {
+		if ab.queued && !force {
+			continue
+		}
+		if force || u.clock.Now().Sub(ab.createdAt) >= u.config.AppendBufferMaxAge {
+			due[name] = ab
+			if force || !u.config.PreserveOrder {
+				delete(u.appends, name)
+			}
+			ab.queued = true
+		}
+	}
+	u.appendsMu.Unlock()
+
+	if !force && u.config.PreserveOrder {
+		for name, ab := range due {
+			name, ab := name, ab
+			u.after(ab.key, func() {
+				// the buffer may have filled up and been sent meanwhile
+				u.appendsMu.Lock()
+				ok := u.appends[name] == ab
+				if ok {
+					delete(u.appends, name)
+				}
+				u.appendsMu.Unlock()
+
+				if ok {
+					u.logger.Debug("max append buffer age reached, sending buffer...")
+					u.sendBuffer(ab)
+				}
+			})
+		}
+		return
+	}
+
+	for name, ab := range due {
+		u.logger.Debug("max append buffer age reached, sending buffer...")
+		if force {
+			u.sendBuffer(ab)
+			u.flushed(name)
+		} else {
+			ab := ab
+			u.wg.Add(1)
+			go func() {
+				defer u.wg.Done()
+				u.sendBuffer(ab)
+			}()
+		}
+	}
+}
+
+// sendBlob writes a batch to the blob named objectKey in container, or in
+// Azure_Container when it's empty. Its errors are logged with the object key
+// and the source of the records. The error is returned when the batch isn't
+// written to the blob, even when it's dead-lettered or spooled.
+func (u *AzblobUploader) sendBlob(container, objectKey string, b []byte, format FileFormat,
+	src Source) error {
+	l := u.logger.WithFields(src.fields()).WithField("object_key", objectKey)
+	if container != "" {
+		l = l.WithField("storage_container", container)
+	}
+	l.Debugf("upload blob=%s size: %d bytes", objectKey, len(b))
+
+	blocks, err := u.encodeBatch(b, format)
+	if err != nil {
+		l.Error(err.Error())
+		return err
+	}
+
+	err = u.deliver(l, container, objectKey, blocks, u.config.BatchRetryLimit, src)
+	if err == nil {
+		u.setFailure(nil)
+		return nil
+	}
+
+	if u.config.DeadLetterContainer != "" && isPermanent(err) {
+		derr := u.deadLetter(objectKey, blocks, err)
+		if derr == nil {
+			l.WithField("error_code", errorCode(err)).Warnf(
+				"permanent failure, batch dead-lettered, blob=%s: %v", objectKey, err)
+			return err
+		}
+		l.WithField("error_code", errorCode(derr)).Errorf(
+			"dead-letter batch error, blob=%s: %v", objectKey, derr)
+	}
+
+	if u.spool != nil {
+		serr := u.spool.Write(container, objectKey, bytes.Join(blocks, nil))
+		if serr == nil {
+			return err
+		}
+		l.Errorf("spool batch error, blob=%s: %v", objectKey, serr)
+	}
+
+	dropped := atomic.AddUint64(&u.dropped, 1)
+	l.WithField("error_code", errorCode(err)).Errorf(
+		"permanent failure, batch dropped, blob=%s dropped=%d: %v", objectKey, dropped, err)
+	u.setFailure(err)
+
+	return err
+}
+
+// deadLetter writes a batch which was rejected for good to a block blob of
+// its own under DeadLetterPrefix in DeadLetterContainer, so it can be
+// analyzed or replayed later. The blob is named after the intended one and
+// its metadata holds the intended blob and the error.
+func (u *AzblobUploader) deadLetter(objectKey string, blocks [][]byte, cause error) error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), Timeout*time.Second)
+	defer cancel()
+
+	i := accountIndex(objectKey, len(u.containers))
+	container := u.containerURL(i, u.config.DeadLetterContainer)
+	if u.config.AutoCreateContainer {
+		if err := u.ensureContainer(ctx, container); err != nil {
+			return err
+		}
+	}
+
+	now := u.clock.Now().UTC()
+	name := fmt.Sprintf("%s%s.%s-%s", u.config.DeadLetterPrefix, objectKey,
+		now.Format("20060102T150405Z"), uuid.NewV4().String())
+	blobURL := container.NewBlockBlobURL(name)
+
+	_, err := azblob.UploadBufferToBlockBlob(ctx, bytes.Join(blocks, nil), blobURL,
+		azblob.UploadToBlockBlobOptions{
+			Metadata: azblob.Metadata{
+				"object_key": metadataValue(objectKey),
+				"error_code": errorCode(cause),
+				"error":      metadataValue(cause.Error()),
+				"failed_at":  now.Format(time.RFC3339),
+			},
+		})
+
+	return err
+}
+
+// metadataValue makes s fit for a metadata value, which is sent as a header:
+// it's kept to one line of printable ASCII of at most 1024 characters.
+func metadataValue(s string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s) && len(b) < 1024; i++ {
+		switch c := s[i]; {
+		case c >= ' ' && c <= '~':
+			b = append(b, c)
+		case c == '\n' || c == '\t':
+			b = append(b, ' ')
+		}
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+func (u *AzblobUploader) setFailure(err error) {
+	u.failureMu.Lock()
+	defer u.failureMu.Unlock()
+
+	u.failure = err
+	u.failedAt = u.clock.Now()
+}
+
+// Err returns the error of the last batch which was lost, until a batch is
+// delivered again.
+func (u *AzblobUploader) Err() error {
+	u.failureMu.Lock()
+	defer u.failureMu.Unlock()
+
+	return u.failure
+}
+
+// FlushErr returns the error a flush is rejected with, that of the last batch
+// which was lost. Records are acknowledged to fluent-bit before their batch
+// is sent, so this is how a failing storage is reported back: rejected
+// flushes make fluent-bit retry the chunks itself. Once every BatchWait one
+// flush gets nil, so its records probe whether the storage recovered.
+func (u *AzblobUploader) FlushErr() error {
+	u.failureMu.Lock()
+	defer u.failureMu.Unlock()
+
+	if u.failure == nil {
+		return nil
+	}
+
+	if u.clock.Now().Sub(u.failedAt) >= u.config.BatchWait {
+		u.failedAt = u.clock.Now()
+		return nil
+	}
+
+	return u.failure
+}
+
+// encodeBatch converts a batch to the blocks written to the blob. A block blob
+// is uploaded as a whole. An append blob takes at most AppendBlockSize per
+// AppendBlock, so the batch is split on record boundaries and, with gzip,
+// every block is compressed as a gzip member of its own.
+func (u *AzblobUploader) encodeBatch(b []byte, format FileFormat) ([][]byte, error) {
+	if u.config.BlobType != AppendBlob {
+		if format != GzipFormat {
+			return [][]byte{b}, nil
+		}
+
+		buf, err := makeGzip(b)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{buf}, nil
+	}
+
+	if format != GzipFormat {
+		return splitChunks(b, AppendBlockSize), nil
+	}
+
+	chunks := splitChunks(b, AppendBlockSize-GzipHeadroom)
+	for i, chunk := range chunks {
+		buf, err := makeGzip(chunk)
+		if err != nil {
+			return nil, err
+		}
+		chunks[i] = buf
+	}
+
+	return chunks, nil
+}
+
+// blocks splits already encoded blob content, e.g. a spooled batch, into the
+// blocks written to the blob.
+func (u *AzblobUploader) blocks(b []byte) [][]byte {
+	if u.config.BlobType != AppendBlob {
+		return [][]byte{b}
+	}
+
+	return splitChunks(b, AppendBlockSize)
+}
+
+// splitChunks splits b into chunks of at most limit bytes. Chunks end on a
+// newline unless a single record is longer than limit.
+func splitChunks(b []byte, limit int) [][]byte {
+	var chunks [][]byte
+
+	for len(b) > limit {
+		i := bytes.LastIndexByte(b[:limit], '\n')
+		if i < 0 {
+			i = limit - 1
+		}
+
+		chunks = append(chunks, b[:i+1])
+		b = b[i+1:]
+	}
+
+	if len(b) > 0 {
+		chunks = append(chunks, b)
+	}
+
+	return chunks
+}
+
+// deliver uploads a blob to one of the storage accounts. Blobs are sharded
+// across the accounts by the object key. With several accounts, a batch
+// fails over to the next account after AccountRetries retries, and comes
+// back to an account in later turns until the retry limit of that account is
+// reached, so a degraded account doesn't hold up its batches even without a
+// retry limit. The next account gets the whole batch.
+//
+// A batch of several append blocks can't be appended atomically. When a block
+// fails, the retries continue with that block, so the batch ends up in the
+// blob once and complete, rather than with a gap or with its first blocks
+// twice.
+//
+// At most UploadParallelism blobs are written at a time, but the
+// writes to one append blob never overlap: the blocks of a batch, including
+// its retries, are appended in order before the next batch for the same blob
+// starts, so the records of a batch are never interleaved with another one.
+//
+// The blob gets the labels of src as its index tags once written.
+func (u *AzblobUploader) deliver(l *logrus.Entry, containerName, objectKey string,
+	blocks [][]byte, attempts *uint64, src Source) error {
+	var err error
+
+	// With LateRecordGrace, block blobs are extended by late records, so
+	// their writes are serialized too.
+	if u.config.BlobType == AppendBlob || u.config.LateRecordGrace > 0 {
+		defer u.lockBlob(blobName(containerName, objectKey))()
+	}
+
+	n := len(u.containers)
+	first := accountIndex(objectKey, n)
+	turn := attempts
+	if n > 1 && (attempts == nil || *attempts > AccountRetries) {
+		retries := uint64(AccountRetries)
+		turn = &retries
+	}
+
+	tries := make([]uint64, n)
+	done := make([]bool, n)
+	remaining := make([][][]byte, n)
+	for i := range remaining {
+		remaining[i] = blocks
+	}
+
+	for j, left := 0, n; left > 0; j++ {
+		i := (first + j) % n
+		if done[i] {
+			continue
+		}
+		container := u.target(i, containerName)
+
+		limit := turn
+		if attempts != nil && *attempts-tries[i] < *turn {
+			retries := *attempts - tries[i]
+			limit = &retries
+		}
+		err = retry(limit, func() error {
+			tries[i]++
+			u.slots <- struct{}{}
+			err := u.upload(l, container, objectKey, remaining[i])
+			<-u.slots
+			if perr, ok := err.(partialAppendError); ok {
+				remaining[i] = remaining[i][perr.appended:]
+			}
+			if isServiceCode(err, azblob.ServiceCodeContainerNotFound) {
+				u.containerState(container).reset()
+			}
+			return err
+		})
+
+		if err == nil {
+			atomic.AddUint64(&u.uploads, 1)
+			for _, block := range blocks {
+				atomic.AddUint64(&u.sentBytes, uint64(len(block)))
+			}
+			u.succeeded(objectKey)
+			if len(src.Labels) > 0 {
+				u.setTags(l, container, objectKey, src.Labels)
+			}
+			if u.config.NotifyQueue != nil || u.config.WebhookURL != nil {
+				n := u.notification(container, objectKey, blocks, src)
+				if u.config.NotifyQueue != nil {
+					u.notify(l, n)
+				}
+				if u.config.WebhookURL != nil {
+					u.startWebhook(l, n)
+				}
+			}
+			return nil
+		}
+
+		if isPermanent(err) || (attempts != nil && tries[i] > *attempts) {
+			done[i] = true
+			left--
+			l.Errorf("retry limit reached, blob=%s account=%s",
+				objectKey, container.URL().Host)
+			continue
+		}
+		l.Warnf("failing over to the next account, blob=%s account=%s",
+			objectKey, container.URL().Host)
+	}
+
+	atomic.AddUint64(&u.failures, 1)
+	return err
+}
+
+// succeeded records the time of an upload for the LastSuccessPrefixes the
+// object key starts with.
+func (u *AzblobUploader) succeeded(objectKey string) {
+	now := u.clock.Now()
+
+	u.successMu.Lock()
+	defer u.successMu.Unlock()
+
+	for _, prefix := range u.config.LastSuccessPrefixes {
+		if strings.HasPrefix(objectKey, prefix) {
+			u.successes[prefix] = now
+		}
+	}
+}
+
+// writeMetrics writes the metrics in the Prometheus text format. The gauge of
+// a prefix appears with its first upload, so streams which never flowed are
+// caught with absent().
+func (u *AzblobUploader) writeMetrics(w io.Writer) {
+	// A buffer which fills up means the records come in faster than they're
+	// batched, and fluent-bit waits for the plugin.
+	fmt.Fprintln(w, "# HELP azblob_entries_buffer_capacity Entries the buffer of records holds.")
+	fmt.Fprintln(w, "# TYPE azblob_entries_buffer_capacity gauge")
+	fmt.Fprintf(w, "azblob_entries_buffer_capacity %d\n", cap(u.Entries))
+	fmt.Fprintln(w, "# HELP azblob_entries_buffer_depth Entries waiting in the buffer of records.")
+	fmt.Fprintln(w, "# TYPE azblob_entries_buffer_depth gauge")
+	fmt.Fprintf(w, "azblob_entries_buffer_depth %d\n", len(u.Entries))
+	fmt.Fprintln(w, "# HELP azblob_entries_buffer_high_watermark "+
+		"Most entries seen waiting in the buffer of records.")
+	fmt.Fprintln(w, "# TYPE azblob_entries_buffer_high_watermark gauge")
+	fmt.Fprintf(w, "azblob_entries_buffer_high_watermark %d\n", atomic.LoadUint64(&u.entriesHigh))
+	fmt.Fprintln(w, "# HELP azblob_empty_batches_skipped_total Batches not uploaded as they held no records.")
+	fmt.Fprintln(w, "# TYPE azblob_empty_batches_skipped_total counter")
+	fmt.Fprintf(w, "azblob_empty_batches_skipped_total %d\n", atomic.LoadUint64(&u.skipped))
+	fmt.Fprintln(w, "# HELP azblob_duplicate_batches_skipped_total "+
+		"Batches not uploaded as they repeated a recent batch of their key.")
+	fmt.Fprintln(w, "# TYPE azblob_duplicate_batches_skipped_total counter")
+	fmt.Fprintf(w, "azblob_duplicate_batches_skipped_total %d\n", atomic.LoadUint64(&u.duplicates))
+	c := u.counters()
+	fmt.Fprintln(w, "# HELP azblob_uploads_total Blob writes which succeeded.")
+	fmt.Fprintln(w, "# TYPE azblob_uploads_total counter")
+	fmt.Fprintf(w, "azblob_uploads_total %d\n", c.uploads)
+	fmt.Fprintln(w, "# HELP azblob_uploaded_bytes_total Bytes of the blob writes which succeeded.")
+	fmt.Fprintln(w, "# TYPE azblob_uploaded_bytes_total counter")
+	fmt.Fprintf(w, "azblob_uploaded_bytes_total %d\n", c.sentBytes)
+	fmt.Fprintln(w, "# HELP azblob_upload_failures_total Batches which failed on every storage account.")
+	fmt.Fprintln(w, "# TYPE azblob_upload_failures_total counter")
+	fmt.Fprintf(w, "azblob_upload_failures_total %d\n", c.failures)
+
+	u.successMu.Lock()
+	defer u.successMu.Unlock()
+
+	if len(u.successes) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "# HELP azblob_last_success_timestamp_seconds "+
+		"Time of the last successful upload of a blob under the prefix.")
+	fmt.Fprintln(w, "# TYPE azblob_last_success_timestamp_seconds gauge")
+	for _, prefix := range u.config.LastSuccessPrefixes {
+		t, ok := u.successes[prefix]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "azblob_last_success_timestamp_seconds{prefix=%s} %.3f\n",
+			strconv.Quote(prefix), float64(t.UnixNano())/1e9)
+	}
+}
+
+// uploadParallelism is the limit of requests in flight, which defaults to
+// Parallelism when the config doesn't set one.
+func uploadParallelism(c *AzblobConfig) int {
+	if c.UploadParallelism > 0 {
+		return c.UploadParallelism
+	}
+
+	return Parallelism
+}
+
+func (u *AzblobUploader) objectKey(k BatchKey) string {
+	objectKey := k.ObjectKeyFormat
+	objectKey = strings.ReplaceAll(objectKey, "%{hostname}", Hostname)
+	objectKey = strings.ReplaceAll(objectKey, "%{instance_id}", InstanceID)
+	objectKey = strings.ReplaceAll(objectKey, "%{uuid}", uuid.NewV4().String())
+	objectKey = strings.ReplaceAll(objectKey, "%{time_slice}", k.TimeSlice)
+	objectKey = strings.ReplaceAll(objectKey, "%{route}", k.Route)
+	objectKey = strings.ReplaceAll(objectKey, "%{level}", k.Level)
+	objectKey = strings.ReplaceAll(objectKey, "%{tag}", k.Tag)
+	objectKey = strings.ReplaceAll(objectKey, "%{image}", k.Image)
+	if strings.Contains(objectKey, "%{upload_date}") {
+		objectKey = strings.ReplaceAll(
+			objectKey, "%{upload_date}", u.uploadDate())
+	}
+
+	if strings.Contains(objectKey, "%{hash}") {
+		objectKey = strings.ReplaceAll(
+			objectKey, "%{hash}", keyHash(strings.ReplaceAll(objectKey, "%{hash}", "")))
+	}
+
+	// An empty placeholder at the start of the format (e.g. an unresolved
+	// hostname) must not produce a blob name beginning with "/".
+	return strings.TrimLeft(objectKey, "/")
+}
+
+// uploadDate is the time of the upload, as opposed to the time slice of the
+// records which comes from the records themselves.
+func (u *AzblobUploader) uploadDate() string {
+	now := u.now()
+	if u.config.Location != nil {
+		now = now.In(u.config.Location)
+	}
+
+	return now.Format(u.config.UploadDateFormat)
+}
+
+// now is the local time, or with ClockSkewLimit the time of the storage
+// service as far as it's known from the Date header of the last response.
+func (u *AzblobUploader) now() time.Time {
+	return u.clock.Now().Add(time.Duration(atomic.LoadInt64(&u.clockOffset)))
+}
+
+func (u *AzblobUploader) observeDate(date time.Time) {
+	if u.config.ClockSkewLimit == 0 || date.IsZero() {
+		return
+	}
+
+	atomic.StoreInt64(&u.clockOffset, int64(date.Sub(u.clock.Now())))
+}
+
+// clampTime limits a record time to ClockSkewLimit around the time of the
+// storage service, so records from a node with a skewed clock don't end up in
+// time slices far in the past or future.
+func (u *AzblobUploader) clampTime(t time.Time) time.Time {
+	if u.config.ClockSkewLimit == 0 {
+		return t
+	}
+
+	now := u.now()
+	switch {
+	case t.Before(now.Add(-u.config.ClockSkewLimit)):
+		return now.Add(-u.config.ClockSkewLimit)
+	case t.After(now.Add(u.config.ClockSkewLimit)):
+		return now.Add(u.config.ClockSkewLimit)
+	}
+
+	return t
+}
+
+// accountIndex picks the storage account for an object key.
+func accountIndex(objectKey string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(objectKey))
+
+	return int(h.Sum32() % uint32(n))
+}
+
+// keyHash returns the value of %{hash}, a short hash of the rest of the
+// object key. Azure partitions blobs by name ranges, so names which share a
+// time prefix all go to one partition and are throttled together. With the
+// hash at the start of the key, writes are spread across partitions while the
+// same key still maps to the same blob.
+func keyHash(objectKey string) string {
+	h := fnv.New32a()
+	h.Write([]byte(objectKey))
+
+	return fmt.Sprintf("%04x", h.Sum32()&0xffff)
+}
+
+// shortenKey makes an object key fit MaxKeyLength, e.g. when it's built from
+// long pod names or labels. The longest path components are cut and end with
+// a hash of what they were, so the same key always gets the same name and
+// keys which differ only in what's cut still get different ones. The file
+// name keeps its extension. The name a key is shortened to is logged once.
+func (u *AzblobUploader) shortenKey(objectKey string) string {
+	limit := MaxKeyLength - KeySuffixRoom
+	if len(objectKey) <= limit {
+		return objectKey
+	}
+
+	parts := strings.Split(objectKey, "/")
+	last := len(parts) - 1
+	_, name, ext := splitKey(parts[last])
+	parts[last] = name
+
+	for excess := len(objectKey) - limit; excess > 0; {
+		longest := 0
+		for i, part := range parts {
+			if len(part) > len(parts[longest]) {
+				longest = i
+			}
+		}
+
+		part := parts[longest]
+		h := fnv.New64a()
+		h.Write([]byte(part))
+		hash := fmt.Sprintf("%016x", h.Sum64())
+		keep := len(part) - excess - len(hash) - 1
+		if keep < 0 {
+			keep = 0
+		}
+		for keep > 0 && !utf8.RuneStart(part[keep]) {
+			keep--
+		}
+		short := part[:keep] + "~" + hash
+		if len(short) >= len(part) {
+			// nothing left to cut
+			break
+		}
+
+		parts[longest] = short
+		excess -= len(part) - len(short)
+	}
+	parts[last] += ext
+	shortened := strings.Join(parts, "/")
+
+	u.shortMu.Lock()
+	defer u.shortMu.Unlock()
+
+	if !u.shortened[objectKey] {
+		if u.shortened == nil || len(u.shortened) >= DefaultOpenBlobsLimit {
+			u.shortened = map[string]bool{}
+		}
+		u.shortened[objectKey] = true
+		u.logger.Warnf("object key too long, shortened, key=%s blob=%s", objectKey, shortened)
+	}
+
+	return shortened
+}
+
+func retry(attempts *uint64, f Func) error {
+	counter := uint64(0)
+	interval := time.Second
+
+	for {
+		err := f()
+
+		if err == nil {
+			return nil
+		}
+
+		if isPermanent(err) {
+			return err
+		}
+
+		if attempts == nil || counter < *attempts {
+			counter++
+
+			// Add some randomness to prevent creating a Thundering Herd
+			jitter := time.Duration(rand.Int63n(int64(interval)))
+			interval = interval + jitter/2
+			time.Sleep(interval)
+			continue
+		}
+
+		return err
+	}
+}
+
+// countRecords returns the number of records in the blocks of a blob, which
+// are compressed or not. It's read from the blocks themselves, so spooled
+// blobs are counted too.
+func countRecords(blocks [][]byte) int {
+	n := 0
+	for _, block := range blocks {
+		if _, ok := gzipSize(block); !ok {
+			n += bytes.Count(block, []byte{'\n'})
+			continue
+		}
+
+		r, err := gzip.NewReader(bytes.NewReader(block))
+		if err != nil {
+			continue
+		}
+		buf := make([]byte, 32*1024)
+		for {
+			m, err := r.Read(buf)
+			n += bytes.Count(buf[:m], []byte{'\n'})
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	return n
+}
+
+// addRecordCount adds the records of the blocks appended to an append blob to
+// its "record_count" metadata. It's best-effort and costs two requests per
+// append: a failure is only logged, and records of a failed append which are
+// retried later are counted only once appended again.
+func (u *AzblobUploader) addRecordCount(ctx context.Context, blobURL azblob.AppendBlobURL,
+	blocks [][]byte) {
+	l := u.logger.WithField("blob", redactURL(blobURL.URL()))
+
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err == nil {
+		metadata := props.NewMetadata()
+		count, _ := strconv.Atoi(metadata["record_count"])
+		metadata["record_count"] = strconv.Itoa(count + countRecords(blocks))
+		_, err = blobURL.SetMetadata(ctx, metadata, azblob.BlobAccessConditions{
+			ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: props.ETag()},
+		})
+	}
+	if err != nil {
+		l.WithField("error_code", errorCode(err)).Warnf(
+			"update record_count metadata error: %s", err.Error())
+	}
+}
+
+// gzipSize returns the uncompressed size of a gzip blob of one member from its
+// trailer, or false when b isn't gzip.
+func gzipSize(b []byte) (uint32, bool) {
+	if len(b) < 18 || b[0] != 0x1f || b[1] != 0x8b {
+		return 0, false
+	}
+
+	return binary.LittleEndian.Uint32(b[len(b)-4:]), true
+}
+
+// based on https://text.baldanders.info/golang/gzip-operation/
+func makeGzip(buf []byte) ([]byte, error) {
+	var b bytes.Buffer
+
+	err := func() error {
+		gw := gzip.NewWriter(&b)
+		gw.Name = "fluent-bit-go-azblob"
+		gw.ModTime = time.Now()
+
+		defer gw.Close()
+
+		if _, err := gw.Write(buf); err != nil {
+			return err
+		}
+		return nil
+	}()
+
+	return b.Bytes(), err
+}
+
+// upload writes blocks to the blob named objectKey in container. Errors are
+// logged with l, which carries the context of the batch.
+func (u *AzblobUploader) upload(l *logrus.Entry,
+	container azblob.ContainerURL, objectKey string, blocks [][]byte) error {
+	ctx, cancel := phaseContext(u.config.SetupTimeout)
+	defer cancel()
+
+	// Without AutoCreateContainer the container is assumed to exist and no
+	// container request is made at all, so identities which may only write
+	// blobs work.
+	if u.config.AutoCreateContainer {
+		err := u.ensureContainer(ctx, container)
+		if err != nil {
+			return err
+		}
+	}
+
+	if u.config.BlobType == AppendBlob {
+		blobURL, err := u.rotate(ctx, container, objectKey, blocks)
+		if err != nil {
+			return err
+		}
+		if u.config.CreateFirst {
+			if err := u.createFirst(ctx, container, objectKey, blobURL); err != nil {
+				return err
+			}
+		}
+
+		write := func() error {
+			if err := u.writeBOM(ctx, container, objectKey, blobURL, blocks); err != nil {
+				return err
+			}
+			return u.appendBlocks(l, blobURL, blocks)
+		}
+		err = write()
+		// A blob of another type, e.g. from a run with Blob_Type block, can't
+		// be appended to, so the records go to the next part instead.
+		for isServiceCode(err, azblob.ServiceCodeInvalidBlobType) {
+			next := u.skipPart(container, objectKey, blocks)
+			l.Warnf("blob %s isn't an append blob, appending to %s instead",
+				redactURL(blobURL.URL()), redactURL(next.URL()))
+			blobURL = next
+			err = write()
+		}
+		if err != nil {
+			u.forget(container, objectKey)
+			return err
+		}
+
+		if u.config.RecordCountMetadata {
+			ctx, cancel := phaseContext(u.config.UploadTimeout)
+			defer cancel()
+			u.addRecordCount(ctx, blobURL, blocks)
+		}
+		return nil
+	}
+
+	// The block blob is written in a context of its own, whatever the
+	// container took.
+	ctx, cancel = phaseContext(u.config.UploadTimeout)
+	defer cancel()
+
+	blobURL := container.NewBlockBlobURL(objectKey)
+	options := azblob.UploadToBlockBlobOptions{
+		BlockSize:   BlockSize,
+		Parallelism: uint16(uploadParallelism(u.config)),
+	}
+	if u.config.BlobType == UniqueBlob {
+		options.AccessConditions.ModifiedAccessConditions.IfNoneMatch = azblob.ETagAny
+	}
+	// A block blob is written from one block, which isn't copied again:
+	// bytes.Join always copies, even a single slice.
+	b := blocks[0]
+	if len(blocks) > 1 {
+		b = bytes.Join(blocks, nil)
+	}
+	// A block blob is new with every upload, except when it's extended.
+	if _, ok := gzipSize(b); u.config.WriteBOM && !ok && !u.extending(container, objectKey) {
+		b = append(append(make([]byte, 0, len(BOM)+len(b)), BOM...), b...)
+	}
+	// The size is read from the gzip trailer rather than passed along, so
+	// spooled blobs get it too.
+	if size, ok := gzipSize(b); ok {
+		if u.config.GzipContentEncoding {
+			options.BlobHTTPHeaders.ContentEncoding = "gzip"
+		} else {
+			options.BlobHTTPHeaders.ContentType = "application/gzip"
+		}
+		options.Metadata = azblob.Metadata{"uncompressed_size": strconv.FormatUint(uint64(size), 10)}
+	}
+	if u.config.RecordCountMetadata {
+		if options.Metadata == nil {
+			options.Metadata = azblob.Metadata{}
+		}
+		options.Metadata["record_count"] = strconv.Itoa(countRecords(blocks))
+	}
+
+	start := time.Now()
+	var resp azblob.CommonResponse
+	var err error
+	if u.config.LateRecordGrace > 0 {
+		resp, err = u.extendBlob(ctx, blobID(container, objectKey), blobURL, b, options)
+	} else {
+		resp, err = azblob.UploadBufferToBlockBlob(ctx, b, blobURL, options)
+	}
+	l = l.WithFields(logrus.Fields{
+		"blob":     redactURL(blobURL.URL()),
+		"bytes":    len(b),
+		"duration": time.Since(start),
+	})
+	if u.config.BlobType == UniqueBlob &&
+		isServiceCode(err, azblob.ServiceCodeBlobAlreadyExists) {
+		// The name is unique to the batch, so the blob was written by an
+		// earlier attempt whose response got lost, or which failed to
+		// protect it.
+		l.Info("blob already exists, skip upload")
+		return u.protect(ctx, container, blobURL.URL())
+	}
+	if err != nil {
+		l.WithField("error_code", errorCode(err)).Errorf(
+			"upload to blob error: %s", err.Error())
+		return err
+	}
+	l.Debug("upload to blob")
+	u.observeDate(resp.Date())
+
+	return u.protect(ctx, container, blobURL.URL())
+}
+
+// protect sets the immutability policy of ImmutabilityDays and the legal hold
+// of LegalHold on a block blob just written.
+func (u *AzblobUploader) protect(ctx context.Context, container azblob.ContainerURL,
+	blobURL url.URL) error {
+	if u.config.ImmutabilityDays > 0 {
+		if err := u.setImmutabilityPolicy(ctx, container, blobURL); err != nil {
+			return err
+		}
+	}
+	if u.config.LegalHold {
+		return u.setLegalHold(ctx, container, blobURL)
+	}
+
+	return nil
+}
+
+// extending tells whether the next write to a block blob extends it, as it
+// was written less than LateRecordGrace ago.
+func (u *AzblobUploader) extending(container azblob.ContainerURL, objectKey string) bool {
+	if u.config.LateRecordGrace == 0 {
+		return false
+	}
+
+	u.listsMu.Lock()
+	defer u.listsMu.Unlock()
+
+	list, ok := u.lists[blobID(container, objectKey)]
+	return ok && u.clock.Now().Sub(list.writtenAt) < u.config.LateRecordGrace
+}
+
+// extendBlob writes a block blob from blocks staged one by one. When the blob
+// was written less than LateRecordGrace ago, the blocks follow the ones it
+// was made of then, so late records are added to it rather than replacing
+// it, and its uncompressed_size and record_count metadata add up.
+func (u *AzblobUploader) extendBlob(ctx context.Context, id string, blobURL azblob.BlockBlobURL,
+	b []byte, options azblob.UploadToBlockBlobOptions) (azblob.CommonResponse, error) {
+	now := u.clock.Now()
+
+	u.listsMu.Lock()
+	for name, list := range u.lists {
+		if now.Sub(list.writtenAt) >= u.config.LateRecordGrace {
+			delete(u.lists, name)
+		}
+	}
+	list := &blockList{writtenAt: now}
+	if prev, ok := u.lists[id]; ok {
+		*list = *prev
+		list.ids = append([]string(nil), prev.ids...)
+		list.writtenAt = now
+	}
+	u.listsMu.Unlock()
+
+	for _, chunk := range splitChunks(b, BlockSize) {
+		blockID := base64.StdEncoding.EncodeToString(uuid.NewV4().Bytes())
+		_, err := blobURL.StageBlock(ctx, blockID, bytes.NewReader(chunk),
+			azblob.LeaseAccessConditions{}, nil)
+		if err != nil {
+			return nil, err
+		}
+		list.ids = append(list.ids, blockID)
+	}
+
+	if size, ok := gzipSize(b); ok {
+		list.size += uint64(size)
+		options.Metadata["uncompressed_size"] = strconv.FormatUint(list.size, 10)
+	}
+	if _, ok := options.Metadata["record_count"]; ok {
+		list.records += countRecords([][]byte{b})
+		options.Metadata["record_count"] = strconv.Itoa(list.records)
+	}
+
+	resp, err := blobURL.CommitBlockList(ctx, list.ids, options.BlobHTTPHeaders,
+		options.Metadata, options.AccessConditions)
+	if err != nil {
+		return nil, err
+	}
+
+	u.listsMu.Lock()
+	u.lists[id] = list
+	u.listsMu.Unlock()
+
+	return resp, nil
+}
+
+// phaseContext returns the context of a phase of an upload, which times out
+// after d, or Timeout when it's not configured.
+func phaseContext(d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		d = Timeout * time.Second
+	}
+
+	return context.WithTimeout(context.Background(), d)
+}
+
+// sendHeartbeat overwrites a small blob with the current time and hostname,
+// so monitoring can tell the plugin is alive and can write to the storage
+// even while no records arrive. Expired credentials or a lost connection
+// show up as a stale heartbeat.
+func (u *AzblobUploader) sendHeartbeat() {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), Timeout*time.Second)
+	defer cancel()
+
+	objectKey := u.objectKey(BatchKey{ObjectKeyFormat: u.config.HeartbeatKeyFormat})
+	container := u.containers[accountIndex(objectKey, len(u.containers))]
+	blobURL := container.NewBlockBlobURL(objectKey)
+	l := u.logger.WithField("blob", redactURL(blobURL.URL()))
+
+	b, err := marshalJSON(map[string]interface{}{
+		"time":        u.now().UTC().Format(time.RFC3339),
+		"hostname":    Hostname,
+		"instance_id": InstanceID,
+		"version":     Version,
+	})
+	if err != nil {
+		l.Errorf("heartbeat error: %s", err.Error())
+		return
+	}
+
+	if u.config.AutoCreateContainer {
+		err = u.ensureContainer(ctx, container)
+	}
+	if err == nil {
+		var resp azblob.CommonResponse
+		resp, err = azblob.UploadBufferToBlockBlob(ctx, b, blobURL,
+			azblob.UploadToBlockBlobOptions{
+				BlobHTTPHeaders: azblob.BlobHTTPHeaders{ContentType: "application/json"},
+			})
+		if err == nil {
+			u.observeDate(resp.Date())
+		}
+	}
+	if err != nil {
+		l.WithField("error_code", errorCode(err)).Errorf(
+			"heartbeat error: %s", err.Error())
+		return
+	}
+	l.Debug("heartbeat")
+}
+
+// setTags sets the index tags of the blob just written to objectKey, so blobs
+// can be found by them without listing. Append blobs are only tagged again
+// when their tags change. It's best-effort: a failure is only logged.
+func (u *AzblobUploader) setTags(l *logrus.Entry, container azblob.ContainerURL,
+	objectKey string, tags map[string]string) {
+	body := tagsXML(tags)
+
+	name := objectKey
+	if u.config.BlobType == AppendBlob {
+		u.blobsMu.Lock()
+		state, ok := u.blobs.Get(blobID(container, objectKey))
+		unchanged := ok && state.tags == body
+		if ok {
+			name = partKey(objectKey, state.part)
+			state.tags = body
+		}
+		u.blobsMu.Unlock()
+
+		if !ok || unchanged {
+			return
+		}
+	}
+
+	p := u.pipeline(container)
+	if p == nil {
+		l.Warnf("set blob tags error, no request pipeline for container %s",
+			redactURL(container.URL()))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), Timeout*time.Second)
+	defer cancel()
+
+	blobURL := container.NewBlobURL(name).URL()
+	q := blobURL.Query()
+	q.Set("comp", "tags")
+	blobURL.RawQuery = q.Encode()
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	_, _, err := doRequest(ctx, p, http.MethodPut, blobURL, header, []byte(body))
+	if err != nil {
+		l.WithField("error_code", errorCode(err)).Warnf(
+			"set index tags error, blob=%s: %v", name, err)
+	}
+}
+
+// tagsXML returns the body of a Set Blob Tags request, with the tags sorted
+// so the same tags always give the same body.
+func tagsXML(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?><Tags><TagSet>`)
+	for _, k := range keys {
+		b.WriteString("<Tag><Key>")
+		xml.EscapeText(&b, []byte(k))
+		b.WriteString("</Key><Value>")
+		xml.EscapeText(&b, []byte(tags[k]))
+		b.WriteString("</Value></Tag>")
+	}
+	b.WriteString("</TagSet></Tags>")
+
+	return b.String()
+}
+
+// pipeline returns the request pipeline of the storage account of a
+// container, for the requests the azblob SDK doesn't provide. Containers
+// other than Azure_Container, e.g. of Container_Key, are in the account of
+// the one their URL shares the host and the path of the account with.
+func (u *AzblobUploader) pipeline(container azblob.ContainerURL) pipeline.Pipeline {
+	account := accountURL(container)
+	for i, c := range u.containers {
+		if accountURL(c) == account && i < len(u.pipelines) {
+			return u.pipelines[i]
+		}
+	}
+
+	return nil
+}
+
+// accountURL returns the URL of the storage account of a container without
+// its query, e.g. "myaccount.blob.core.windows.net/", or
+// "127.0.0.1:10000/devstoreaccount1" with path-style URLs.
+func accountURL(container azblob.ContainerURL) string {
+	u := container.URL()
+
+	return u.Host + path.Dir(u.Path)
+}
+
+// setImmutabilityPolicy keeps a blob from being modified or deleted for
+// ImmutabilityDays.
+func (u *AzblobUploader) setImmutabilityPolicy(
+	ctx context.Context, container azblob.ContainerURL, blobURL url.URL) error {
+	until := u.clock.Now().AddDate(0, 0, u.config.ImmutabilityDays).UTC()
+
+	header := http.Header{}
+	header.Set("x-ms-immutability-policy-until-date", until.Format(http.TimeFormat))
+	header.Set("x-ms-immutability-policy-mode", "Unlocked")
+
+	err := u.setImmutability(ctx, container, blobURL, "immutabilityPolicies", header,
+		"set immutability policy")
+	if err == nil {
+		u.logger.WithField("until", until).Debug("set immutability policy")
+	}
+
+	return err
+}
+
+// setLegalHold keeps a blob from being modified or deleted until the hold is
+// cleared.
+func (u *AzblobUploader) setLegalHold(
+	ctx context.Context, container azblob.ContainerURL, blobURL url.URL) error {
+	header := http.Header{}
+	header.Set("x-ms-legal-hold", "true")
+
+	err := u.setImmutability(ctx, container, blobURL, "legalhold", header, "set legal hold")
+	if err == nil {
+		u.logger.Debug("set legal hold")
+	}
+
+	return err
+}
+
+// setImmutability makes one of the requests of version-level immutability
+// support on the container, which the SDK in use predates, so it's made
+// directly. The service rejects it on containers without that support.
+func (u *AzblobUploader) setImmutability(ctx context.Context, container azblob.ContainerURL,
+	blobURL url.URL, comp string, header http.Header, what string) error {
+	p := u.pipeline(container)
+	if p == nil {
+		return permanentError{fmt.Errorf("no request pipeline for container %s",
+			redactURL(container.URL()))}
+	}
+
+	q := blobURL.Query()
+	q.Set("comp", comp)
+	blobURL.RawQuery = q.Encode()
+
+	_, _, err := doRequest(ctx, p, http.MethodPut, blobURL, header, nil)
+	if err != nil {
+		l := u.logger.WithFields(logrus.Fields{
+			"blob":       redactURL(blobURL),
+			"error_code": errorCode(err),
+		})
+		if rerr, ok := err.(*RESTError); ok && rerr.StatusCode < http.StatusInternalServerError {
+			l.Errorf("%s error, make sure version-level "+
+				"immutability is enabled on the container: %s", what, err.Error())
+		} else {
+			l.Errorf("%s error: %s", what, err.Error())
+		}
+		return err
+	}
+
+	return nil
+}
+
+// rotate returns the client of the part of an append blob the blocks are
+// appended to. With MaxBlobSize or MaxBlobBlocks a new part is started once
+// the current part would grow past either limit, so an append never fails on
+// the 50,000 blocks an append blob can hold. The size and block count of a
+// part are read from the storage the first time the blob is written, so the
+// numbering survives restarts.
+//
+// The clients are kept in a cache of at most OpenBlobsLimit blobs, so they
+// aren't built again for every write while the number of blobs, e.g. one per
+// pod, stays bounded.
+func (u *AzblobUploader) rotate(ctx context.Context, container azblob.ContainerURL,
+	objectKey string, blocks [][]byte) (azblob.AppendBlobURL, error) {
+	var size int64
+	for _, block := range blocks {
+		size += int64(len(block))
+	}
+	max := int64(u.config.MaxBlobSize)
+	maxBlocks := u.config.MaxBlobBlocks
+	full := func(state *blobState) bool {
+		return (max > 0 && state.size+size > max) ||
+			(maxBlocks > 0 && state.blocks+len(blocks) > maxBlocks)
+	}
+
+	// The parts are looked up without holding blobsMu, so a slow storage
+	// doesn't hold up the writers of other blobs; those of the same blob are
+	// serialized by lockBlob.
+	id := blobID(container, objectKey)
+	u.blobsMu.Lock()
+	state, ok := u.blobs.Get(id)
+	u.blobsMu.Unlock()
+	if !ok {
+		found, err := u.findPart(ctx, container, objectKey, full)
+		if err != nil {
+			return azblob.AppendBlobURL{}, err
+		}
+
+		u.blobsMu.Lock()
+		if state, ok = u.blobs.Get(id); !ok {
+			state = found
+			u.blobs.Add(id, state)
+		}
+		u.blobsMu.Unlock()
+	}
+
+	u.blobsMu.Lock()
+	defer u.blobsMu.Unlock()
+
+	if (state.size > 0 || state.blocks > 0) && full(state) {
+		reason := "max blob size"
+		if max == 0 || state.size+size <= max {
+			reason = "max blob blocks"
+		}
+		state.part++
+		state.size = 0
+		state.blocks = 0
+		state.tags = ""
+		state.created = false
+		state.bom = false
+		state.url = nil
+		u.logger.Infof("%s reached, blob=%s part=%d", reason, objectKey, state.part)
+	}
+	state.size += size
+	state.blocks += len(blocks)
+
+	if state.url == nil {
+		blobURL := container.NewAppendBlobURL(partKey(objectKey, state.part))
+		state.url = &blobURL
+	}
+
+	return *state.url, nil
+}
+
+// findPart reads the state of the first part of an append blob which isn't
+// full from the storage. Without MaxBlobSize and MaxBlobBlocks the blob has
+// a single part, which isn't read.
+func (u *AzblobUploader) findPart(ctx context.Context, container azblob.ContainerURL,
+	objectKey string, full func(*blobState) bool) (*blobState, error) {
+	state := &blobState{}
+	for u.config.MaxBlobSize > 0 || u.config.MaxBlobBlocks > 0 {
+		blobURL := container.NewBlobURL(partKey(objectKey, state.part))
+		props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+		if isServiceCode(err, azblob.ServiceCodeBlobNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		state.size = props.ContentLength()
+		state.created = true
+		if n := props.BlobCommittedBlockCount(); n > 0 {
+			state.blocks = int(n)
+		}
+		if !full(state) {
+			break
+		}
+		state.part++
+		state.size = 0
+		state.blocks = 0
+		state.created = false
+		state.bom = false
+	}
+
+	return state, nil
+}
+
+// skipPart moves an append blob on to its next part, which the blocks are
+// appended to, and returns it.
+func (u *AzblobUploader) skipPart(container azblob.ContainerURL, objectKey string,
+	blocks [][]byte) azblob.AppendBlobURL {
+	u.blobsMu.Lock()
+	defer u.blobsMu.Unlock()
+
+	id := blobID(container, objectKey)
+	state, ok := u.blobs.Get(id)
+	if !ok {
+		state = &blobState{}
+		u.blobs.Add(id, state)
+	}
+
+	state.part++
+	state.size = 0
+	state.tags = ""
+	state.created = false
+	state.bom = false
+	for _, block := range blocks {
+		state.size += int64(len(block))
+	}
+	state.blocks = len(blocks)
+	blobURL := container.NewAppendBlobURL(partKey(objectKey, state.part))
+	state.url = &blobURL
+
+	return blobURL
+}
+
+// lockBlob waits until no other batch is written to objectKey and returns the
+// function which lets the next one in.
+func (u *AzblobUploader) lockBlob(objectKey string) func() {
+	u.writingMu.Lock()
+	l, ok := u.writing[objectKey]
+	if !ok {
+		l = &blobLock{}
+		u.writing[objectKey] = l
+	}
+	l.refs++
+	u.writingMu.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		u.writingMu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(u.writing, objectKey)
+		}
+		u.writingMu.Unlock()
+	}
+}
+
+// forget drops what is known about an append blob after a failed write, so
+// it is read again from the storage on the next write.
+func (u *AzblobUploader) forget(container azblob.ContainerURL, objectKey string) {
+	u.blobsMu.Lock()
+	defer u.blobsMu.Unlock()
+
+	u.blobs.Remove(blobID(container, objectKey))
+}
+
+func blobID(container azblob.ContainerURL, objectKey string) string {
+	containerURL := container.URL()
+
+	return containerURL.Host + containerURL.Path + "/" + objectKey
+}
+
+// blobName names the blob objectKey in container for the locks and buffers
+// of blobs. An empty container is Azure_Container, whose blobs go by their
+// object key alone.
+func blobName(container, objectKey string) string {
+	if container == "" {
+		return objectKey
+	}
+
+	return container + "/" + objectKey
+}
+
+// partKey returns the name of a part of a blob. The first part keeps the
+// object key as it is; the following ones have "-<part>" inserted before
+// the file extensions, e.g. "logs/app-2.log.gz", unless the object key has a
+// %{part} placeholder.
+func partKey(objectKey string, part int) string {
+	if strings.Contains(objectKey, "%{part}") {
+		return strings.ReplaceAll(objectKey, "%{part}", strconv.Itoa(part))
+	}
+
+	if part == 0 {
+		return objectKey
+	}
+
+	dir, name, ext := splitKey(objectKey)
+
+	return fmt.Sprintf("%s%s-%d%s", dir, name, part, ext)
+}
+
+// splitKey splits an object key into its directory, the name of the blob up
+// to the first dot and the extension from it on.
+func splitKey(objectKey string) (dir, name, ext string) {
+	dir, name = path.Split(objectKey)
+	if i := strings.Index(name, "."); i > 0 {
+		name, ext = name[:i], name[i:]
+	}
+
+	return dir, name, ext
+}
+
+// restartKey adds the restart ID to an object key, before the extension like
+// the part number, so blobs of different runs never have the same name.
+func restartKey(objectKey, restartID string) string {
+	if restartID == "" {
+		return objectKey
+	}
+
+	dir, name, ext := splitKey(objectKey)
+
+	return fmt.Sprintf("%s%s-%s%s", dir, name, restartID, ext)
+}
+
+// createFirst creates an append blob before the first append to it, unless
+// it's known to exist already, so the first append to a new blob doesn't fail
+// with BlobNotFound and has to be sent again. An existing blob is left as it
+// is.
+func (u *AzblobUploader) createFirst(ctx context.Context, container azblob.ContainerURL,
+	objectKey string, blobURL azblob.AppendBlobURL) error {
+	id := blobID(container, objectKey)
+	u.blobsMu.Lock()
+	state := u.partState(id, blobURL)
+	u.blobsMu.Unlock()
+	if state != nil && state.created {
+		return nil
+	}
+
+	_, err := blobURL.Create(ctx, azblob.BlobHTTPHeaders{}, azblob.Metadata{},
+		azblob.BlobAccessConditions{
+			ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny},
+		})
+	if err != nil && !isServiceCode(err, azblob.ServiceCodeBlobAlreadyExists) {
+		return err
+	}
+
+	u.blobsMu.Lock()
+	if state := u.partState(id, blobURL); state != nil {
+		state.created = true
+	}
+	u.blobsMu.Unlock()
+
+	return nil
+}
+
+// partState returns the state of the append blob id while blobURL is its
+// current part, or nil once the blob rotated since. blobsMu must be held.
+func (u *AzblobUploader) partState(id string, blobURL azblob.AppendBlobURL) *blobState {
+	state, ok := u.blobs.Get(id)
+	if !ok || state.url == nil || state.url.URL() != blobURL.URL() {
+		return nil
+	}
+
+	return state
+}
+
+// writeBOM starts a new text append blob with a BOM. It's appended only at
+// position 0, so a blob gets it once however many writers append to it, and
+// the blob cache remembers the parts which have it or don't need it, so it
+// costs a request per part rather than per write.
+func (u *AzblobUploader) writeBOM(ctx context.Context, container azblob.ContainerURL,
+	objectKey string, blobURL azblob.AppendBlobURL, blocks [][]byte) error {
+	if !u.config.WriteBOM {
+		return nil
+	}
+	if _, ok := gzipSize(blocks[0]); ok {
+		return nil
+	}
+
+	id := blobID(container, objectKey)
+	u.blobsMu.Lock()
+	state := u.partState(id, blobURL)
+	u.blobsMu.Unlock()
+	if state != nil && state.bom {
+		return nil
+	}
+
+	empty := azblob.AppendBlobAccessConditions{
+		AppendPositionAccessConditions: azblob.AppendPositionAccessConditions{IfAppendPositionEqual: -1},
+	}
+	_, err := blobURL.AppendBlock(ctx, bytes.NewReader(BOM), empty, nil)
+	if isServiceCode(err, azblob.ServiceCodeBlobNotFound) {
+		_, err = blobURL.Create(ctx, azblob.BlobHTTPHeaders{}, azblob.Metadata{},
+			azblob.BlobAccessConditions{
+				ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny},
+			})
+		if err == nil || isServiceCode(err, azblob.ServiceCodeBlobAlreadyExists) {
+			_, err = blobURL.AppendBlock(ctx, bytes.NewReader(BOM), empty, nil)
+		}
+	}
+	if err != nil && !isServiceCode(err, azblob.ServiceCodeAppendPositionConditionNotMet) {
+		return err
+	}
+
+	u.blobsMu.Lock()
+	if state := u.partState(id, blobURL); state != nil {
+		state.created = true
+		state.bom = true
+	}
+	u.blobsMu.Unlock()
+
+	return nil
+}
+
+// appendBlocks appends the blocks in order, creating the blob on the first
+// write to it. When a block after the first one fails, the error is a
+// partialAppendError.
+func (u *AzblobUploader) appendBlocks(l *logrus.Entry, blobURL azblob.AppendBlobURL,
+	blocks [][]byte) error {
+	for i, block := range blocks {
+		start := time.Now()
+		err := u.appendBlock(blobURL, block)
+		l := l.WithFields(logrus.Fields{
+			"blob":     redactURL(blobURL.URL()),
+			"bytes":    len(block),
+			"duration": time.Since(start),
+		})
+		if err != nil {
+			l.WithField("error_code", errorCode(err)).Errorf(
+				"append to blob error: %s", err.Error())
+			if i > 0 {
+				return partialAppendError{error: err, appended: i}
+			}
+			return err
+		}
+		l.Debug("append to blob")
+	}
+
+	return nil
+}
+
+func (u *AzblobUploader) appendBlock(blobURL azblob.AppendBlobURL, block []byte) error {
+	ctx, cancel := phaseContext(u.config.UploadTimeout)
+	defer cancel()
+
+	if u.config.SequenceMetadata {
+		return u.appendSequenced(ctx, blobURL, block)
+	}
+
+	resp, err := blobURL.AppendBlock(ctx, bytes.NewReader(block),
+		azblob.AppendBlobAccessConditions{}, nil)
+	if err == nil {
+		u.observeDate(resp.Date())
+		return nil
+	}
+	if !isServiceCode(err, azblob.ServiceCodeBlobNotFound) {
+		return err
+	}
+
+	_, err = blobURL.Create(ctx, azblob.BlobHTTPHeaders{}, azblob.Metadata{},
+		azblob.BlobAccessConditions{})
+	if err != nil && !isServiceCode(err, azblob.ServiceCodeBlobAlreadyExists) {
+		return err
+	}
+
+	resp, err = blobURL.AppendBlock(ctx, bytes.NewReader(block),
+		azblob.AppendBlobAccessConditions{}, nil)
+	if err != nil {
+		return err
+	}
+	u.observeDate(resp.Date())
+
+	return nil
+}
+
+// appendSequenced appends a block and increments the "sequence" metadata of
+// the blob while holding a lease on it, so the appends of other writers doing
+// the same, e.g. other instances, can't slip in between and the sequence
+// counts every append. A failed count is only logged rather than returned:
+// the block is appended already and sending it again would duplicate it, and
+// the sequence lagging the committed block count is what readers look for.
+func (u *AzblobUploader) appendSequenced(ctx context.Context, blobURL azblob.AppendBlobURL,
+	block []byte) error {
+	leaseID, err := u.acquireLease(ctx, blobURL)
+	if err != nil {
+		return err
+	}
+	lease := azblob.LeaseAccessConditions{LeaseID: leaseID}
+	defer func() {
+		_, err := blobURL.ReleaseLease(ctx, leaseID, azblob.ModifiedAccessConditions{})
+		if err != nil {
+			u.logger.WithField("blob", redactURL(blobURL.URL())).Warnf(
+				"release lease error: %s", err.Error())
+		}
+	}()
+
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{LeaseAccessConditions: lease})
+	if err != nil {
+		return err
+	}
+	resp, err := blobURL.AppendBlock(ctx, bytes.NewReader(block),
+		azblob.AppendBlobAccessConditions{LeaseAccessConditions: lease}, nil)
+	if err != nil {
+		return err
+	}
+	u.observeDate(resp.Date())
+
+	metadata := props.NewMetadata()
+	sequence, _ := strconv.ParseUint(metadata["sequence"], 10, 64)
+	metadata["sequence"] = strconv.FormatUint(sequence+1, 10)
+	_, err = blobURL.SetMetadata(ctx, metadata, azblob.BlobAccessConditions{LeaseAccessConditions: lease})
+	if err != nil {
+		u.logger.WithFields(logrus.Fields{
+			"blob":       redactURL(blobURL.URL()),
+			"error_code": errorCode(err),
+		}).Errorf("update sequence metadata error: %s", err.Error())
+	}
+
+	return nil
+}
+
+// acquireLease takes a lease on an append blob, creating the blob first if it
+// doesn't exist, and waits while another writer holds one.
+func (u *AzblobUploader) acquireLease(ctx context.Context, blobURL azblob.AppendBlobURL) (string, error) {
+	for {
+		resp, err := blobURL.AcquireLease(ctx, "", SequenceLeaseDuration,
+			azblob.ModifiedAccessConditions{})
+		if err == nil {
+			return resp.LeaseID(), nil
+		}
+
+		switch {
+		case isServiceCode(err, azblob.ServiceCodeBlobNotFound):
+			_, err = blobURL.Create(ctx, azblob.BlobHTTPHeaders{}, azblob.Metadata{},
+				azblob.BlobAccessConditions{})
+			if err != nil && !isServiceCode(err, azblob.ServiceCodeBlobAlreadyExists) {
+				return "", err
+			}
+		case isServiceCode(err, azblob.ServiceCodeLeaseAlreadyPresent):
+			select {
+			case <-ctx.Done():
+				return "", err
+			case <-time.After(LeaseRetryInterval):
+			}
+		default:
+			return "", err
+		}
+	}
+}
+
+// permanentError is an error which sending the same data again won't fix.
+type permanentError struct {
+	error
+}
+
+// partialAppendError is a failed append of a batch whose first blocks were
+// appended already.
+type partialAppendError struct {
+	error
+	appended int
+}
+
+// isPermanent tells whether an error is permanent: the storage service
+// rejected the request as invalid or unauthorized (4xx other than timeouts
+// and throttling), or the data can't be sent at all. Network errors, timeouts,
+// throttling and server errors are transient.
+func isPermanent(err error) bool {
+	var status int
+
+	switch e := err.(type) {
+	case nil:
+		return false
+	case permanentError:
+		return true
+	case partialAppendError:
+		return isPermanent(e.error)
+	case azblob.StorageError:
+		if e.ServiceCode() == azblob.ServiceCodeContainerBeingDeleted {
+			return false
+		}
+		if e.Response() == nil {
+			return false
+		}
+		status = e.Response().StatusCode
+	case *RESTError:
+		status = e.StatusCode
+	default:
+		return false
+	}
+
+	return status >= http.StatusBadRequest &&
+		status < http.StatusInternalServerError &&
+		status != http.StatusRequestTimeout &&
+		status != http.StatusTooManyRequests
+}
+
+// redactURL drops the query of a blob URL, which holds the SAS signature.
+func redactURL(u url.URL) string {
+	u.RawQuery = ""
+
+	return u.String()
+}
+
+// errorCode returns the storage service error code of err, or the HTTP status
+// when the service didn't send one.
+func errorCode(err error) string {
+	if perr, ok := err.(partialAppendError); ok {
+		err = perr.error
+	}
+
+	if rerr, ok := err.(*RESTError); ok {
+		if rerr.Code != "" {
+			return rerr.Code
+		}
+		return strconv.Itoa(rerr.StatusCode)
+	}
+
+	serr, ok := err.(azblob.StorageError)
+	if !ok {
+		return "none"
+	}
+
+	if code := serr.ServiceCode(); code != "" {
+		return string(code)
+	}
+
+	return strconv.Itoa(serr.Response().StatusCode)
+}
+
+func isServiceCode(err error, code azblob.ServiceCodeType) bool {
+	if serr, ok := err.(azblob.StorageError); ok {
+		return serr.ServiceCode() == code
+	}
+
+	return false
+}
+
+func (u *AzblobUploader) containerState(container azblob.ContainerURL) *containerState {
+	u.createdMu.Lock()
+	defer u.createdMu.Unlock()
+
+	key := container.String()
+	s, ok := u.created[key]
+	if !ok {
+		s = &containerState{}
+		u.created[key] = s
+	}
+
+	return s
+}
+
+func (s *containerState) reset() {
+	s.mu.Lock()
+	s.created = false
+	s.mu.Unlock()
+}
+
+// precreateContainers creates the PrecreateContainers in every storage
+// account at startup, UploadParallelism at a time, so the first batches don't
+// race their creation. Containers which already exist are fine. Credentials
+// which aren't allowed to create them fail the startup, other errors are only
+// logged.
+func (u *AzblobUploader) precreateContainers() error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), Timeout*time.Second)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		authErr error
+	)
+	slots := make(chan struct{}, uploadParallelism(u.config))
+	for i := range u.containers {
+		for _, name := range u.config.PrecreateContainers {
+			container := u.containerURL(i, name)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				slots <- struct{}{}
+				defer func() { <-slots }()
+
+				err := u.ensureContainer(ctx, container)
+				if err == nil {
+					u.logger.Debugf("precreate container %s", redactURL(container.URL()))
+					return
+				}
+				u.logger.WithField("error_code", errorCode(err)).Errorf(
+					"precreate container %s error: %s", redactURL(container.URL()), err.Error())
+				if isAuthError(err) {
+					mu.Lock()
+					authErr = err
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	return authErr
+}
+
+// containerURL returns the container name in the storage account of the i-th
+// container, with the same credentials.
+func (u *AzblobUploader) containerURL(i int, name string) azblob.ContainerURL {
+	containerURL := u.containers[i].URL()
+	containerURL.Path = path.Join(path.Dir(containerURL.Path), name)
+
+	return azblob.NewContainerURL(containerURL, u.pipelines[i])
+}
+
+// target returns the container records go to in the i-th storage account:
+// Azure_Container unless name is set.
+func (u *AzblobUploader) target(i int, name string) azblob.ContainerURL {
+	if name == "" {
+		return u.containers[i]
+	}
+
+	return u.containerURL(i, name)
+}
+
+// isAuthError tells whether a request was rejected because of its
+// credentials.
+func isAuthError(err error) bool {
+	serr, ok := err.(azblob.StorageError)
+	if !ok || serr.Response() == nil {
+		return false
+	}
+
+	return serr.Response().StatusCode == http.StatusUnauthorized ||
+		serr.Response().StatusCode == http.StatusForbidden
+}
+
+// ensureContainer creates a container unless it's known to exist. Only one
+// upload per container makes the requests, the others wait for its result.
+// A container which exists already counts as created, and a container still
+// being deleted is retried with backoff until ctx is done.
+func (u *AzblobUploader) ensureContainer(
+	ctx context.Context, container azblob.ContainerURL) error {
+	s := u.containerState(container)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.created {
+		return nil
+	}
+
+	_, err := container.GetProperties(ctx, azblob.LeaseAccessConditions{})
+	if err == nil {
+		s.created = true
+		return nil
+	}
+
+	interval := ContainerCreateInterval
+	for {
+		_, err = container.Create(ctx, azblob.Metadata{}, PublicAccessType)
+		if err == nil || isServiceCode(err, azblob.ServiceCodeContainerAlreadyExists) {
+			s.created = true
+			return nil
+		}
+		if !isServiceCode(err, azblob.ServiceCodeContainerBeingDeleted) {
+			return err
+		}
+
+		u.logger.Debugf("container is being deleted, retry create in %v", interval)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
 }
 
 func init() {
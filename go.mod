@@ -4,6 +4,7 @@ go 1.15
 
 require (
 	code.cloudfoundry.org/bytefmt v0.0.0-20200131002437-cf55d5288a48
+	github.com/Azure/azure-pipeline-go v0.2.2
 	github.com/Azure/azure-storage-blob-go v0.10.0
 	github.com/fluent/fluent-bit-go v0.0.0-20200729034236-b9c0d6a20853
 	github.com/joho/godotenv v1.3.0